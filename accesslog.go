@@ -0,0 +1,101 @@
+package multireq
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// WithAccessLog logs one record to l for every proxied request: who sent
+// it, which target won, what became of each target raced, and how much was
+// written back and how long it all took. A nil l logs nothing.
+func WithAccessLog(l *slog.Logger) Option {
+	return func(p *Proxy) { p.access = l }
+}
+
+// countingWriter remembers the status and counts the body bytes written
+// through it, for the access log.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, which only a switch of protocols does.
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// clientIP returns the address r came from, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// logAccess writes the access log record of r, which w answered after the
+// race rt, if there was one, was won by winner, if anyone.
+func (p *Proxy) logAccess(r *http.Request, id string, w *countingWriter, start time.Time, rt *raceTrace, winner *Target) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("client", clientIP(r)),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", status),
+		slog.Int64("bytes", w.bytes),
+		slog.Float64("duration_ms", float64(time.Since(start))/float64(time.Millisecond)),
+	}
+	if winner != nil {
+		attrs = append(attrs, slog.String("winner", winner.String()))
+	}
+	if rt != nil {
+		targets := slices.Clone(rt.targets)
+		for i := range targets {
+			if targets[i].Outcome == "pending" {
+				targets[i].Outcome = "lost"
+			}
+		}
+		attrs = append(attrs, slog.Any("targets", targets))
+	}
+	p.access.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+}
@@ -0,0 +1,123 @@
+package multireq
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for an adaptive timeout's settings.
+const (
+	defaultAdaptivePercentile = 99
+	defaultAdaptiveFactor     = 2
+	defaultAdaptiveMin        = 100 * time.Millisecond
+	defaultAdaptiveMax        = 30 * time.Second
+)
+
+// AdaptiveTimeouts bound requests under path prefixes, longest prefix
+// first, by how long the requests there that got an answer have taken
+// recently, rather than by a fixed time.
+type AdaptiveTimeouts []*adaptiveTimeout
+
+type adaptiveTimeout struct {
+	route      string
+	percentile float64
+	factor     float64
+	min, max   time.Duration
+
+	// latencies are the times from which the timeout comes: how long
+	// answered requests under the route took from being sent to the
+	// targets to the winner's response headers.
+	latencies latencyHistogram
+
+	gauge *metricVec
+}
+
+// NewAdaptiveTimeouts builds timeouts from path prefixes to comma separated
+// settings, all optional, which are
+//
+//	percentile  the percentile of recent answered requests' times to start
+//	            from, such as p99 (the default)
+//	factor      what to multiply it by, 2 by default
+//	min, max    the shortest and longest timeout, 100ms and 30s by
+//	            default; max is also the timeout until there are enough
+//	            times to go by
+func NewAdaptiveTimeouts(routes map[string]string) (AdaptiveTimeouts, error) {
+	var ts AdaptiveTimeouts
+	for route, s := range routes {
+		a := &adaptiveTimeout{
+			route:      route,
+			percentile: defaultAdaptivePercentile,
+			factor:     defaultAdaptiveFactor,
+			min:        defaultAdaptiveMin,
+			max:        defaultAdaptiveMax,
+		}
+		settings := map[string]string{}
+		if s != "" {
+			var err error
+			if settings, err = ParseLabelList(s); err != nil {
+				return nil, fmt.Errorf("%s: %s", route, err)
+			}
+		}
+		for k, v := range settings {
+			var err error
+			switch k {
+			case "percentile":
+				a.percentile, err = strconv.ParseFloat(strings.TrimPrefix(v, "p"), 64)
+				if err == nil && (a.percentile <= 0 || a.percentile >= 100) {
+					err = errors.New("must be over 0 and under 100")
+				}
+			case "factor":
+				a.factor, err = strconv.ParseFloat(v, 64)
+				if err == nil && a.factor <= 0 {
+					err = errors.New("must be positive")
+				}
+			case "min":
+				a.min, err = time.ParseDuration(v)
+			case "max":
+				a.max, err = time.ParseDuration(v)
+			default:
+				err = errors.New("unknown setting")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", route, k, err)
+			}
+		}
+		if a.min <= 0 || a.max < a.min {
+			return nil, fmt.Errorf("%s: min must be positive and max no less than it", route)
+		}
+		ts = append(ts, a)
+	}
+	slices.SortFunc(ts, func(a, b *adaptiveTimeout) int { return len(b.route) - len(a.route) })
+	return ts, nil
+}
+
+// WithAdaptiveTimeouts bounds requests under the routes of ts by their
+// adaptive timeouts instead of the proxy's fixed one. X-Multireq-Timeout
+// still overrides both.
+func WithAdaptiveTimeouts(ts AdaptiveTimeouts) Option {
+	return func(p *Proxy) { p.adaptive = ts }
+}
+
+// match returns the adaptive timeout for path, or nil if it has none.
+func (ts AdaptiveTimeouts) match(path string) *adaptiveTimeout {
+	for _, a := range ts {
+		if strings.HasPrefix(path, a.route) {
+			return a
+		}
+	}
+	return nil
+}
+
+// timeout returns the route's current timeout.
+func (a *adaptiveTimeout) timeout(now time.Time) time.Duration {
+	d := a.max
+	if p, ok := a.latencies.percentile(a.percentile, now); ok {
+		d = min(max(time.Duration(float64(p)*a.factor), a.min), a.max)
+	}
+	a.gauge.set(d.Seconds(), a.route)
+	return d
+}
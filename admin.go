@@ -0,0 +1,43 @@
+package multireq
+
+import "net/http"
+
+// AdminHandler serves operational endpoints, to be kept apart from proxied
+// traffic on an address of their own:
+//
+//	/metrics      metrics in the Prometheus text format
+//	/errors       the most recent upstream failures, as JSON
+//	/targets      each target and whether it is healthy, as JSON; with the
+//	              admin token, POST adds a target and DELETE removes one
+//	/targets/drain, /targets/undrain
+//	              POST, with the admin token, stops or resumes sending
+//	              new requests to a target
+//	/status.json  uptime, configuration, targets and recent races, for tooling
+//	/heatmap.json, /heatmap.csv
+//	              how long each target took to answer, hour by hour over
+//	              the last week
+//	/learned      the weights hedged races have learned for each target, as
+//	              JSON; POST /learned/reset, with the admin token, forgets
+//	              them
+//	/deliveries/dead
+//	              events given up on delivering, as JSON; POST, with the
+//	              admin token, requeues them, narrowed by the target and
+//	              name form values
+//	/test-race    POST, with the admin token, races the request described
+//	              in JSON and reports what each target made of it
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.metrics.reg)
+	mux.Handle("/errors", p.errors)
+	mux.HandleFunc("/targets", p.serveTargets)
+	mux.HandleFunc("/targets/drain", p.serveDrain)
+	mux.HandleFunc("/targets/undrain", p.serveDrain)
+	mux.HandleFunc("/status.json", p.serveStatus)
+	mux.HandleFunc("/heatmap.json", p.serveHeatmap)
+	mux.HandleFunc("/heatmap.csv", p.serveHeatmap)
+	mux.HandleFunc("/learned", p.serveLearned)
+	mux.HandleFunc("/learned/reset", p.serveLearned)
+	mux.HandleFunc("/deliveries/dead", p.serveDeadLetters)
+	mux.HandleFunc("/test-race", p.serveTestRace)
+	return mux
+}
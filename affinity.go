@@ -0,0 +1,116 @@
+package multireq
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// multiLegAuth returns the scheme of the first Authorization or
+// WWW-Authenticate value that authenticates the connection rather than the
+// request, as NTLM and Negotiate do, or "" if there is none. Every leg of
+// such a handshake, and every request after it, must reach the same
+// upstream connection for the authentication to hold.
+func multiLegAuth(values []string) string {
+	for _, v := range values {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if strings.EqualFold(scheme, "NTLM") || strings.EqualFold(scheme, "Negotiate") {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// challenge reports whether resp asks the client to start a multi-leg
+// handshake.
+func challenge(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized && multiLegAuth(resp.Header.Values("WWW-Authenticate")) != ""
+}
+
+type connKey struct{}
+
+// clientConn is a client connection, which is pinned to a single upstream
+// connection on a single target once it takes part in multi-leg
+// authentication.
+type clientConn struct {
+	remote string
+
+	mu     sync.Mutex
+	target *Target
+	client *http.Client
+}
+
+// ConnContext gives each client connection's requests its clientConn.
+func (p *Proxy) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	cc := &clientConn{remote: c.RemoteAddr().String()}
+	p.conns.Store(c, cc)
+	return context.WithValue(ctx, connKey{}, cc)
+}
+
+// ConnState closes the upstream connection of a pinned client connection
+// once the client's is gone.
+func (p *Proxy) ConnState(c net.Conn, s http.ConnState) {
+	if s != http.StateClosed && s != http.StateHijacked {
+		return
+	}
+	if v, ok := p.conns.LoadAndDelete(c); ok {
+		v.(*clientConn).close()
+	}
+}
+
+// connOf returns the client connection r arrived on, or nil if the server
+// does not track them.
+func connOf(r *http.Request) *clientConn {
+	cc, _ := r.Context().Value(connKey{}).(*clientConn)
+	return cc
+}
+
+// pinned returns the target cc is pinned to and the client that reaches it
+// over cc's own upstream connection, or nil if cc is not pinned.
+func (cc *clientConn) pinned() (*Target, *http.Client) {
+	if cc == nil {
+		return nil, nil
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.target, cc.client
+}
+
+// pin pins cc to t, unless it is pinned already, and returns the target it
+// is pinned to and the client to reach it with.
+func (p *Proxy) pin(cc *clientConn, t *Target, scheme string) (*Target, *http.Client) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.target != nil {
+		return cc.target, cc.client
+	}
+	// A transport of the connection's own, allowed a single connection,
+	// keeps every request on the upstream connection that was
+	// authenticated. The handshake is not carried over HTTP/2. A target
+	// given a transport with WithTransport keeps using it.
+	client := t.client
+	if t.roundTripper == nil {
+		tr := t.transport.Clone()
+		tr.MaxConnsPerHost = 1
+		tr.MaxIdleConnsPerHost = 1
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		client = &http.Client{Transport: tr}
+	}
+	cc.target, cc.client = t, client
+	slog.Info("pinning a connection using multi-leg authentication to one target, which is no longer raced", "client", cc.remote, "scheme", scheme, "target", t.String())
+	p.metrics.pinned.inc(t.String())
+	return cc.target, cc.client
+}
+
+func (cc *clientConn) close() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.client != nil {
+		cc.client.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,238 @@
+package multireq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scrubbed values are replaced with these.
+const (
+	redacted = "[REDACTED]"
+	masked   = "***"
+)
+
+// Scrubber removes personal data from recorded responses before they are
+// written anywhere.
+type Scrubber struct {
+	// headers are redacted whole.
+	headers map[string]bool
+
+	// fields are JSON paths whose values are masked, each a list of object
+	// keys, with "*" matching any key or array element.
+	fields [][]string
+
+	// patterns are redacted wherever they match a header value, the URL or
+	// the body.
+	patterns []*regexp.Regexp
+}
+
+// NewScrubber returns a scrubber redacting the named headers, masking the
+// JSON fields at paths like user.email or items.*.card, and redacting every
+// match of the regular expressions patterns. Set-Cookie is always redacted.
+func NewScrubber(headers, fields, patterns []string) (*Scrubber, error) {
+	s := &Scrubber{headers: map[string]bool{"Set-Cookie": true}}
+	for _, h := range headers {
+		s.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, f := range fields {
+		path := strings.Split(f, ".")
+		for _, k := range path {
+			if k == "" {
+				return nil, fmt.Errorf("JSON path %q has an empty key", f)
+			}
+		}
+		s.fields = append(s.fields, path)
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s, nil
+}
+
+func (s *Scrubber) text(v string) string {
+	for _, re := range s.patterns {
+		v = re.ReplaceAllString(v, redacted)
+	}
+	return v
+}
+
+func (s *Scrubber) header(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			if s.headers[k] {
+				v = redacted
+			}
+			out[k] = append(out[k], s.text(v))
+		}
+	}
+	return out
+}
+
+// body scrubs a response body, reporting false if it can't be made safe to
+// keep: if it is compressed, or has fields to mask but isn't whole JSON.
+func (s *Scrubber) body(h http.Header, b []byte, truncated bool) (string, bool) {
+	if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return "", false
+	}
+	if len(s.fields) > 0 && strings.Contains(h.Get("Content-Type"), "json") {
+		var v any
+		if truncated || json.Unmarshal(b, &v) != nil {
+			return "", false
+		}
+		for _, path := range s.fields {
+			v = mask(v, path)
+		}
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return "", false
+		}
+	}
+	return s.text(string(b)), true
+}
+
+// mask replaces the values at path in v.
+func mask(v any, path []string) any {
+	if len(path) == 0 {
+		return masked
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if path[0] == "*" || path[0] == k {
+				v[k] = mask(e, path[1:])
+			}
+		}
+	case []any:
+		if path[0] == "*" {
+			for i, e := range v {
+				v[i] = mask(e, path[1:])
+			}
+		}
+	}
+	return v
+}
+
+// AuditLog records a sample of winning responses, scrubbed, as JSON lines.
+type AuditLog struct {
+	sample  float64
+	maxBody int
+	scrub   *Scrubber
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewAuditLog returns an audit log appending to the file at path, which
+// records the given share of responses, up to maxBody bytes of each body,
+// after scrubbing them with scrub.
+func NewAuditLog(path string, sample float64, maxBody int, scrub *Scrubber) (*AuditLog, error) {
+	if sample <= 0 || sample > 1 {
+		return nil, fmt.Errorf("sample rate must be in (0, 1]")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{sample: sample, maxBody: maxBody, scrub: scrub, f: f}, nil
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time          time.Time   `json:"time"`
+	RequestID     string      `json:"request_id"`
+	Method        string      `json:"method"`
+	Host          string      `json:"host"`
+	URL           string      `json:"url"`
+	Target        string      `json:"target"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Body          *string     `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+	BodyDropped   bool        `json:"body_dropped,omitempty"`
+}
+
+// capture returns a buffer collecting resp's body as it is read, if resp is
+// sampled, or nil if it is not.
+func (a *AuditLog) capture(resp *http.Response) *capped {
+	if a == nil || rand.Float64() >= a.sample {
+		return nil
+	}
+	c := &capped{max: a.maxBody}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, c), resp.Body}
+	return c
+}
+
+// write records resp, whose body c captured, as t's answer to r.
+func (a *AuditLog) write(r *http.Request, id string, t *Target, resp *http.Response, c *capped) {
+	if c == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: id,
+		Method:    r.Method,
+		Host:      r.Host,
+		URL:       a.scrub.text(r.URL.RequestURI()),
+		Target:    t.String(),
+		Status:    resp.StatusCode,
+		Header:    a.scrub.header(resp.Header),
+	}
+	if body, ok := a.scrub.body(resp.Header, c.buf.Bytes(), c.truncated); ok {
+		rec.Body, rec.BodyTruncated = &body, c.truncated
+	} else {
+		rec.BodyDropped = true
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		slog.Error("writing the audit log", "err", err)
+	}
+}
+
+func (a *AuditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.f.Close()
+}
+
+// capped keeps the first max bytes written to it.
+type capped struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *capped) Write(b []byte) (int, error) {
+	if room := c.max - c.buf.Len(); len(b) > room {
+		c.buf.Write(b[:max(room, 0)])
+		c.truncated = true
+	} else {
+		c.buf.Write(b)
+	}
+	return len(b), nil
+}
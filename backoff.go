@@ -0,0 +1,163 @@
+package multireq
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryAfter caps how long a Retry-After header can exclude a target, so a
+// bogus value can't take it out of rotation indefinitely.
+const maxRetryAfter = 10 * time.Minute
+
+// retryAfter returns how long resp asks us to wait before trying again, if
+// it is a 429 or 503 carrying a Retry-After header.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(v); err == nil {
+		d = at.Sub(now)
+	} else {
+		return 0, false
+	}
+	if d <= 0 {
+		return 0, false
+	}
+	return min(d, maxRetryAfter), true
+}
+
+// backOff keeps t out of races until d from now.
+func (t *Target) backOff(d time.Duration) {
+	until := time.Now().Add(d).UnixNano()
+	for {
+		cur := t.backoffUntil.Load()
+		if cur >= until || t.backoffUntil.CompareAndSwap(cur, until) {
+			return
+		}
+	}
+}
+
+// backingOff returns when t may be raced again, if it is currently excluded.
+func (t *Target) backingOff(now time.Time) (time.Time, bool) {
+	until := time.Unix(0, t.backoffUntil.Load())
+	return until, now.Before(until)
+}
+
+// eligible returns the candidates that may be raced right now, taking a
+// token from each one that is paced. If there are none it returns the
+// soonest time one will be. Targets evicted by a health check are left out,
+// unless every candidate is, in which case they are all raced rather than
+// fail every request. Targets whose circuit is open are always left out.
+func (p *Proxy) eligible(candidates []*Target, now time.Time) ([]*Target, time.Time) {
+	var ts []*Target
+	var soonest time.Time
+	later := func(at time.Time) {
+		if soonest.IsZero() || at.Before(soonest) {
+			soonest = at
+		}
+	}
+	evicting := slices.ContainsFunc(candidates, func(t *Target) bool { return t.evicted.Load() == 0 })
+	for _, t := range candidates {
+		if t.draining.Load() {
+			continue
+		}
+		if evicting && t.evicted.Load() > 0 {
+			continue
+		}
+		if until, ok := t.backingOff(now); ok {
+			later(until)
+			continue
+		}
+		if t.pace != nil {
+			if ok, wait := t.pace.take(now); !ok {
+				p.metrics.paced.inc(t.String())
+				later(now.Add(wait))
+				continue
+			}
+		}
+		if p.breaker != nil {
+			if ok, until := p.breaker.admit(t, now); !ok {
+				later(until)
+				continue
+			}
+		}
+		ts = append(ts, t)
+	}
+	return ts, soonest
+}
+
+// writeUnavailable answers a request that arrived while no target could be
+// raced, asking the client to retry once one can.
+func (p *Proxy) writeUnavailable(w http.ResponseWriter, r *http.Request, until time.Time) {
+	p.errorPages.write(w, r, http.StatusServiceUnavailable, errorBody{
+		Error:      "no target is available",
+		RetryAfter: int(time.Until(until)/time.Second) + 1,
+	})
+}
+
+// targetState is how a target stands, for the admin API.
+type targetState struct {
+	Target     string            `json:"target"`
+	URL        string            `json:"url"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	State      string            `json:"state"` // ok, draining, failing, open, half-open, evicted, shadow or backoff
+	RetryAfter *time.Time        `json:"retry_after,omitempty"`
+
+	// LatencyMS holds the p50, p95 and p99 of the target's response times
+	// over the last minute, once it has enough of them.
+	LatencyMS map[string]float64 `json:"latency_ms,omitempty"`
+}
+
+func (p *Proxy) states(now time.Time) []targetState {
+	var states []targetState
+	for _, t := range p.Targets() {
+		states = append(states, p.state(t, now))
+	}
+	return states
+}
+
+// state returns how t stands.
+func (p *Proxy) state(t *Target, now time.Time) targetState {
+	s := targetState{Target: t.String(), URL: t.url.String(), Labels: t.labels, State: "ok"}
+	if t.draining.Load() {
+		s.State = "draining"
+	} else if until, ok := t.backingOff(now); ok {
+		s.State = "backoff"
+		s.RetryAfter = &until
+	} else if c := t.circuitState(); c != "closed" {
+		s.State = c
+	} else if t.evicted.Load() > 0 {
+		s.State = "evicted"
+	} else if t.shadowed.Load() {
+		s.State = "shadow"
+	} else if t.failing.Load() || t.checksFailing.Load() > 0 {
+		s.State = "failing"
+	}
+	for _, q := range []float64{50, 95, 99} {
+		if d, ok := t.latencies.percentile(q, now); ok {
+			if s.LatencyMS == nil {
+				s.LatencyMS = make(map[string]float64)
+			}
+			s.LatencyMS[fmt.Sprintf("p%g", q)] = float64(d) / float64(time.Millisecond)
+		}
+	}
+	return s
+}
+
+// targetStates serves the state of every target as JSON.
+func (p *Proxy) targetStates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.states(time.Now()))
+}
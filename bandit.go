@@ -0,0 +1,149 @@
+package multireq
+
+import (
+	"cmp"
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// learnedDecay is what a target's past outcomes are worth, against its
+// newest, each time it has another: its weight follows its last hundred or
+// so hedged races, so that a target that changes is soon judged afresh.
+const learnedDecay = 0.99
+
+// WithLearnedHedging orders hedged races by weights learned from how
+// targets fare in them, rather than by their average response times, when
+// on. Each target's chance of answering a hedged race first is estimated
+// from its wins and losses, and every race samples from those estimates
+// (Thompson sampling), so that the target likeliest to win usually goes
+// first while the others are still tried now and then.
+func WithLearnedHedging(on bool) Option {
+	return func(p *Proxy) { p.learned = on }
+}
+
+// arm is what a target has learned from the hedged races it was sent:
+// decayed counts of the races it won and of those it lost or failed,
+// having been sent the request before the winner was.
+type arm struct {
+	mu     sync.Mutex
+	wins   float64
+	losses float64
+}
+
+func (a *arm) record(won bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.wins *= learnedDecay
+	a.losses *= learnedDecay
+	if won {
+		a.wins++
+	} else {
+		a.losses++
+	}
+}
+
+func (a *arm) counts() (wins, losses float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.wins, a.losses
+}
+
+func (a *arm) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.wins, a.losses = 0, 0
+}
+
+// sample draws a chance of winning from the Beta distribution of a's
+// outcomes, with a uniform prior.
+func (a *arm) sample() float64 {
+	wins, losses := a.counts()
+	x, y := gamma(wins+1), gamma(losses+1)
+	return x / (x + y)
+}
+
+// gamma draws from the Gamma distribution of shape k >= 1 and scale 1, as
+// Marsaglia and Tsang do.
+func gamma(k float64) float64 {
+	d := k - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rand.Float64()
+		if math.Log(u) < x*x/2+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// byLearned returns targets in the order a hedged race should try them,
+// those sampled likelier to win first.
+func byLearned(targets []*Target) []*Target {
+	chances := make(map[*Target]float64, len(targets))
+	for _, t := range targets {
+		chances[t] = t.arm.sample()
+	}
+	ts := slices.Clone(targets)
+	slices.SortStableFunc(ts, func(a, b *Target) int {
+		return cmp.Compare(chances[b], chances[a])
+	})
+	return ts
+}
+
+// learn records the outcome of a hedged race among targets, sent the
+// request in turn, which win won or, if it is -1, none did. A target sent
+// the request after the winner had less time to answer, so says nothing of
+// its chances. The rest lost, whether they failed, were beaten to it or had
+// yet to answer when the race ran out of time.
+func learn(targets []*Target, win int) {
+	for i, t := range targets {
+		if win >= 0 && i > win {
+			break
+		}
+		t.arm.record(i == win)
+	}
+}
+
+type learnedJSON struct {
+	Target string  `json:"target"`
+	Wins   float64 `json:"wins"`
+	Losses float64 `json:"losses"`
+	Weight float64 `json:"weight"`
+}
+
+// serveLearned serves the weights hedged races have learned as JSON, with
+// each target's decayed wins and losses and its estimated chance of
+// winning. POST /learned/reset forgets them.
+func (p *Proxy) serveLearned(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/learned/reset" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !p.authorized(w, r) {
+			return
+		}
+		for _, t := range p.Targets() {
+			t.arm.reset()
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	learned := []learnedJSON{}
+	for _, t := range p.Targets() {
+		wins, losses := t.arm.counts()
+		learned = append(learned, learnedJSON{t.String(), wins, losses, (wins + 1) / (wins + losses + 2)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(learned)
+}
@@ -0,0 +1,34 @@
+package multireq
+
+import (
+	"io"
+	"mime"
+	"net/http"
+)
+
+// bannerSearch is how much of an HTML body is searched for its <body> tag.
+const bannerSearch = 64 << 10
+
+// wantsBanner reports whether a banner can be injected into resp, which it
+// can for uncompressed HTML.
+func wantsBanner(resp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt == "text/html" && resp.Header.Get("Content-Encoding") == "" && resp.Request.Method != http.MethodHead
+}
+
+// injectBanner copies body to w with banner inserted just after the opening
+// <body> tag. If there is none near the start, body is copied unchanged.
+func injectBanner(w io.Writer, body io.Reader, banner string) (int64, error) {
+	head := make([]byte, bannerSearch)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		w.Write(head[:n])
+		return int64(n), err
+	}
+	head = insertAfterTag(head[:n], "<body", []byte(banner))
+	if _, err := w.Write(head); err != nil {
+		return int64(len(head)), err
+	}
+	m, err := io.Copy(w, body)
+	return int64(len(head)) + m, err
+}
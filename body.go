@@ -0,0 +1,130 @@
+package multireq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// defaultBodyMemory is how much of a request body is buffered in memory
+// before the rest spills to disk.
+const defaultBodyMemory = 1 << 20
+
+// errBodyTooLarge is returned for a request body over the proxy's limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// bodyBuffer holds each request body, so that every target can be sent all
+// of it.
+type bodyBuffer struct {
+	// memory is how many bytes are kept in memory.
+	memory int64
+
+	// max, if set, is the largest body accepted.
+	max int64
+
+	// dir is where bodies larger than memory spill to. If it is empty,
+	// they are rejected instead.
+	dir string
+}
+
+// buffered is a request body read in full, which hands out a reader per
+// target.
+type buffered struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// read reads all of body.
+func (b bodyBuffer) read(body io.Reader) (*buffered, error) {
+	limit := b.memory
+	if b.max > 0 {
+		limit = min(limit, b.max)
+	}
+	mem, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(mem)) <= limit {
+		return &buffered{mem: mem, size: int64(len(mem))}, nil
+	}
+	if b.dir == "" || (b.max > 0 && limit == b.max) {
+		return nil, errBodyTooLarge
+	}
+
+	f, err := os.CreateTemp(b.dir, "multireq-body-")
+	if err != nil {
+		return nil, err
+	}
+	// Unlinked at once, the file goes away with its last descriptor.
+	os.Remove(f.Name())
+	rest := body
+	if b.max > 0 {
+		rest = io.LimitReader(body, b.max-int64(len(mem))+1)
+	}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(mem), rest))
+	if err == nil && b.max > 0 && n > b.max {
+		err = errBodyTooLarge
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &buffered{file: f, size: n}, nil
+}
+
+// open returns a reader for the whole body.
+func (b *buffered) open() (io.ReadCloser, error) {
+	if b.file != nil {
+		return io.NopCloser(io.NewSectionReader(b.file, 0, b.size)), nil
+	}
+	return io.NopCloser(bytes.NewReader(b.mem)), nil
+}
+
+func (b *buffered) close() {
+	if b != nil && b.file != nil {
+		b.file.Close()
+	}
+}
+
+// bufferBody replaces r's body with one every target can read in full. It
+// answers the client itself, and returns false, if the body can't be read
+// or is over the limit.
+func (p *Proxy) bufferBody(w http.ResponseWriter, r *http.Request) (*buffered, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if p.bodies.max > 0 && r.ContentLength > p.bodies.max {
+		p.writeTooLarge(w, r)
+		return nil, false
+	}
+	b, err := p.bodies.read(r.Body)
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		p.writeTooLarge(w, r)
+		return nil, false
+	case err != nil:
+		if r.Context().Err() == nil {
+			p.errorPages.write(w, r, http.StatusBadRequest, errorBody{Error: fmt.Sprintf("reading request body: %s", err)})
+		}
+		return nil, false
+	}
+	r.Body, _ = b.open()
+	r.GetBody = b.open
+	r.ContentLength = b.size
+	r.TransferEncoding = nil
+	return b, true
+}
+
+func (p *Proxy) writeTooLarge(w http.ResponseWriter, r *http.Request) {
+	limit := p.bodies.max
+	if p.bodies.dir == "" && (limit == 0 || p.bodies.memory < limit) {
+		limit = p.bodies.memory
+	}
+	p.errorPages.write(w, r, http.StatusRequestEntityTooLarge, errorBody{
+		Error: fmt.Sprintf("request body is larger than %d bytes", limit),
+	})
+}
@@ -0,0 +1,221 @@
+package multireq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultBodyCheckLimit is how much of a body a BodyCheck reads.
+const DefaultBodyCheckLimit = 64 << 10
+
+// A BodyCheck fails responses whose body says they are errors, though sent
+// with a status that would win, so the race goes on without them. It reads
+// only the start of each body, which still reaches the client whole.
+type BodyCheck struct {
+	limit int
+	check func(body []byte) error
+}
+
+// ParseBodyCheck returns the check spec describes, reading up to limit
+// bytes of each body, one of
+//
+//	regexp:<regexp>                    the body must match
+//	!regexp:<regexp>                   the body must not match
+//	jsonpath:<path>                    the value at path must be there, and not null or false
+//	jsonpath:<path> == <json value>    the value at path must be the one given
+//	jsonpath:<path> != <json value>    the value at path must not be the one given
+//
+// A path is $ followed by fields, as .status or ["status"], and array
+// indexes, as [0]. A JSON body cut off at limit fails a jsonpath check.
+func ParseBodyCheck(spec string, limit int) (*BodyCheck, error) {
+	if limit <= 0 {
+		return nil, errors.New("the body check must read some of the body")
+	}
+	kind, arg, _ := strings.Cut(spec, ":")
+	c := &BodyCheck{limit: limit}
+	switch kind {
+	case "regexp", "!regexp":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", spec, err)
+		}
+		want := kind == "regexp"
+		c.check = func(body []byte) error {
+			switch matched := re.Match(body); {
+			case want && !matched:
+				return fmt.Errorf("body doesn't match %s", re)
+			case !want && matched:
+				return fmt.Errorf("body matches %s", re)
+			}
+			return nil
+		}
+	case "jsonpath":
+		check, err := parseJSONCheck(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", spec, err)
+		}
+		c.check = check
+	default:
+		return nil, fmt.Errorf("%q is not a regexp:, !regexp: or jsonpath: check", spec)
+	}
+	return c, nil
+}
+
+// WithBodyCheck fails responses c rejects.
+func WithBodyCheck(c *BodyCheck) Option {
+	return func(p *Proxy) { p.bodyCheck = c }
+}
+
+// applies reports whether the body of resp, the answer to r, is checked:
+// that of a 2xx that is neither 204 nor 206, to a request other than HEAD.
+func (c *BodyCheck) applies(r *http.Request, resp *http.Response) bool {
+	return c != nil && r.Method != http.MethodHead && resp.StatusCode/100 == 2 &&
+		resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusPartialContent
+}
+
+// run checks the start of resp's body, which it puts back in front of the
+// rest. Bodies in an encoding other than gzip can't be checked, and pass.
+func (c *BodyCheck) run(resp *http.Response) error {
+	head, err := io.ReadAll(io.LimitReader(resp.Body, int64(c.limit)))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	if err != nil {
+		return err
+	}
+	switch resp.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		// Decoding what was read of it is enough to go by.
+		zr, err := gzip.NewReader(bytes.NewReader(head))
+		if err != nil {
+			return &failure{code: codeBadBody, status: resp.StatusCode, err: err}
+		}
+		head, _ = io.ReadAll(io.LimitReader(zr, int64(c.limit)))
+	default:
+		return nil
+	}
+	if err := c.check(head); err != nil {
+		return &failure{code: codeBadBody, status: resp.StatusCode, err: err}
+	}
+	return nil
+}
+
+// parseJSONCheck parses a jsonpath check's path and comparison.
+func parseJSONCheck(s string) (func([]byte) error, error) {
+	path, op, value := strings.TrimSpace(s), "", any(nil)
+	// The comparison is at the first operator, as either may appear in
+	// the value compared against.
+	at := -1
+	for _, o := range []string{"==", "!="} {
+		if i := strings.Index(s, o); i >= 0 && (at < 0 || i < at) {
+			at, op = i, o
+		}
+	}
+	if at >= 0 {
+		path = strings.TrimSpace(s[:at])
+		r := strings.TrimSpace(s[at+len(op):])
+		if err := json.Unmarshal([]byte(r), &value); err != nil {
+			return nil, fmt.Errorf("%q is not a JSON value", r)
+		}
+	}
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(body []byte) error {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not JSON: %s", err)
+		}
+		got, ok := walkJSON(doc, steps)
+		switch {
+		case op == "" && (!ok || got == nil || got == false):
+			return fmt.Errorf("%s is missing, null or false", path)
+		case op == "==" && (!ok || !reflect.DeepEqual(got, value)):
+			return fmt.Errorf("%s is not %s", path, jsonString(value))
+		case op == "!=" && ok && reflect.DeepEqual(got, value):
+			return fmt.Errorf("%s is %s", path, jsonString(value))
+		}
+		return nil
+	}, nil
+}
+
+// parseJSONPath splits a path into field names, as strings, and array
+// indexes, as ints.
+func parseJSONPath(path string) ([]any, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("path %q doesn't start with $", path)
+	}
+	var steps []any
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path %q has an empty field", path)
+			}
+			steps = append(steps, rest[1:end+1])
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unclosed [", path)
+			}
+			in := rest[1:end]
+			if n, err := strconv.Atoi(in); err == nil {
+				steps = append(steps, n)
+			} else if name, err := strconv.Unquote(in); err == nil {
+				steps = append(steps, name)
+			} else {
+				return nil, fmt.Errorf("path %q has [%s], which is neither an index nor a quoted field", path, in)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %q: unexpected %q", path, rest)
+		}
+	}
+	return steps, nil
+}
+
+// walkJSON returns the value at steps in doc, and whether there is one.
+func walkJSON(doc any, steps []any) (any, bool) {
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			m, ok := doc.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = m[s]; !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := doc.([]any)
+			if !ok || s < 0 || s >= len(a) {
+				return nil, false
+			}
+			doc = a[s]
+		}
+	}
+	return doc, true
+}
+
+func jsonString(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
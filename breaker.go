@@ -0,0 +1,133 @@
+package multireq
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops sending requests to targets that fail too often.
+// Where an error budget keeps racing a failing target to see when it
+// recovers, a breaker opens, leaving the target out of races altogether for
+// a cool-down, then lets a single request through to probe it. The target
+// is raced again if that succeeds, and left out for another cool-down if
+// not.
+type circuitBreaker struct {
+	// ratio is the share of a target's attempts in window that may fail
+	// before its circuit opens, once there are minAttempts of them.
+	ratio       float64
+	window      time.Duration
+	minAttempts uint64
+
+	// open is how long a circuit stays open before it is probed.
+	open time.Duration
+
+	gauge, opened *metricVec
+}
+
+// WithCircuitBreaker opens the circuit of a target that fails more than
+// ratio of at least minAttempts attempts in window, leaving it out of races
+// for open before probing it with one request. A ratio of zero never opens
+// a circuit.
+func WithCircuitBreaker(ratio float64, window time.Duration, minAttempts int, open time.Duration) Option {
+	return func(p *Proxy) {
+		p.breaker = nil
+		if ratio > 0 {
+			p.breaker = &circuitBreaker{ratio: ratio, window: window, minAttempts: uint64(max(minAttempts, 1)), open: open}
+		}
+	}
+}
+
+// The states of a circuit.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var circuitStates = [...]string{"closed", "open", "half-open"}
+
+// circuit is a target's circuit breaker state.
+type circuit struct {
+	mu    sync.Mutex
+	state int
+
+	// until is when an open circuit may be probed, or, while half-open,
+	// when a probe that never reported back is given up on.
+	until time.Time
+
+	// since is when the circuit last closed. Attempts before then don't
+	// count toward opening it again.
+	since time.Time
+}
+
+// admit reports whether t may be raced now. If not, it returns when it may
+// be. Admitting a target whose circuit is due a probe makes the request the
+// probe, and keeps other requests from the target until it reports back.
+func (b *circuitBreaker) admit(t *Target, now time.Time) (bool, time.Time) {
+	c := &t.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.state == circuitClosed:
+		return true, time.Time{}
+	case now.Before(c.until):
+		return false, c.until
+	}
+	if c.state == circuitOpen {
+		slog.Info("circuit half-open; probing", "target", t.String())
+		c.state = circuitHalfOpen
+		b.gauge.set(circuitHalfOpen, t.String())
+	}
+	c.until = now.Add(b.open)
+	return true, time.Time{}
+}
+
+// record judges t's circuit by the outcome of its latest attempt, which
+// judge has already counted.
+func (b *circuitBreaker) record(t *Target, ok bool, now time.Time) {
+	c := &t.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		return
+	case circuitHalfOpen:
+		if ok {
+			slog.Info("probe succeeded; closing the circuit", "target", t.String())
+			c.state, c.since = circuitClosed, now
+			b.gauge.set(circuitClosed, t.String())
+			return
+		}
+		slog.Warn("probe failed; the circuit stays open", "target", t.String(), "open_for", b.open.String())
+		c.state, c.until = circuitOpen, now.Add(b.open)
+		b.gauge.set(circuitOpen, t.String())
+		return
+	}
+	if ok {
+		return
+	}
+	window := b.window
+	if !c.since.IsZero() {
+		window = min(window, now.Sub(c.since)+time.Second)
+	}
+	n := t.attempts.sum(now, window)
+	if n < b.minAttempts {
+		return
+	}
+	rate := float64(t.attemptErrors.sum(now, window)) / float64(n)
+	if rate <= b.ratio {
+		return
+	}
+	slog.Warn("opening the circuit", "target", t.String(), "error_rate", rate, "window", b.window.String(), "open_for", b.open.String())
+	c.state, c.until = circuitOpen, now.Add(b.open)
+	b.gauge.set(circuitOpen, t.String())
+	b.opened.inc(t.String())
+}
+
+// circuitState returns the name of t's circuit state.
+func (t *Target) circuitState() string {
+	t.circuit.mu.Lock()
+	defer t.circuit.mu.Unlock()
+	return circuitStates[t.circuit.state]
+}
@@ -0,0 +1,134 @@
+package multireq
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// broadcastQueue is how many reads from the client a broadcast mirror may
+// fall behind by before it is hung up on.
+const broadcastQueue = 256
+
+// WithBroadcastUpgrades sends the handshake of each request switching
+// protocols, such as a WebSocket, to every target rather than racing it
+// when on. The client is joined to the primary, or without one to the first
+// target to switch, and every other target that switches is sent a copy of
+// what the client sends, its own answers being thrown away. The handshake
+// doesn't offer the targets any WebSocket extensions, so that each can read
+// the same frames.
+func WithBroadcastUpgrades(on bool) Option {
+	return func(p *Proxy) { p.broadcast = on }
+}
+
+// broadcast copies what a client joined to one target sends to the other
+// targets of its handshake, the mirrors: those that switched protocols, and
+// those yet to answer, whose copies wait until they do. A mirror that falls
+// broadcastQueue reads behind is hung up on, rather than slowing the
+// client down or missing some of what it sent.
+type broadcast struct {
+	p       *Proxy
+	targets []*Target
+
+	mu      sync.Mutex
+	mirrors map[int]chan []byte // by index into targets
+}
+
+func newBroadcast(p *Proxy, targets []*Target) *broadcast {
+	b := &broadcast{p: p, targets: targets, mirrors: make(map[int]chan []byte)}
+	for i := range targets {
+		b.mirrors[i] = make(chan []byte, broadcastQueue)
+	}
+	return b
+}
+
+// Write queues a copy of data for every mirror.
+func (b *broadcast) Write(data []byte) (int, error) {
+	data = bytes.Clone(data)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, ch := range b.mirrors {
+		select {
+		case ch <- data:
+		default:
+			slog.Warn("hung up on a broadcast target that fell behind the client", "target", b.targets[i].String())
+			b.p.metrics.broadcastDrops.inc(b.targets[i].String())
+			close(ch)
+			delete(b.mirrors, i)
+		}
+	}
+	return len(data), nil
+}
+
+// attach starts sending target i, which switched protocols with resp, what
+// the client has sent and goes on to send, reading and discarding what it
+// sends back until either side is done.
+func (b *broadcast) attach(i int, resp *http.Response) {
+	if b == nil {
+		resp.Body.Close()
+		return
+	}
+	b.mu.Lock()
+	ch, ok := b.mirrors[i]
+	b.mu.Unlock()
+	conn, rw := resp.Body.(io.ReadWriter)
+	if !ok || !rw {
+		b.forget(i)
+		resp.Body.Close()
+		return
+	}
+	t := b.targets[i]
+	b.p.metrics.upgraded.add(1, t.String())
+	go func() {
+		io.Copy(io.Discard, conn)
+		b.forget(i)
+	}()
+	go func() {
+		defer b.p.metrics.upgraded.add(-1, t.String())
+		defer resp.Body.Close()
+		for data := range ch {
+			if _, err := conn.Write(data); err != nil {
+				b.forget(i)
+				break
+			}
+		}
+	}()
+}
+
+// forget stops copying to target i, the one the client is joined to or one
+// that won't be sent any more.
+func (b *broadcast) forget(i int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch, ok := b.mirrors[i]; ok {
+		close(ch)
+		delete(b.mirrors, i)
+	}
+}
+
+// close stops copying to every mirror once the client is done. What they
+// were sent is still written to them before they are hung up on.
+func (b *broadcast) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, ch := range b.mirrors {
+		close(ch)
+		delete(b.mirrors, i)
+	}
+}
+
+// reader returns r, copying what is read from it to the mirrors.
+func (b *broadcast) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return io.TeeReader(r, b)
+}
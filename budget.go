@@ -0,0 +1,139 @@
+package multireq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds each webhook notification.
+const webhookTimeout = 10 * time.Second
+
+// errorBudget takes targets that fail too often out of races, leaving them
+// shadow-only: still sent every request, so it shows when they recover,
+// but never allowed to answer one.
+type errorBudget struct {
+	// ratio is the share of a target's attempts in window that may fail
+	// before it is shadowed. It is raced again once under half that.
+	ratio  float64
+	window time.Duration
+
+	// minAttempts is how many attempts in window it takes to judge a
+	// target.
+	minAttempts uint64
+
+	// webhook, if set, is posted a JSON event whenever a target is
+	// shadowed or restored.
+	webhook string
+	client  *http.Client
+
+	gauge *metricVec
+}
+
+// budgetEvent is posted to the webhook.
+type budgetEvent struct {
+	Target    string    `json:"target"`
+	URL       string    `json:"url"`
+	State     string    `json:"state"` // shadow or racing
+	ErrorRate float64   `json:"error_rate"`
+	Budget    float64   `json:"budget"`
+	Window    string    `json:"window"`
+	Time      time.Time `json:"time"`
+}
+
+// settle records whether an attempt on t got an acceptable response or
+// failed for a reason of t's own.
+func (p *Proxy) settle(t *Target, ok bool) {
+	t.failing.Store(!ok)
+	p.judge(t, ok)
+}
+
+// judge counts an attempt on t against its error budget and its circuit
+// breaker, if the proxy has them.
+func (p *Proxy) judge(t *Target, ok bool) {
+	if p.budget == nil && p.breaker == nil {
+		return
+	}
+	now := time.Now()
+	t.attempts.inc(now)
+	if !ok {
+		t.attemptErrors.inc(now)
+	}
+	if p.budget != nil {
+		p.budget.judge(t, now)
+	}
+	if p.breaker != nil {
+		p.breaker.record(t, ok, now)
+	}
+}
+
+// judge shadows or restores t by its error rate over the window.
+func (b *errorBudget) judge(t *Target, now time.Time) {
+	n := t.attempts.sum(now, b.window)
+	if n < b.minAttempts {
+		return
+	}
+	rate := float64(t.attemptErrors.sum(now, b.window)) / float64(n)
+	var state string
+	switch {
+	case rate > b.ratio && t.shadowed.CompareAndSwap(false, true):
+		state = "shadow"
+		slog.Warn("over its error budget; shadowing target", "target", t.String(), "error_rate", rate, "window", b.window.String(), "budget", b.ratio)
+		b.gauge.set(1, t.String())
+	case rate <= b.ratio/2 && t.shadowed.CompareAndSwap(true, false):
+		state = "racing"
+		slog.Info("back within its error budget; racing target again", "target", t.String(), "error_rate", rate, "window", b.window.String())
+		b.gauge.set(0, t.String())
+	default:
+		return
+	}
+	if b.webhook != "" {
+		go postEvent(b.client, b.webhook, budgetEvent{t.String(), t.url.String(), state, rate, b.ratio, b.window.String(), now}, "error budget webhook")
+	}
+}
+
+// postEvent posts e as JSON to webhook, logging any failure as coming
+// from what.
+func postEvent(client *http.Client, webhook string, e any, what string) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("posting to the "+what, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+	}
+	if err != nil {
+		slog.Warn("posting to the "+what, "err", err)
+	}
+}
+
+// shadows reports which of targets may not answer the request they are
+// raced for. If none could, all are trusted rather than fail every request.
+func shadows(targets []*Target) []bool {
+	s := make([]bool, len(targets))
+	all := true
+	for i, t := range targets {
+		s[i] = t.shadowed.Load()
+		all = all && s[i]
+	}
+	if all {
+		return make([]bool, len(targets))
+	}
+	return s
+}
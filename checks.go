@@ -0,0 +1,287 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for a check's settings.
+const (
+	defaultCheckEvery   = 30 * time.Second
+	defaultCheckTimeout = 10 * time.Second
+)
+
+// maxCheckBody is how much of a response a check's body pattern is
+// matched against.
+const maxCheckBody = 1 << 20
+
+// Checks are synthetic transactions: requests sent to every target on a
+// schedule, whose answers must be as expected. A target is unhealthy while
+// any check is failing on it, and each run counts toward its error budget.
+// A check can also evict a target that keeps failing it, taking it out of
+// races until it passes again.
+type Checks struct {
+	checks  []*check
+	webhook string
+	client  *http.Client
+	stop    context.CancelFunc
+
+	// ctx is done once the checks stop, for those run on targets added
+	// later.
+	ctx context.Context
+
+	runs, passing, evicted *metricVec
+}
+
+type check struct {
+	path    string
+	method  string
+	status  int
+	body    *regexp.Regexp
+	every   time.Duration
+	timeout time.Duration
+
+	// unhealthy, if set, is how many failures in a row evict a target,
+	// and healthy how many passes in a row restore it.
+	unhealthy, healthy int
+}
+
+// checkEvent is posted to the webhook whenever a check starts or stops
+// failing on a target, or evicts or restores it.
+type checkEvent struct {
+	Check  string    `json:"check"`
+	Target string    `json:"target"`
+	URL    string    `json:"url"`
+	State  string    `json:"state"` // failing, passing, evicted or restored
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// NewChecks builds checks from paths to comma separated settings, which
+// are
+//
+//	method     the request's method, GET by default
+//	status     the status the target must answer with; by default any
+//	           that could win a race
+//	body       a regular expression the response body must match
+//	every      how often to run the check, 30s by default
+//	timeout    how long the target has to answer, 10s by default
+//	unhealthy  how many failures in a row take a target out of races;
+//	           by default failures never do
+//	healthy    how many passes in a row put an evicted target back, 1 by
+//	           default
+//
+// Each change in a check's result on a target is posted to webhook, if it
+// is set.
+func NewChecks(specs map[string]string, webhook string) (*Checks, error) {
+	cs := &Checks{webhook: webhook, client: &http.Client{}}
+	for path, s := range specs {
+		c := &check{path: path, method: http.MethodGet, every: defaultCheckEvery, timeout: defaultCheckTimeout, healthy: 1}
+		if u, err := url.Parse(path); err != nil || u.Host != "" {
+			return nil, fmt.Errorf("check %s: not a path", path)
+		}
+		settings := map[string]string{}
+		if s != "" {
+			var err error
+			if settings, err = ParseLabelList(s); err != nil {
+				return nil, fmt.Errorf("check %s: %s", path, err)
+			}
+		}
+		for k, v := range settings {
+			var err error
+			switch k {
+			case "method":
+				c.method = strings.ToUpper(v)
+			case "status":
+				c.status, err = strconv.Atoi(v)
+			case "body":
+				c.body, err = regexp.Compile(v)
+			case "every":
+				c.every, err = time.ParseDuration(v)
+				if err == nil && c.every <= 0 {
+					err = errors.New("must be positive")
+				}
+			case "timeout":
+				c.timeout, err = time.ParseDuration(v)
+				if err == nil && c.timeout <= 0 {
+					err = errors.New("must be positive")
+				}
+			case "unhealthy", "healthy":
+				n := &c.unhealthy
+				if k == "healthy" {
+					n = &c.healthy
+				}
+				*n, err = strconv.Atoi(v)
+				if err == nil && *n < 1 {
+					err = errors.New("must be at least 1")
+				}
+			default:
+				err = errors.New("unknown setting")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("check %s: %s: %s", path, k, err)
+			}
+		}
+		cs.checks = append(cs.checks, c)
+	}
+	return cs, nil
+}
+
+// WithChecks runs cs against every target once StartChecks is called.
+func WithChecks(cs *Checks) Option {
+	return func(p *Proxy) { p.checks = cs }
+}
+
+// StartChecks starts running the proxy's checks, if it has any, until it
+// is closed. Each check's first run on each target comes at a random point
+// in its first interval, so they don't all land at once.
+func (p *Proxy) StartChecks() {
+	cs := p.checks
+	if cs == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cs.ctx, cs.stop = ctx, cancel
+	for _, c := range cs.checks {
+		for _, t := range p.Targets() {
+			go p.runCheck(ctx, c, t)
+		}
+	}
+}
+
+func (cs *Checks) close() {
+	if cs != nil && cs.stop != nil {
+		cs.stop()
+	}
+}
+
+// runCheck runs c against t every c.every until ctx is done.
+func (p *Proxy) runCheck(ctx context.Context, c *check, t *Target) {
+	cs := p.checks
+	timer := time.NewTimer(rand.N(c.every))
+	defer timer.Stop()
+	passing, evicted := true, false
+	fails, passes := 0, 0
+	defer func() {
+		if !passing {
+			t.checksFailing.Add(-1)
+		}
+		if evicted && t.evicted.Add(-1) == 0 {
+			cs.evicted.set(0, t.String())
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.removed:
+			return
+		case <-timer.C:
+		}
+		err := c.run(ctx, t, p.accepted)
+		if ctx.Err() != nil {
+			return
+		}
+		timer.Reset(c.every)
+		p.judge(t, err == nil)
+		if err == nil {
+			cs.runs.inc(c.path, t.String(), "passed")
+			cs.passing.set(1, c.path, t.String())
+			fails, passes = 0, passes+1
+		} else {
+			cs.runs.inc(c.path, t.String(), "failed")
+			cs.passing.set(0, c.path, t.String())
+			fails, passes = fails+1, 0
+		}
+		state := ""
+		if passing != (err == nil) {
+			passing = err == nil
+			if passing {
+				t.checksFailing.Add(-1)
+				state = "passing"
+				slog.Info("check is passing again", "check", c.path, "target", t.String())
+			} else {
+				t.checksFailing.Add(1)
+				state = "failing"
+				slog.Warn("check is failing", "check", c.path, "target", t.String(), "err", err)
+			}
+		}
+		switch {
+		case !evicted && c.unhealthy > 0 && fails >= c.unhealthy:
+			evicted = true
+			state = "evicted"
+			slog.Warn("evicting target for failing its check", "check", c.path, "target", t.String(), "failures", fails)
+			if t.evicted.Add(1) == 1 {
+				cs.evicted.set(1, t.String())
+			}
+		case evicted && passes >= c.healthy:
+			evicted = false
+			state = "restored"
+			slog.Info("restoring target for passing its check", "check", c.path, "target", t.String(), "passes", passes)
+			if t.evicted.Add(-1) == 0 {
+				cs.evicted.set(0, t.String())
+			}
+		}
+		if state == "" || cs.webhook == "" {
+			continue
+		}
+		e := checkEvent{Check: c.path, Target: t.String(), URL: t.url.String(), State: state, Time: time.Now()}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		go postEvent(cs.client, cs.webhook, e, "check webhook")
+	}
+}
+
+// run sends c's request to t the way a proxied request would be sent,
+// returning why the answer isn't what c expects, if it isn't: the status
+// c names, or else one of accept.
+func (c *check) run(ctx context.Context, t *Target, accept StatusSet) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	u, err := url.Parse(c.path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, c.method, t.join(u).String(), nil)
+	if err != nil {
+		return err
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if err := t.prepare(ctx, req); err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case c.status != 0 && resp.StatusCode != c.status:
+		return fmt.Errorf("status %d, want %d", resp.StatusCode, c.status)
+	case c.status == 0 && !accept[resp.StatusCode]:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	case c.body == nil:
+		return nil
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return err
+	}
+	if !c.body.Match(b) {
+		return fmt.Errorf("body does not match %s", c.body)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+)
+
+func setupBench(fs *flag.FlagSet) func([]string) error {
+	n := fs.Int("n", 200, "number of requests to send")
+	c := fs.Int("c", 10, "number of requests in flight at once")
+	method := fs.String("method", http.MethodGet, "request method")
+	return func(args []string) error {
+		if len(args) != 1 || *n < 1 || *c < 1 {
+			return errUsage
+		}
+		// Check the URL once up front rather than failing every request.
+		if _, err := http.NewRequest(*method, args[0], nil); err != nil {
+			return err
+		}
+		sent := 0
+		lr := runLoad(*c, func() *http.Request {
+			if sent == *n {
+				return nil
+			}
+			sent++
+			req, _ := http.NewRequest(*method, args[0], nil)
+			return req
+		})
+		lr.print(os.Stdout)
+		return nil
+	}
+}
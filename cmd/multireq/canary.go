@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// canaryCheckInterval is how often a canaried reload's error rate is
+// compared with the running config's.
+const canaryCheckInterval = time.Second
+
+// canaryMinRequests is how many requests a canaried reload must have
+// answered before its error rate is judged ahead of its time being up.
+const canaryMinRequests = 20
+
+// canary is a reloaded config being tried on a share of the requests
+// before it is given them all.
+type canary struct {
+	g       *generation
+	percent int
+
+	// stable and trial count the requests the running config and the
+	// canary answered, and how many of those failed.
+	stable, trial outcomes
+}
+
+type outcomes struct {
+	requests, failed atomic.Int64
+}
+
+// rate returns the share of o's requests that failed, and how many there
+// were.
+func (o *outcomes) rate() (float64, int64) {
+	n := o.requests.Load()
+	if n == 0 {
+		return 0, 0
+	}
+	return float64(o.failed.Load()) / float64(n), n
+}
+
+// serve answers r through the canary if r falls in its share of the
+// requests, and otherwise through stable, counting how each fares. It
+// reports false, leaving r unanswered, if the generation picked has been
+// retired. Requests for delivery stay with stable, which holds the spool.
+func (cn *canary) serve(w http.ResponseWriter, r *http.Request, stable *generation) bool {
+	g, o := stable, &cn.stable
+	if rand.IntN(100) < cn.percent && !stable.p.Delivers(r) && !cn.g.p.Delivers(r) {
+		g, o = cn.g, &cn.trial
+	}
+	if !g.enter() {
+		return false
+	}
+	defer g.leave()
+	sw := &statusWriter{ResponseWriter: w}
+	g.h.ServeHTTP(sw, r)
+	o.requests.Add(1)
+	if sw.status >= 500 {
+		o.failed.Add(1)
+	}
+	return true
+}
+
+// spiked reports whether the canary, having answered at least least
+// requests, has failed a share of them more than rise above the running
+// config's.
+func (cn *canary) spiked(rise float64, least int64) bool {
+	trial, n := cn.trial.rate()
+	stable, _ := cn.stable.rate()
+	return n > 0 && n >= least && trial > stable+rise
+}
+
+// startCanary starts g on its config's share of the requests, leaving old
+// to serve the rest, and promotes or rolls back g in the background.
+func (rl *reloader) startCanary(g, old *generation) {
+	g.p.Prewarm()
+	g.p.StartChecks()
+	cn := &canary{g: g, percent: g.c.canaryPercent}
+	rl.canary.Store(cn)
+	slog.Info("canarying the reloaded config", "file", g.c.configFile, "percent", cn.percent, "duration", g.c.canaryDuration.String())
+	go rl.runCanary(cn, old)
+}
+
+// runCanary rolls cn back as soon as its error rate spikes, and otherwise
+// gives it every request once its time is up.
+func (rl *reloader) runCanary(cn *canary, old *generation) {
+	c := cn.g.c
+	tick := time.NewTicker(canaryCheckInterval)
+	defer tick.Stop()
+	end := time.After(c.canaryDuration)
+	for {
+		select {
+		case <-tick.C:
+			if cn.spiked(c.canaryErrorRate, canaryMinRequests) {
+				rl.rollBack(cn, "its error rate spiked")
+				return
+			}
+		case <-end:
+			// However few requests it had, they are all there is
+			// to go on.
+			if cn.spiked(c.canaryErrorRate, 1) {
+				rl.rollBack(cn, "its error rate spiked")
+				return
+			}
+			// Responses cached while the canary ran came to old.
+			cn.g.p.CopyHeadCache(old.p)
+			if err := cn.g.takeDeliveries(old); err != nil {
+				rl.rollBack(cn, "its deliveries couldn't start: "+err.Error())
+				return
+			}
+			rl.swap(cn.g, old)
+			rl.canary.Store(nil)
+			return
+		}
+	}
+}
+
+// rollBack gives the requests cn was trying back to the running config,
+// and retires cn.
+func (rl *reloader) rollBack(cn *canary, why string) {
+	rl.canary.Store(nil)
+	trial, n := cn.trial.rate()
+	stable, _ := cn.stable.rate()
+	slog.Warn("rolled back the reloaded config; keeping the one before", "file", cn.g.c.configFile, "reason", why, "requests", n, "error_rate", trial, "running_error_rate", stable)
+	go cn.g.retire()
+}
+
+// statusWriter remembers the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, which only a switch of protocols does.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// certFile serves the certificate in a pair of PEM files, loading it again
+// when either changes, so a renewal by certbot or the like needs no
+// restart.
+type certFile struct {
+	certPath, keyPath string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	mtime   time.Time
+	checked time.Time
+}
+
+func loadCertFile(certPath, keyPath string) (*certFile, error) {
+	f := &certFile{certPath: certPath, keyPath: keyPath}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads the files, if they have changed since they were last read.
+func (f *certFile) load() error {
+	var mtime time.Time
+	for _, p := range []string{f.certPath, f.keyPath} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	if f.cert != nil && mtime.Equal(f.mtime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		return err
+	}
+	if f.cert != nil {
+		slog.Info("loaded the renewed certificate", "file", f.certPath)
+	}
+	f.cert, f.mtime = &cert, mtime
+	return nil
+}
+
+// get returns the certificate for a handshake. If the files have changed
+// but can't be loaded, perhaps because only one has been replaced so far,
+// the certificate loaded before is kept until they can.
+func (f *certFile) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= certCheckInterval {
+		f.checked = now
+		if err := f.load(); err != nil {
+			slog.Warn("reloading the certificate", "file", f.certPath, "err", err)
+		}
+	}
+	return f.cert, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/whyrusleeping/multireq"
+)
+
+func setupCheck(fs *flag.FlagSet) func([]string) error {
+	var c serveConfig
+	c.register(fs)
+	path := fs.String("path", "/", "path to request from every target")
+	return func(args []string) error {
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		c, args, err := c.load(args, set)
+		if err != nil {
+			return err
+		}
+		c.dryRun = true
+		// -timeout is shared with serve, and bounds each probe here.
+		timeout := 5 * time.Second
+		if c.timeout > 0 {
+			timeout = c.timeout
+		}
+		_, p, err := c.build(args, &multireq.Registry{})
+		if err != nil {
+			return err
+		}
+		fmt.Println("configuration ok")
+
+		failed := 0
+		for _, t := range p.Targets() {
+			status, took, err := t.Probe(*path, timeout)
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("FAIL %s: %s\n", t, err)
+			case !p.Acceptable(status):
+				failed++
+				fmt.Printf("FAIL %s: status %d in %s\n", t, status, took.Round(time.Millisecond))
+			default:
+				fmt.Printf("ok   %s: status %d in %s\n", t, status, took.Round(time.Millisecond))
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d targets failed", failed, len(p.Targets()))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func init() {
+	// Added here rather than in the table literal, which completion
+	// itself reads.
+	commands = append(commands, &command{
+		"completion", "bash|zsh|fish", "print a shell completion script", setupCompletion,
+	})
+}
+
+func setupCompletion(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(os.Stdout)
+		case "zsh":
+			writeZshCompletion(os.Stdout)
+		case "fish":
+			writeFishCompletion(os.Stdout)
+		default:
+			return fmt.Errorf("no completion for shell %q", args[0])
+		}
+		return nil
+	}
+}
+
+// commandFlags returns the flags a command registers.
+func commandFlags(c *command) []*flag.Flag {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.setup(fs)
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// argChoices returns the fixed set of words a command's argument can be,
+// going by a synopsis like "bash|zsh|fish".
+func argChoices(c *command) []string {
+	if !strings.Contains(c.args, "|") {
+		return nil
+	}
+	return strings.Split(c.args, "|")
+}
+
+func flagWords(c *command) string {
+	words := argChoices(c)
+	for _, f := range commandFlags(c) {
+		words = append(words, "-"+f.Name)
+	}
+	return strings.Join(words, " ")
+}
+
+func writeBashCompletion(w io.Writer) {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	fmt.Fprintln(w, "# bash completion for multireq")
+	fmt.Fprintln(w, "_multireq() {")
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}"`)
+	fmt.Fprintln(w, `	if [ "$COMP_CWORD" -eq 1 ]; then`)
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " ")+" "+flagWords(commands[0]))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, `	case "${COMP_WORDS[1]}" in`)
+	for _, c := range commands[1:] {
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", c.name, flagWords(c))
+	}
+	// Without a command the arguments are serve's.
+	fmt.Fprintf(w, "\t*) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", flagWords(commands[0]))
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _multireq multireq")
+}
+
+var zshEscaper = strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintln(w, "#compdef multireq")
+	fmt.Fprintln(w, "_multireq() {")
+	fmt.Fprintln(w, "\tlocal -a commands")
+	fmt.Fprintln(w, "\tcommands=(")
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", c.name, zshEscaper.Replace(c.summary))
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\tif (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then")
+	fmt.Fprintln(w, "\t\t_describe 'command' commands")
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase $words[2] in")
+	for _, c := range commands[1:] {
+		fmt.Fprintf(w, "\t%s)\n\t\tshift words; (( CURRENT-- ))\n\t\t_arguments%s '*:file:_files' ;;\n", c.name, zshSpecs(c))
+	}
+	fmt.Fprintf(w, "\t*)\n\t\t[[ $words[2] == serve ]] && { shift words; (( CURRENT-- )) }\n\t\t_arguments%s '*:file:_files' ;;\n", zshSpecs(commands[0]))
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, `if [ "$funcstack[1]" = "_multireq" ]; then _multireq "$@"; else compdef _multireq multireq; fi`)
+}
+
+func zshSpecs(c *command) string {
+	var b strings.Builder
+	if choices := argChoices(c); choices != nil {
+		fmt.Fprintf(&b, " '1:argument:(%s)'", strings.Join(choices, " "))
+	}
+	for _, f := range commandFlags(c) {
+		if isBoolFlag(f) {
+			fmt.Fprintf(&b, " '-%s[%s]'", f.Name, zshEscaper.Replace(f.Usage))
+		} else {
+			fmt.Fprintf(&b, " '*-%s[%s]:value:'", f.Name, zshEscaper.Replace(f.Usage))
+		}
+	}
+	return b.String()
+}
+
+var fishEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion for multireq")
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+		fmt.Fprintf(w, "complete -c multireq -n __fish_use_subcommand -f -a %s -d '%s'\n", c.name, fishEscaper.Replace(c.summary))
+	}
+	for _, c := range commands {
+		cond := "__fish_seen_subcommand_from " + c.name
+		if c == commands[0] {
+			// serve's flags also apply when no command is given.
+			cond = "not __fish_seen_subcommand_from " + strings.Join(names[1:], " ")
+		}
+		if choices := argChoices(c); choices != nil {
+			fmt.Fprintf(w, "complete -c multireq -n '%s' -f -a '%s'\n", cond, strings.Join(choices, " "))
+		}
+		for _, f := range commandFlags(c) {
+			req := " -r"
+			if isBoolFlag(f) {
+				req = ""
+			}
+			fmt.Fprintf(w, "complete -c multireq -n '%s' -o %s%s -d '%s'\n", cond, f.Name, req, fishEscaper.Replace(f.Usage))
+		}
+	}
+}
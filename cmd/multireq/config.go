@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/whyrusleeping/multireq"
+)
+
+// readConfig reads the config file at path into the arguments serve would
+// take on the command line. The file holds top-level TOML keys, one per
+// line: listen, target, and the name of any serve flag. A value is a bare
+// word, a quoted string, or an array of them, which repeats the key:
+//
+//	listen = ":7777"
+//	target = ["http://10.0.0.1:8080", "http://10.0.0.2:8080"]
+//	timeout = "5s"
+//	target-name = ["http://10.0.0.1:8080=a", "http://10.0.0.2:8080=b"]
+//	access-log = true
+//
+// A file sops encrypted is decrypted with sops first.
+func readConfig(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if sopsEncrypted(b) {
+		if b, err = sopsDecrypt(path); err != nil {
+			return nil, err
+		}
+	}
+	var flags, targets []string
+	listen := ""
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: not of the form <key> = <value>", path, n)
+		}
+		key = strings.TrimSpace(key)
+		values, err := configValues(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %s", path, n, key, err)
+		}
+		switch key {
+		case "listen":
+			if listen != "" || len(values) != 1 {
+				return nil, fmt.Errorf("%s:%d: listen must be given once", path, n)
+			}
+			listen = values[0]
+		case "target":
+			targets = append(targets, values...)
+		case "config":
+			return nil, fmt.Errorf("%s:%d: a config file can't name another", path, n)
+		default:
+			for _, v := range values {
+				flags = append(flags, "-"+key+"="+v)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if listen == "" {
+		return nil, fmt.Errorf("%s: no listen address", path)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s: no targets", path)
+	}
+	return append(append(flags, listen), targets...), nil
+}
+
+// configValues parses a config value: a quoted string, a bare word, or an
+// array of either.
+func configValues(raw string) ([]string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		v, rest, err := configValue(raw)
+		if err == nil && rest != "" && !strings.HasPrefix(rest, "#") {
+			err = fmt.Errorf("unexpected %q", rest)
+		}
+		return []string{v}, err
+	}
+	var values []string
+	rest := strings.TrimSpace(raw[1:])
+	for !strings.HasPrefix(rest, "]") {
+		v, r, err := configValue(rest)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if rest = strings.TrimSpace(r); strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, errors.New("array values must be separated by commas")
+		}
+	}
+	if rest = strings.TrimSpace(rest[1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, fmt.Errorf("unexpected %q", rest)
+	}
+	return values, nil
+}
+
+// configValue parses the quoted string or bare word at the start of s,
+// returning what follows it.
+func configValue(s string) (string, string, error) {
+	if s == "" {
+		return "", "", errors.New("no value")
+	}
+	switch s[0] {
+	case '\'':
+		// Literal strings have no escapes.
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], strings.TrimSpace(s[end+2:]), nil
+	case '"':
+		q, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", err
+		}
+		v, err := strconv.Unquote(q)
+		return v, strings.TrimSpace(s[len(q):]), err
+	}
+	end := strings.IndexAny(s, ",]# \t")
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end], strings.TrimSpace(s[end:]), nil
+}
+
+// load returns the config to build from, with its positional arguments:
+// c and args themselves, or, if c names a config file, those read from it.
+func (c *serveConfig) load(args []string, set map[string]bool) (*serveConfig, []string, error) {
+	if c.configFile == "" {
+		return c, args, nil
+	}
+	if len(args) > 0 || len(set) > 1 {
+		return nil, nil, errors.New("-config: give every setting in the file, and no other flags or arguments")
+	}
+	fileArgs, err := readConfig(c.configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-config: %s", err)
+	}
+	fc := &serveConfig{}
+	fs := flag.NewFlagSet(c.configFile, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fc.register(fs)
+	if err := fs.Parse(fileArgs); err != nil {
+		return nil, nil, fmt.Errorf("-config: %s: %s", c.configFile, err)
+	}
+	fc.configFile = c.configFile
+	return fc, fs.Args(), nil
+}
+
+// generation is one build of the proxy, which serves until a reload
+// replaces it, and is closed once its last request is done.
+type generation struct {
+	c       *serveConfig
+	p       *multireq.Proxy
+	h       http.Handler
+	address string
+
+	// reg holds the metrics of every generation, which carry on across
+	// reloads.
+	reg *multireq.Registry
+
+	mu      sync.Mutex
+	serving int
+	retired bool
+	done    chan struct{}
+}
+
+func newGeneration(c *serveConfig, listenAddr string, p *multireq.Proxy, reg *multireq.Registry) *generation {
+	return &generation{c: c, p: p, h: c.v.wrap(p), address: listenAddr, reg: reg, done: make(chan struct{})}
+}
+
+// enter counts a request as being served by g, unless g has been retired.
+func (g *generation) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.serving++
+	return true
+}
+
+func (g *generation) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.serving--; g.retired && g.serving == 0 {
+		close(g.done)
+	}
+}
+
+// retire waits for g's requests to finish, then closes its proxy.
+func (g *generation) retire() {
+	g.mu.Lock()
+	g.retired = true
+	if g.serving == 0 {
+		close(g.done)
+	}
+	g.mu.Unlock()
+	<-g.done
+	g.p.Close()
+}
+
+// reloader serves through the current generation, which a reload swaps
+// for a new one without interrupting the requests of the old.
+type reloader struct {
+	cur   atomic.Pointer[generation]
+	conns sync.Map // net.Conn to the proxy that knows it
+
+	// canary, while a reload is canaried, holds the generation being
+	// tried on a share of the requests.
+	canary atomic.Pointer[canary]
+}
+
+func (rl *reloader) current() *generation {
+	return rl.cur.Load()
+}
+
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if cn := rl.canary.Load(); cn != nil && cn.serve(w, r, rl.current()) {
+		return
+	}
+	g := rl.current()
+	for !g.enter() {
+		g = rl.current()
+	}
+	defer g.leave()
+	g.h.ServeHTTP(w, r)
+}
+
+func (rl *reloader) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	p := rl.current().p
+	rl.conns.Store(c, p)
+	return p.ConnContext(ctx, c)
+}
+
+func (rl *reloader) ConnState(c net.Conn, s http.ConnState) {
+	if v, ok := rl.conns.Load(c); ok {
+		v.(*multireq.Proxy).ConnState(c, s)
+		if s == http.StateClosed || s == http.StateHijacked {
+			rl.conns.Delete(c)
+		}
+	}
+}
+
+// adminHandler serves the admin API of the current generation.
+func (rl *reloader) adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.current().p.AdminHandler().ServeHTTP(w, r)
+	})
+}
+
+// start gets g's proxy ready to serve in place of prev, if there is one.
+func (g *generation) start(prev *generation) error {
+	g.p.Prewarm()
+	if err := g.takeDeliveries(prev); err != nil {
+		return err
+	}
+	g.p.StartChecks()
+	return nil
+}
+
+// takeDeliveries starts g's deliveries in place of prev's, if there is
+// one. Only one generation may deliver from the spool, so prev stops
+// delivering just before g starts, and starts again if g can't.
+func (g *generation) takeDeliveries(prev *generation) error {
+	if prev != nil {
+		prev.p.StopDeliveries()
+	}
+	err := g.p.StartDeliveries()
+	if errors.Is(err, multireq.ErrSpoolInUse) && prev == nil && replacing() {
+		// The process we replace lets go of the spool once we serve.
+		go g.awaitSpool()
+	} else if err != nil {
+		if prev != nil {
+			if err := prev.p.StartDeliveries(); err != nil {
+				slog.Error("restarting deliveries", "err", err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// spoolPoll is how often a process started by an upgrade tries to take
+// over the delivery spool from the one it replaces.
+const spoolPoll = 100 * time.Millisecond
+
+// awaitSpool starts g's deliveries once the spool is free, until g is
+// retired.
+func (g *generation) awaitSpool() {
+	for {
+		time.Sleep(spoolPoll)
+		select {
+		case <-g.done:
+			return
+		default:
+		}
+		err := g.p.StartDeliveries()
+		if err == nil {
+			slog.Info("took over the delivery spool")
+			return
+		}
+		if !errors.Is(err, multireq.ErrSpoolInUse) {
+			slog.Error("starting deliveries", "err", err)
+			return
+		}
+	}
+}
+
+// reload builds a new generation from the config file and swaps it in,
+// keeping the old one if the file can't be built.
+func (rl *reloader) reload(c *serveConfig) {
+	if rl.canary.Load() != nil {
+		slog.Error("not reloading the config while the last reload's canary runs", "file", c.configFile)
+		return
+	}
+	old := rl.current()
+	fc, args, err := c.load(nil, map[string]bool{"config": true})
+	var p *multireq.Proxy
+	listenAddr := ""
+	if err == nil {
+		listenAddr, p, err = fc.build(args, old.reg)
+	}
+	if err != nil {
+		slog.Error("reloading the config; keeping the one before", "file", c.configFile, "err", err)
+		return
+	}
+	if listenAddr != old.address {
+		slog.Warn("the listen address only changes on restart", "listen", old.address, "config", listenAddr)
+	}
+	// The rest are read once, on startup, from c.
+	for _, s := range []struct {
+		name     string
+		was, now any
+	}{
+		{"tls-cert", c.tlsCert, fc.tlsCert},
+		{"tls-key", c.tlsKey, fc.tlsKey},
+		{"workers", c.workers, fc.workers},
+		{"admin", c.adminAddr, fc.adminAddr},
+		{"pid-file", c.pidFile, fc.pidFile},
+		{"drain-timeout", c.drainTimeout, fc.drainTimeout},
+		{"head-cache-file", c.headCacheFile, fc.headCacheFile},
+		{"log-format", c.logFormat, fc.logFormat},
+		{"log-level", c.logLevel, fc.logLevel},
+	} {
+		if !reflect.DeepEqual(s.was, s.now) {
+			slog.Warn("setting only changes on restart", "setting", s.name, "running", s.was, "config", s.now)
+		}
+	}
+	if c.tlsProfile != fc.tlsProfile || c.tlsMinVersion != fc.tlsMinVersion || !slices.Equal(c.tlsCiphers, fc.tlsCiphers) {
+		slog.Warn("the listener's TLS policy only changes on restart; targets use the new one")
+	}
+	g := newGeneration(fc, old.address, p, old.reg)
+	p.CopyHeadCache(old.p)
+	if fc.canaryPercent > 0 {
+		rl.startCanary(g, old)
+		return
+	}
+	if err := g.start(old); err != nil {
+		p.Close()
+		slog.Error("reloading the config; keeping the one before", "file", c.configFile, "err", err)
+		return
+	}
+	rl.swap(g, old)
+}
+
+// swap makes g, started, the current generation in place of old, which is
+// retired.
+func (rl *reloader) swap(g, old *generation) {
+	rl.cur.Store(g)
+	slog.Info("reloaded the config", "file", g.c.configFile, "targets", len(g.p.Targets()))
+	// The targets are the file's alone: those added through the admin API
+	// are dropped, and those removed or drained come back.
+	listed := make(map[string]bool)
+	for _, t := range g.p.Targets() {
+		listed[t.String()] = true
+	}
+	for _, t := range old.p.Targets() {
+		if !listed[t.String()] {
+			slog.Warn("dropped a target the config file doesn't list", "target", t.String())
+		}
+	}
+	go old.retire()
+}
@@ -0,0 +1,10 @@
+// Building with -tags fips turns on FIPS 140-3 mode, in which crypto/tls
+// negotiates only approved algorithms, and allows the fips TLS profile.
+// Setting GOFIPS140=v1.0.0 when building links the validated module rather
+// than the latest one.
+
+//go:build fips
+
+//go:debug fips140=on
+
+package main
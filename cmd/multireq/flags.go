@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// listFlag collects the values of a flag that may be repeated or given as a
+// comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// set returns the values as a lookup table after applying norm to each, or
+// nil if the flag was never given.
+func (l listFlag) set(norm func(string) string) map[string]bool {
+	if len(l) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(l))
+	for _, v := range l {
+		m[norm(v)] = true
+	}
+	return m
+}
+
+// targetFlag collects per-target values given as <target>=<value>, where
+// target is written exactly as it is on the command line.
+type targetFlag map[string]string
+
+func (t targetFlag) String() string {
+	var parts []string
+	for k, v := range t {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (t targetFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("%q is not of the form <target>=<value>", s)
+	}
+	t[k] = v
+	return nil
+}
+
+// check reports any key that is not one of the given targets.
+func (t targetFlag) check(name string, targets []string) error {
+	for k := range t {
+		if !slices.Contains(targets, k) {
+			return fmt.Errorf("-%s: %s is not a target", name, k)
+		}
+	}
+	return nil
+}
+
+// targetListFlag collects per-target values given as <target>=<value>,
+// any number of them for each target.
+type targetListFlag map[string][]string
+
+func (t targetListFlag) String() string {
+	var parts []string
+	for k, vs := range t {
+		for _, v := range vs {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (t targetListFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("%q is not of the form <target>=<value>", s)
+	}
+	t[k] = append(t[k], v)
+	return nil
+}
+
+// check reports any key that is not one of the given targets.
+func (t targetListFlag) check(name string, targets []string) error {
+	for k := range t {
+		if !slices.Contains(targets, k) {
+			return fmt.Errorf("-%s: %s is not a target", name, k)
+		}
+	}
+	return nil
+}
+
+// routeFlag collects per-route values given as <path prefix>=<value>.
+type routeFlag map[string]string
+
+func (r routeFlag) String() string {
+	return targetFlag(r).String()
+}
+
+func (r routeFlag) Set(s string) error {
+	k, v, err := cutRoute(s)
+	if err != nil {
+		return err
+	}
+	r[k] = v
+	return nil
+}
+
+// cutRoute splits s, given as <path prefix>=<value>, into its prefix and
+// value.
+func cutRoute(s string) (string, string, error) {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(k, "/") {
+		return "", "", fmt.Errorf("%q is not of the form <path prefix>=<value>", s)
+	}
+	return k, v, nil
+}
+
+// ruleFlag collects a value for every request, or given as
+// <path prefix>=<value>, for the requests under a route. The empty prefix
+// holds the value for every request.
+type ruleFlag map[string]string
+
+func (r ruleFlag) String() string {
+	return targetFlag(r).String()
+}
+
+func (r ruleFlag) Set(s string) error {
+	k, v := "", s
+	if strings.HasPrefix(s, "/") {
+		var err error
+		if k, v, err = cutRoute(s); err != nil {
+			return err
+		}
+	}
+	r[k] = v
+	return nil
+}
+
+// ruleListFlag collects, as listFlag does, values for every request or,
+// given as <path prefix>=<values>, for the requests under a route.
+type ruleListFlag map[string]listFlag
+
+func (r ruleListFlag) String() string {
+	var parts []string
+	for k, l := range r {
+		if k != "" {
+			parts = append(parts, k+"="+l.String())
+		} else {
+			parts = append(parts, l.String())
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r ruleListFlag) Set(s string) error {
+	k, v := "", s
+	if strings.HasPrefix(s, "/") {
+		var err error
+		if k, v, err = cutRoute(s); err != nil {
+			return err
+		}
+	}
+	l := r[k]
+	l.Set(v)
+	r[k] = l
+	return nil
+}
+
+// repeatedFlag collects every value of a flag that may be repeated, as
+// given.
+type repeatedFlag []string
+
+func (r *repeatedFlag) String() string {
+	return strings.Join(*r, " ")
+}
+
+func (r *repeatedFlag) Set(s string) error {
+	*r = append(*r, s)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// loadReport accumulates the outcomes of requests sent by bench and replay.
+type loadReport struct {
+	mu        sync.Mutex
+	start     time.Time
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+// runLoad sends the requests returned by next, c at a time, until it
+// returns nil.
+func runLoad(c int, next func() *http.Request) *loadReport {
+	lr := &loadReport{start: time.Now(), statuses: make(map[int]int)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range c {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				req := next()
+				mu.Unlock()
+				if req == nil {
+					return
+				}
+				start := time.Now()
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					_, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				lr.add(time.Since(start), resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return lr
+}
+
+func (lr *loadReport) add(d time.Duration, resp *http.Response, err error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if err != nil {
+		lr.errors++
+		return
+	}
+	lr.latencies = append(lr.latencies, d)
+	lr.statuses[resp.StatusCode]++
+}
+
+func (lr *loadReport) print(w io.Writer) {
+	elapsed := time.Since(lr.start)
+	n := len(lr.latencies) + lr.errors
+	fmt.Fprintf(w, "requests:  %d in %s (%.1f/s)\n", n, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+	fmt.Fprintf(w, "errors:    %d\n", lr.errors)
+
+	codes := make([]int, 0, len(lr.statuses))
+	for c := range lr.statuses {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		fmt.Fprintf(w, "status %d: %d\n", c, lr.statuses[c])
+	}
+
+	if len(lr.latencies) == 0 {
+		return
+	}
+	l := slices.Clone(lr.latencies)
+	slices.Sort(l)
+	pct := func(p float64) time.Duration { return l[int(p*float64(len(l)-1))] }
+	fmt.Fprintf(w, "latency:   p50 %s  p90 %s  p99 %s  max %s\n",
+		pct(.5).Round(time.Microsecond), pct(.9).Round(time.Microsecond),
+		pct(.99).Round(time.Microsecond), l[len(l)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,106 @@
+// Command multireq is a reverse proxy that races every request across its
+// targets. See the multireq package for using it as a library.
+package main
+
+import (
+	"crypto/fips140"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/whyrusleeping/multireq"
+)
+
+// command is a multireq subcommand. setup registers the command's flags and
+// returns the function that runs it on the remaining arguments.
+type command struct {
+	name    string
+	args    string
+	summary string
+	setup   func(fs *flag.FlagSet) func(args []string) error
+}
+
+// commands lists the subcommands. The first is run when none is named, so
+// `multireq [flags] <listen addr> <target>...` still serves.
+var commands = []*command{
+	{"serve", "<listen addr> <target>...", "race requests across targets", setupServe},
+	{"check", "<listen addr> <target>...", "validate serve arguments and probe every target", setupCheck},
+	{"bench", "<url>", "send load to a URL and report latencies", setupBench},
+	{"replay", "<file> <base url>", "replay recorded requests against a URL", setupReplay},
+	{"status", "<admin addr>", "summarize a running multireq's metrics", setupStatus},
+	{"top", "<admin addr>", "watch live races, win rates and errors", setupTop},
+	{"upgrade", "", "replace a running multireq with the installed binary", setupUpgrade},
+	{"version", "", "print the version", setupVersion},
+}
+
+// errUsage is returned by a command whose arguments are wrong, to have its
+// usage printed.
+var errUsage = errors.New("usage")
+
+func main() {
+	cmd, args := commands[0], os.Args[1:]
+	if len(args) > 0 {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			usage()
+			return
+		}
+		for _, c := range commands {
+			if c.name == args[0] {
+				cmd, args = c, args[1:]
+				break
+			}
+		}
+	}
+
+	fs := flag.NewFlagSet("multireq "+cmd.name, flag.ExitOnError)
+	run := cmd.setup(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: multireq %s [flags] %s\n", cmd.name, cmd.args)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	err := run(fs.Args())
+	if errors.Is(err, errUsage) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		die(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: multireq <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "       multireq [serve flags] <listen addr> <target>...")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun `multireq <command> -h` for a command's flags")
+}
+
+func setupVersion(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		fips := ""
+		if fips140.Enabled() {
+			fips = " fips140=" + fips140.Version()
+		}
+		fmt.Printf("multireq %s %s %s/%s%s\n", multireq.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH, fips)
+		return nil
+	}
+}
+
+func setupUpgrade(fs *flag.FlagSet) func([]string) error {
+	pidFile := fs.String("pid-file", "multireq.pid", "pid file of the running multireq")
+	return func(args []string) error {
+		return upgrade(*pidFile)
+	}
+}
+
+func die(err error) {
+	fmt.Println(err)
+	os.Exit(1)
+}
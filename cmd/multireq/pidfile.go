@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// writePidFile records our pid at path, if one is given, so that other
+// invocations such as `multireq upgrade` can find us.
+func writePidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
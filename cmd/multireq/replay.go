@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// replayEntry is one request read from a replay file.
+type replayEntry struct {
+	method string
+	uri    string
+}
+
+// readReplay parses a replay file: one request per line, written as
+// "<method> <request uri>" or just the request URI for a GET. Blank lines and
+// lines starting with # are skipped.
+func readReplay(r io.Reader) ([]replayEntry, error) {
+	var entries []replayEntry
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		f := strings.Fields(s)
+		switch len(f) {
+		case 1:
+			entries = append(entries, replayEntry{http.MethodGet, f[0]})
+		case 2:
+			entries = append(entries, replayEntry{strings.ToUpper(f[0]), f[1]})
+		default:
+			return nil, fmt.Errorf("line %d: want \"<method> <uri>\"", line)
+		}
+	}
+	return entries, sc.Err()
+}
+
+func setupReplay(fs *flag.FlagSet) func([]string) error {
+	c := fs.Int("c", 1, "number of requests in flight at once")
+	return func(args []string) error {
+		if len(args) != 2 || *c < 1 {
+			return errUsage
+		}
+		in := os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		entries, err := readReplay(in)
+		if err != nil {
+			return fmt.Errorf("%s: %s", args[0], err)
+		}
+
+		base := strings.TrimSuffix(args[1], "/")
+		var reqs []*http.Request
+		for _, e := range entries {
+			req, err := http.NewRequest(e.method, base+e.uri, nil)
+			if err != nil {
+				return err
+			}
+			reqs = append(reqs, req)
+		}
+		lr := runLoad(*c, func() *http.Request {
+			if len(reqs) == 0 {
+				return nil
+			}
+			req := reqs[0]
+			reqs = reqs[1:]
+			return req
+		})
+		lr.print(os.Stdout)
+		return nil
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+// soReusePort is SO_REUSEPORT from asm-generic/socket.h, which the syscall
+// package doesn't export.
+const soReusePort = 0xf
+
+// listenReusePort binds addr with SO_REUSEPORT, letting several worker
+// processes share it and the kernel spread connections between them.
+func listenReusePort(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
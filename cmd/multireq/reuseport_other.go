@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenReusePort(addr string) (net.Listener, error) {
+	return nil, errors.New("SO_REUSEPORT workers are only supported on linux")
+}
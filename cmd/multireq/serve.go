@@ -0,0 +1,1133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/whyrusleeping/multireq"
+)
+
+// Client connections that send their headers too slowly, or sit idle between
+// requests for too long, are closed so they can't hold resources forever.
+const (
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// serveConfig holds the flags describing a proxy, shared by serve and check.
+type serveConfig struct {
+	v                   validator
+	maxURLLength        ruleFlag
+	methods             ruleListFlag
+	requiredHeaders     ruleListFlag
+	contentTypes        ruleListFlag
+	headCacheSize       int
+	headCacheFile       string
+	configFile          string
+	canaryPercent       int
+	canaryDuration      time.Duration
+	canaryErrorRate     float64
+	logFormat           string
+	logLevel            string
+	accessLog           bool
+	negativeCache       time.Duration
+	negativeCacheSize   int
+	familyTTL           time.Duration
+	familySize          int
+	fullRace            repeatedFlag
+	fullRaceHeaders     repeatedFlag
+	longPoll            repeatedFlag
+	userAgent           string
+	targetUA            targetFlag
+	bind                string
+	targetBind          targetFlag
+	caBundle            string
+	targetCABundle      targetFlag
+	insecure            bool
+	targetInsecure      targetFlag
+	targetSNI           targetFlag
+	tlsProfile          string
+	tlsMinVersion       string
+	tlsCiphers          listFlag
+	targetTLSProfile    targetFlag
+	tlsPolicy           *multireq.TLSPolicy
+	tlsCert             string
+	tlsKey              string
+	pidFile             string
+	workers             int
+	adminAddr           string
+	adminToken          string
+	drainTimeout        time.Duration
+	maxAge              time.Duration
+	targetMaxAge        targetFlag
+	maxRate             float64
+	targetMaxRate       targetFlag
+	prewarm             int
+	targetPrewarm       targetFlag
+	sessionCache        int
+	maxIdleConns        int
+	idleConnTimeout     time.Duration
+	targetMaxIdleConns  targetFlag
+	targetIdleTimeout   targetFlag
+	targetSessionCache  targetFlag
+	degradeAt           int
+	degradeFanout       int
+	maxRaces            int
+	tenantHeader        string
+	tenantWeights       string
+	queueWait           time.Duration
+	affinity            string
+	budget              float64
+	budgetWindow        time.Duration
+	budgetMin           int
+	breaker             float64
+	breakerWindow       time.Duration
+	breakerMin          int
+	breakerOpen         time.Duration
+	budgetWebhook       string
+	checks              routeFlag
+	adaptiveTimeouts    routeFlag
+	checkWebhook        string
+	healthCheck         string
+	healthInterval      time.Duration
+	healthyThreshold    int
+	unhealthyThreshold  int
+	fallbacks           routeFlag
+	errorPages          routeFlag
+	signatures          routeFlag
+	deliver             listFlag
+	deliverySpool       string
+	deliveryRetry       time.Duration
+	deliveryRetryMax    time.Duration
+	deliveryAttempts    int
+	banner              string
+	redundancy          bool
+	resume              bool
+	reportTrailer       bool
+	flushInterval       time.Duration
+	accept              string
+	acceptBody          string
+	acceptBodyLimit     int
+	failOn              string
+	stripPrefix         string
+	xForwarded          bool
+	via                 bool
+	forwarded           bool
+	broadcastUpgrades   bool
+	dnsMinTTL           time.Duration
+	dnsMaxTTL           time.Duration
+	decisionsDir        string
+	bodyMemory          int64
+	maxBody             int64
+	spillDir            string
+	auditLog            string
+	auditSample         float64
+	auditMaxBody        int
+	auditHeaders        listFlag
+	auditFields         listFlag
+	auditPatterns       repeatedFlag
+	experiment          string
+	variants            repeatedFlag
+	experimentKey       string
+	exposureLog         string
+	trusted             listFlag
+	targetName          targetFlag
+	targetLabels        targetFlag
+	selectors           repeatedFlag
+	headerTimeout       time.Duration
+	bodyStall           time.Duration
+	timeout             time.Duration
+	hedge               time.Duration
+	hedgePercentile     float64
+	hedgeLearn          bool
+	strategy            string
+	quorum              int
+	primary             string
+	diffLog             string
+	diffHeaders         listFlag
+	diffJSON            bool
+	staging             repeatedFlag
+	stagingPercent      float64
+	stagingRate         float64
+	stagingInFlight     int
+	injectDelay         string
+	transforms          repeatedFlag
+	negotiate           repeatedFlag
+	injectDelayPercent  float64
+	attemptTimeout      time.Duration
+	targetAttempt       targetFlag
+	targetHeaderTimeout targetFlag
+	targetBodyStall     targetFlag
+	targetOAuth2        targetFlag
+	targetHeaders       targetListFlag
+
+	// dryRun, set by check, builds the proxy without creating or opening
+	// any of the files and directories it would write to.
+	dryRun bool
+}
+
+func (c *serveConfig) register(fs *flag.FlagSet) {
+	c.targetUA = targetFlag{}
+	c.targetName = targetFlag{}
+	c.targetLabels = targetFlag{}
+	c.targetHeaderTimeout = targetFlag{}
+	c.targetBodyStall = targetFlag{}
+	c.targetAttempt = targetFlag{}
+	c.targetOAuth2 = targetFlag{}
+	c.targetHeaders = targetListFlag{}
+	c.targetBind = targetFlag{}
+	c.targetCABundle = targetFlag{}
+	c.targetInsecure = targetFlag{}
+	c.targetSNI = targetFlag{}
+	c.targetTLSProfile = targetFlag{}
+	c.targetMaxAge = targetFlag{}
+	c.targetMaxRate = targetFlag{}
+	c.targetPrewarm = targetFlag{}
+	c.targetSessionCache = targetFlag{}
+	c.targetMaxIdleConns = targetFlag{}
+	c.targetIdleTimeout = targetFlag{}
+	c.fallbacks = routeFlag{}
+	c.errorPages = routeFlag{}
+	c.signatures = routeFlag{}
+	c.checks = routeFlag{}
+	c.adaptiveTimeouts = routeFlag{}
+	c.maxURLLength = ruleFlag{}
+	c.methods = ruleListFlag{}
+	c.requiredHeaders = ruleListFlag{}
+	c.contentTypes = ruleListFlag{}
+	fs.Var(c.maxURLLength, "max-url-length", "reject requests whose URL is longer than this (0 for no limit), or as <path prefix>=<length>, those under a route (repeatable)")
+	fs.Var(c.methods, "methods", "comma separated list of allowed request methods, or as <path prefix>=<methods>, those allowed under a route (repeatable)")
+	fs.Var(c.requiredHeaders, "require-header", "header that must be present on every request, or as <path prefix>=<header>, on those under a route (repeatable)")
+	fs.Var(c.contentTypes, "content-types", "comma separated list of allowed request content types, or as <path prefix>=<types>, those allowed under a route (repeatable)")
+	fs.IntVar(&c.headCacheSize, "head-cache", 0, "answer HEAD requests from the metadata of up to this many cached GET responses (0 to disable)")
+	fs.DurationVar(&c.negativeCache, "negative-cache", 0, "leave a target out of races for a resource this long after it answers a GET or HEAD for it with 404 or 410 (0 to disable)")
+	fs.IntVar(&c.negativeCacheSize, "negative-cache-size", 10000, "most -negative-cache entries to keep")
+	fs.DurationVar(&c.familyTTL, "family-ttl", 0, "send requests with the same X-Multireq-Family header to the target that won the family's last race, if within this long, racing the others only if it fails (0 to disable)")
+	fs.IntVar(&c.familySize, "family-size", 10000, "most -family-ttl families to remember")
+	fs.Var(&c.fullRace, "full-race", "path prefix whose requests are never answered from or stored in a cache and are always raced against every target (repeatable)")
+	fs.Var(&c.fullRaceHeaders, "full-race-header", "like -full-race, for requests with a header matching a regular expression, as <header>=<regexp> (repeatable)")
+	fs.Var(&c.longPoll, "long-poll", "path prefix, or pattern such as /users/*/events, of long-poll requests, sent to one target at a time with no timeouts or hedging (repeatable)")
+	fs.StringVar(&c.headCacheFile, "head-cache-file", "", "file to load the -head-cache from on startup and save it to on shutdown")
+	fs.StringVar(&c.userAgent, "user-agent", multireq.DefaultUserAgent, "User-Agent sent to targets (empty to pass on the client's)")
+	fs.Var(c.targetUA, "target-user-agent", "User-Agent for a single target, as <target>=<user agent> (repeatable)")
+	fs.StringVar(&c.bind, "bind", "", "comma separated local IPs or interfaces to send upstream connections from")
+	fs.Var(c.targetBind, "target-bind", "source addresses for a single target, as <target>=<ips or interfaces> (repeatable)")
+	fs.StringVar(&c.caBundle, "ca-bundle", "", "PEM file of CA certificates to verify https targets against, in place of the system's")
+	fs.Var(c.targetCABundle, "target-ca-bundle", "-ca-bundle for a single target, as <target>=<file> (repeatable)")
+	fs.BoolVar(&c.insecure, "insecure-skip-verify", false, "accept any certificate from https targets (unsafe)")
+	fs.Var(c.targetInsecure, "target-insecure-skip-verify", "-insecure-skip-verify for a single target, as <target>=true (repeatable)")
+	fs.Var(c.targetSNI, "target-sni", "server name to send and verify a single https target's certificate against, as <target>=<name> (repeatable)")
+	fs.StringVar(&c.tlsProfile, "tls-profile", "", "TLS policy for the listener and https targets: modern, intermediate, old or fips (default Go's own)")
+	fs.StringVar(&c.tlsMinVersion, "tls-min-version", "", "lowest TLS version to allow, such as 1.2, in place of -tls-profile's")
+	fs.Var(&c.tlsCiphers, "tls-ciphers", "comma separated cipher suites to allow for TLS 1.2 and below, named as in Go's crypto/tls, in place of -tls-profile's")
+	fs.Var(c.targetTLSProfile, "target-tls-profile", "-tls-profile for a single target, as <target>=<profile> (repeatable)")
+	fs.StringVar(&c.tlsCert, "tls-cert", "", "PEM certificate chain to serve HTTPS with on the listen address, along with -tls-key; reloaded when either file changes")
+	fs.StringVar(&c.tlsKey, "tls-key", "", "PEM private key for -tls-cert")
+	fs.StringVar(&c.pidFile, "pid-file", "", "write our pid to this file, for the upgrade command to find")
+	fs.IntVar(&c.workers, "workers", 1, "number of worker processes sharing the listen socket with SO_REUSEPORT")
+	fs.StringVar(&c.adminAddr, "admin", "", "address to serve the admin API on")
+	fs.DurationVar(&c.drainTimeout, "drain-timeout", 30*time.Second, "on SIGINT, SIGTERM or an upgrade, how long to wait for in-flight requests before cancelling them")
+	fs.StringVar(&c.adminToken, "admin-token", "", "reference to a bearer token, as env:, file: or vault:, that lets admin API clients add, drain and remove targets")
+	fs.DurationVar(&c.maxAge, "max-response-age", 0, "reject responses older than this according to their Date and Age headers (0 for no limit)")
+	fs.Var(c.targetMaxAge, "target-max-response-age", "-max-response-age for a single target, as <target>=<duration> (repeatable)")
+	fs.Float64Var(&c.maxRate, "max-rate", 0, "most requests per second to send each target, leaving it out of races beyond that (0 for no limit)")
+	fs.Var(c.targetMaxRate, "target-max-rate", "-max-rate for a single target, as <target>=<requests per second> (repeatable)")
+	fs.IntVar(&c.prewarm, "prewarm", 0, "number of connections to open to each target on startup, before serving")
+	fs.Var(c.targetPrewarm, "target-prewarm", "-prewarm for a single target, as <target>=<connections> (repeatable)")
+	fs.IntVar(&c.maxIdleConns, "max-idle-conns", multireq.DefaultMaxIdleConns, "number of idle connections to keep open to each target for reuse")
+	fs.Var(c.targetMaxIdleConns, "target-max-idle-conns", "-max-idle-conns for a single target, as <target>=<connections> (repeatable)")
+	fs.DurationVar(&c.idleConnTimeout, "idle-conn-timeout", multireq.DefaultIdleConnTimeout, "close connections to targets that have been idle this long (0 to keep them until the target closes them)")
+	fs.Var(c.targetIdleTimeout, "target-idle-conn-timeout", "-idle-conn-timeout for a single target, as <target>=<duration> (repeatable)")
+	fs.IntVar(&c.sessionCache, "tls-session-cache", multireq.DefaultTLSSessionCache, "number of TLS sessions to keep per target for resuming connections (0 to never resume)")
+	fs.Var(c.targetSessionCache, "target-tls-session-cache", "-tls-session-cache for a single target, as <target>=<sessions> (repeatable)")
+	fs.IntVar(&c.degradeAt, "degrade-in-flight", 0, "race only -degrade-fanout targets per request while this many races are in flight, until half that (0 to never degrade)")
+	fs.IntVar(&c.degradeFanout, "degrade-fanout", 1, "number of targets, the fastest, to race per request while degraded")
+	fs.IntVar(&c.maxRaces, "max-races", 0, "most races to run at once, queueing the rest fairly across tenants (0 for no limit)")
+	fs.StringVar(&c.tenantHeader, "tenant-header", "", "request header, such as X-Tenant-Id, naming the tenant a request is queued for under -max-races; by default the client's IP address")
+	fs.StringVar(&c.tenantWeights, "tenant-weights", "", "shares of -max-races for tenants other than the default of 1, as <tenant>=<weight>,...")
+	fs.DurationVar(&c.queueWait, "queue-wait", 5*time.Second, "longest a request waits for its turn under -max-races before getting a 503")
+	fs.StringVar(&c.affinity, "affinity-header", "", "request header, such as X-User-Id, whose value sends a request to one target picked by consistent hashing, racing the rest only if that one fails")
+	fs.Float64Var(&c.budget, "error-budget", 0, "share of a target's attempts, such as 0.05, that may fail within -error-budget-window before its responses stop being used (0 for no budget)")
+	fs.DurationVar(&c.budgetWindow, "error-budget-window", 5*time.Minute, "window to judge -error-budget over, up to 5m")
+	fs.IntVar(&c.budgetMin, "error-budget-min-attempts", 20, "fewest attempts within -error-budget-window to judge a target by")
+	fs.Float64Var(&c.breaker, "circuit-breaker", 0, "share of a target's attempts, such as 0.5, that may fail within -circuit-breaker-window before it is left out of races for -circuit-breaker-open (0 for no breaker)")
+	fs.DurationVar(&c.breakerWindow, "circuit-breaker-window", 30*time.Second, "window to judge -circuit-breaker over, up to 5m")
+	fs.IntVar(&c.breakerMin, "circuit-breaker-min-attempts", 10, "fewest attempts within -circuit-breaker-window to judge a target by")
+	fs.DurationVar(&c.breakerOpen, "circuit-breaker-open", 30*time.Second, "how long a target's circuit stays open before one request is let through to probe it")
+	fs.StringVar(&c.budgetWebhook, "error-budget-webhook", "", "URL to post a JSON event to whenever a target goes over its error budget or recovers")
+	fs.Var(c.adaptiveTimeouts, "adaptive-timeout", "replace -timeout under a path prefix with a multiple of how long its recent requests took, as <path prefix>=percentile=p99,factor=2,min=100ms,max=30s (repeatable; every setting optional)")
+	fs.Var(c.checks, "check", "send a synthetic request for a path to every target on a schedule, as <path>=method=GET,status=200,body=<regexp>,every=30s,timeout=10s (repeatable; every setting optional)")
+	fs.StringVar(&c.checkWebhook, "check-webhook", "", "URL to post a JSON event to whenever a -check starts or stops failing on a target, or a -health-check evicts or restores one")
+	fs.StringVar(&c.healthCheck, "health-check", "", "path to GET from every target on a schedule, taking a target out of races while it keeps failing")
+	fs.DurationVar(&c.healthInterval, "health-check-interval", 5*time.Second, "how often to run -health-check")
+	fs.IntVar(&c.healthyThreshold, "healthy-threshold", 2, "passes of -health-check in a row that put an evicted target back")
+	fs.IntVar(&c.unhealthyThreshold, "unhealthy-threshold", 3, "failures of -health-check in a row that evict a target")
+	fs.Var(c.fallbacks, "fallback", "local file or directory to serve GET requests under a path prefix when no target answers, as <path prefix>=<path> (repeatable)")
+	fs.Var(c.errorPages, "error-page", "HTML template shown to browsers under a path prefix when no target answers, as <path prefix>=<file> (repeatable)")
+	fs.Var(c.signatures, "verify-signature", "require HMAC signed requests under a path prefix, as <path prefix>=style=github|stripe|hmac,secret=<secret reference>,... (repeatable; see README)")
+	fs.Var(&c.deliver, "deliver", "comma separated path prefixes whose requests, such as webhooks, are answered 202 and delivered to every target with retries rather than raced")
+	fs.StringVar(&c.deliverySpool, "delivery-spool", "", "directory to keep -deliver events in until every target has them")
+	fs.DurationVar(&c.deliveryRetry, "delivery-retry", time.Second, "wait before retrying a failed -deliver event, doubling with each attempt")
+	fs.DurationVar(&c.deliveryRetryMax, "delivery-retry-max", 10*time.Minute, "longest wait between -deliver attempts")
+	fs.IntVar(&c.deliveryAttempts, "delivery-attempts", 0, "attempts to deliver an event before making it a dead letter (0 to retry forever)")
+	fs.StringVar(&c.banner, "outage-banner", "", "HTML to insert at the top of HTML responses while any target is unhealthy")
+	fs.BoolVar(&c.resume, "resume", true, "when the winning target fails partway through the body of a GET, ask another for the rest with a range request, if the response has a strong ETag")
+	fs.StringVar(&c.accept, "accept", "200,302,304", "comma separated statuses, or classes such as 2xx, of responses that can win a race")
+	fs.StringVar(&c.acceptBody, "accept-body", "", "fail responses that would win unless the start of their body passes a check: regexp:<regexp>, !regexp:<regexp>, jsonpath:<path>, or jsonpath:<path> == or != <json value>")
+	fs.IntVar(&c.acceptBodyLimit, "accept-body-limit", multireq.DefaultBodyCheckLimit, "bytes of each body -accept-body reads")
+	fs.StringVar(&c.failOn, "fail-on", "", "comma separated statuses, or classes such as 5xx, of responses that fail even if -accept takes them")
+	fs.DurationVar(&c.flushInterval, "flush-interval", multireq.DefaultFlushInterval, "longest a winning response's body waits to be flushed to the client (0 to wait for the buffer to fill, negative to flush after every write); event streams are flushed after every write")
+	fs.StringVar(&c.stripPrefix, "strip-prefix", "", "remove this prefix from the paths of requests under it before sending them to targets, which join what is left to their own paths")
+	fs.BoolVar(&c.xForwarded, "x-forwarded", true, "tell targets the client's address, and the host and scheme it asked for, in X-Forwarded-For, -Host and -Proto headers")
+	fs.BoolVar(&c.via, "via", true, "append multireq to the Via header of requests and responses")
+	fs.BoolVar(&c.forwarded, "forwarded", false, "tell targets the client's address, and the host and scheme it asked for, in a Forwarded header")
+	fs.BoolVar(&c.broadcastUpgrades, "broadcast-upgrades", false, "send WebSocket and other protocol upgrades to every target, joining the client to the -primary, or the first to switch, and sending the others a copy of what the client sends")
+	fs.BoolVar(&c.reportTrailer, "report-trailer", false, "end every response passed on with a Multireq-Report trailer of each target's outcome and timings, sending it without a Content-Length")
+	fs.BoolVar(&c.redundancy, "redundancy-header", false, "tell clients in an X-Multireq-Redundancy header how many targets raced their request and how many are healthy")
+	fs.DurationVar(&c.dnsMinTTL, "dns-min-ttl", 0, "reuse resolved target addresses for this long before resolving again (0 to resolve every connection)")
+	fs.DurationVar(&c.dnsMaxTTL, "dns-max-ttl", 0, "keep using resolved addresses this long after they were resolved if resolving again fails (0 for -dns-min-ttl)")
+	fs.Int64Var(&c.bodyMemory, "body-memory", 1<<20, "bytes of each request body to buffer in memory before spilling to -body-spill-dir")
+	fs.Int64Var(&c.maxBody, "max-body-size", 0, "reject request bodies larger than this many bytes with a 413 (0 for no limit)")
+	fs.StringVar(&c.spillDir, "body-spill-dir", os.TempDir(), "directory for request bodies larger than -body-memory (empty to reject them instead)")
+	fs.StringVar(&c.configFile, "config", "", "file to read the listen address, targets and every other setting from instead of the command line, reloaded on SIGHUP")
+	fs.IntVar(&c.canaryPercent, "reload-canary", 0, "when the -config file is reloaded, send this percentage of requests to the new settings for -reload-canary-duration before the rest, rolling back if their error rate spikes (0 to switch at once)")
+	fs.DurationVar(&c.canaryDuration, "reload-canary-duration", 5*time.Minute, "how long a reload is canaried before it gets every request")
+	fs.Float64Var(&c.canaryErrorRate, "reload-canary-error-rate", 0.05, "how far the share of a canaried reload's requests answered with a 5xx may rise above the old settings' before it is rolled back")
+	fs.StringVar(&c.logFormat, "log-format", "text", "format of the log on stderr: text or json")
+	fs.StringVar(&c.logLevel, "log-level", "info", "least severe level to log: debug, info, warn or error")
+	fs.BoolVar(&c.accessLog, "access-log", false, "log a record of every proxied request: client, method, path, status, winning target, each target's outcome and timings, bytes written and duration")
+	fs.StringVar(&c.auditLog, "audit-log", "", "file to append a sample of served responses to as JSON lines, scrubbed by the -audit-redact flags")
+	fs.Float64Var(&c.auditSample, "audit-sample", 1, "share of responses to record in -audit-log, such as 0.01")
+	fs.IntVar(&c.auditMaxBody, "audit-max-body", 64<<10, "most bytes of each response body to record in -audit-log")
+	fs.Var(&c.auditHeaders, "audit-redact-header", "comma separated response headers to redact in -audit-log; Set-Cookie always is")
+	fs.Var(&c.auditFields, "audit-mask-json", "comma separated JSON paths, like user.email or items.*.card, whose values to mask in -audit-log")
+	fs.Var(&c.auditPatterns, "audit-redact", "regular expression to redact from headers, URLs and bodies in -audit-log (repeatable)")
+	fs.StringVar(&c.decisionsDir, "decision-log", "", "directory to write a CSV record of every race decision to, in batches")
+	fs.StringVar(&c.experiment, "experiment", "", "name of an experiment splitting clients between the -variant target groups")
+	fs.Var(&c.variants, "variant", "experiment variant, as <name>[:<weight>]=<target>,<target>... (repeatable)")
+	fs.StringVar(&c.experimentKey, "experiment-key", "", "header identifying clients for experiment assignment (default the client IP)")
+	fs.StringVar(&c.exposureLog, "exposure-log", "", "file to append a JSON line to for every request assigned to a variant")
+	fs.Var(&c.trusted, "trust-overrides-from", "comma separated IPs or CIDR ranges of clients allowed to send X-Multireq-Targets, -Mode, -Timeout and -Pin")
+	fs.Var(c.targetName, "target-name", "name for a single target, used in logs, metrics and override headers, as <target>=<name> (repeatable)")
+	fs.Var(c.targetLabels, "target-labels", "labels for a single target, as <target>=<key>=<value>,<key>=<value>... (repeatable)")
+	fs.DurationVar(&c.headerTimeout, "header-timeout", multireq.DefaultHeaderTimeout, "fail a target that sends no response headers this long after the request (0 to wait forever)")
+	fs.Var(c.targetHeaderTimeout, "target-header-timeout", "-header-timeout for a single target, as <target>=<duration> (repeatable)")
+	fs.StringVar(&c.strategy, "strategy", "race", "how requests are sent to targets: race (all at once), fallback (in order, moving on when one fails) or random (one per request)")
+	fs.Float64Var(&c.hedgePercentile, "hedge-percentile", 0, "in a hedged race, wait for each target for as long as this percentile of its response times over the last minute, if longer than -hedge-delay (0 to wait -hedge-delay alone)")
+	fs.BoolVar(&c.hedgeLearn, "hedge-learn", false, "order hedged races by weights learned from which targets win them, rather than by average response time")
+	fs.StringVar(&c.primary, "primary", "", "target, written as it is among the targets, that answers every request while the rest are sent mirrored copies whose answers are only counted")
+	fs.StringVar(&c.diffLog, "mirror-diff-log", "", "file to append a JSON line to for each mirrored request where a mirror's answer differs from the primary's")
+	fs.Var(&c.diffHeaders, "mirror-diff-headers", "comma separated response headers for -mirror-diff-log to compare, besides status and body")
+	fs.Var(&c.staging, "staging", "target outside the race, a staging deployment say, to send copies of a sample of requests to in the background (repeatable)")
+	fs.Float64Var(&c.stagingPercent, "staging-percent", 10, "percentage of requests to copy to -staging")
+	fs.Float64Var(&c.stagingRate, "staging-max-rate", 100, "most requests to copy to -staging a second (0 for no limit)")
+	fs.IntVar(&c.stagingInFlight, "staging-max-in-flight", 100, "most copies to -staging left unanswered at once")
+	fs.Var(&c.negotiate, "negotiate", "ask targets for a variant of an asset the client accepts, as <suffix>=<variant suffix>[:<media type>], such as .jpg=.webp, falling back to the asset on targets without it (repeatable, most preferred first)")
+	fs.Var(&c.transforms, "transform", "rewrite the bodies of winning responses under a path prefix as they stream, as <path prefix>=<transform>, where a transform is s/<regexp>/<replacement>/, json-set:<field>=<json value> or html-base:<url> (repeatable, applied in order)")
+	fs.StringVar(&c.injectDelay, "inject-delay", "", "for testing clients, hold back winning responses by a time drawn from a distribution: a duration, or uniform:<min>,<max>, normal:<mean>,<deviation> or exponential:<mean>")
+	fs.Float64Var(&c.injectDelayPercent, "inject-delay-percent", 100, "percentage of winning responses to hold back by -inject-delay")
+	fs.BoolVar(&c.diffJSON, "mirror-diff-json", false, "compare JSON bodies for -mirror-diff-log value by value, naming each difference, rather than byte by byte")
+	fs.IntVar(&c.quorum, "quorum", 0, "send each request to every target, answering only once this many return the same status and body (0 to take the first acceptable answer)")
+	fs.DurationVar(&c.hedge, "hedge-delay", 0, "send each request to the fastest target first, and to the next only after this long without an answer (0 to race every target at once)")
+	fs.DurationVar(&c.timeout, "timeout", 0, "give up on a request this long after it arrives, response body included, whatever the targets are doing (0 to wait forever)")
+	fs.DurationVar(&c.attemptTimeout, "attempt-timeout", 0, "fail a target that hasn't sent its whole response this long after the request (0 to wait forever)")
+	fs.Var(c.targetAttempt, "target-attempt-timeout", "-attempt-timeout for a single target, as <target>=<duration> (repeatable)")
+	fs.DurationVar(&c.bodyStall, "body-stall-timeout", 0, "abort a winning response whose body delivers nothing for this long (0 to wait forever)")
+	fs.Var(c.targetBodyStall, "target-body-stall-timeout", "-body-stall-timeout for a single target, as <target>=<duration> (repeatable)")
+	fs.Var(c.targetHeaders, "target-header", "change a header of every request to a single target, as <target>=set: <name>: <value>, <target>=add: <name>: <value> or <target>=remove: <name>; values may refer to secrets, as {env:API_TOKEN} (repeatable)")
+	fs.Var(c.targetOAuth2, "target-oauth2", "fetch OAuth2 tokens for a single target, as <target>=token_url=<url>,client_id=<id>,client_secret=<secret reference>,... (repeatable; see README)")
+	fs.Var(&c.selectors, "select", `expression over target labels and header("<name>") picking the targets to race; the first that picks any is used (repeatable)`)
+}
+
+// build turns the positional arguments, a listen address followed by the
+// targets, into a proxy recording its metrics in reg.
+func (c *serveConfig) build(args []string, reg *multireq.Registry) (string, *multireq.Proxy, error) {
+	if len(args) < 2 {
+		return "", nil, errUsage
+	}
+	if err := c.setupLogging(); err != nil {
+		return "", nil, err
+	}
+
+	listenAddr, targets := args[0], args[1:]
+	for name, f := range map[string]targetFlag{
+		"target-user-agent":           c.targetUA,
+		"target-bind":                 c.targetBind,
+		"target-ca-bundle":            c.targetCABundle,
+		"target-insecure-skip-verify": c.targetInsecure,
+		"target-sni":                  c.targetSNI,
+		"target-tls-profile":          c.targetTLSProfile,
+		"target-max-response-age":     c.targetMaxAge,
+		"target-max-rate":             c.targetMaxRate,
+		"target-prewarm":              c.targetPrewarm,
+		"target-tls-session-cache":    c.targetSessionCache,
+		"target-max-idle-conns":       c.targetMaxIdleConns,
+		"target-idle-conn-timeout":    c.targetIdleTimeout,
+		"target-name":                 c.targetName,
+		"target-labels":               c.targetLabels,
+		"target-header-timeout":       c.targetHeaderTimeout,
+		"target-body-stall-timeout":   c.targetBodyStall,
+		"target-attempt-timeout":      c.targetAttempt,
+		"target-oauth2":               c.targetOAuth2,
+	} {
+		if err := f.check(name, targets); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := c.targetHeaders.check("target-header", targets); err != nil {
+		return "", nil, err
+	}
+
+	var err error
+	if c.tlsPolicy, err = multireq.NewTLSPolicy(c.tlsProfile, c.tlsMinVersion, c.tlsCiphers); err != nil {
+		return "", nil, err
+	}
+	if c.v, err = newValidator(c.maxURLLength, c.methods, c.requiredHeaders, c.contentTypes); err != nil {
+		return "", nil, err
+	}
+
+	var common []multireq.TargetOption
+	if c.bind != "" {
+		pool, err := multireq.ParseSourcePool(c.bind)
+		if err != nil {
+			return "", nil, err
+		}
+		common = append(common, multireq.WithSourcePool(pool))
+	}
+	if c.dnsMinTTL > 0 {
+		maxTTL := c.dnsMaxTTL
+		if maxTTL == 0 {
+			maxTTL = c.dnsMinTTL
+		}
+		if maxTTL < c.dnsMinTTL {
+			return "", nil, fmt.Errorf("-dns-max-ttl must be at least -dns-min-ttl")
+		}
+		common = append(common, multireq.WithDNSCache(multireq.NewDNSCache(c.dnsMinTTL, maxTTL)))
+	}
+	common = append(common,
+		multireq.WithUserAgent(c.userAgent),
+		multireq.WithMaxAge(c.maxAge),
+		multireq.WithMaxRate(c.maxRate),
+		multireq.WithPrewarm(c.prewarm),
+		multireq.WithTLSSessionCache(c.sessionCache),
+		multireq.WithMaxIdleConns(c.maxIdleConns),
+		multireq.WithIdleConnTimeout(c.idleConnTimeout),
+		multireq.WithHeaderTimeout(c.headerTimeout),
+		multireq.WithAttemptTimeout(c.attemptTimeout),
+		multireq.WithBodyStallTimeout(c.bodyStall),
+	)
+
+	tokens := multireq.NewTokenCache(reg)
+	var ts []*multireq.Target
+	byName := make(map[string]*multireq.Target)
+	for _, t := range targets {
+		u, err := url.Parse(t)
+		if err != nil {
+			return "", nil, err
+		}
+		opts := slices.Clone(common)
+		if name, ok := c.targetName[t]; ok {
+			opts = append(opts, multireq.WithName(name))
+		}
+		if s, ok := c.targetLabels[t]; ok {
+			labels, err := multireq.ParseLabelList(s)
+			if err != nil {
+				return "", nil, fmt.Errorf("-target-labels: %s", err)
+			}
+			opts = append(opts, multireq.WithLabels(labels))
+		}
+		if ua, ok := c.targetUA[t]; ok {
+			opts = append(opts, multireq.WithUserAgent(ua))
+		}
+		if b, ok := c.targetBind[t]; ok {
+			pool, err := multireq.ParseSourcePool(b)
+			if err != nil {
+				return "", nil, err
+			}
+			opts = append(opts, multireq.WithSourcePool(pool))
+		}
+		tlsOpts, err := c.tlsOptions(t, u.Scheme == "https")
+		if err != nil {
+			return "", nil, err
+		}
+		opts = append(opts, tlsOpts...)
+		if s, ok := c.targetMaxAge[t]; ok {
+			age, err := time.ParseDuration(s)
+			if err != nil {
+				return "", nil, fmt.Errorf("-target-max-response-age: %s", err)
+			}
+			opts = append(opts, multireq.WithMaxAge(age))
+		}
+		for name, d := range map[string]struct {
+			f   targetFlag
+			opt func(time.Duration) multireq.TargetOption
+		}{
+			"target-header-timeout":     {c.targetHeaderTimeout, multireq.WithHeaderTimeout},
+			"target-body-stall-timeout": {c.targetBodyStall, multireq.WithBodyStallTimeout},
+			"target-attempt-timeout":    {c.targetAttempt, multireq.WithAttemptTimeout},
+			"target-idle-conn-timeout":  {c.targetIdleTimeout, multireq.WithIdleConnTimeout},
+		} {
+			if s, ok := d.f[t]; ok {
+				timeout, err := time.ParseDuration(s)
+				if err != nil {
+					return "", nil, fmt.Errorf("-%s: %s", name, err)
+				}
+				opts = append(opts, d.opt(timeout))
+			}
+		}
+		if s, ok := c.targetOAuth2[t]; ok {
+			src, err := tokens.Source(s)
+			if err != nil {
+				return "", nil, fmt.Errorf("-target-oauth2: %s", err)
+			}
+			opts = append(opts, multireq.WithPreflight(src))
+		}
+		if specs, ok := c.targetHeaders[t]; ok {
+			rules, err := multireq.ParseHeaderRules(specs)
+			if err != nil {
+				return "", nil, fmt.Errorf("-target-header: %s", err)
+			}
+			opts = append(opts, multireq.WithPreflight(rules))
+		}
+		if s, ok := c.targetMaxRate[t]; ok {
+			rate, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("-target-max-rate: %s", err)
+			}
+			opts = append(opts, multireq.WithMaxRate(rate))
+		}
+		for name, d := range map[string]struct {
+			f   targetFlag
+			opt func(int) multireq.TargetOption
+		}{
+			"target-prewarm":           {c.targetPrewarm, multireq.WithPrewarm},
+			"target-tls-session-cache": {c.targetSessionCache, multireq.WithTLSSessionCache},
+			"target-max-idle-conns":    {c.targetMaxIdleConns, multireq.WithMaxIdleConns},
+		} {
+			if s, ok := d.f[t]; ok {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return "", nil, fmt.Errorf("-%s: %s", name, err)
+				}
+				opts = append(opts, d.opt(n))
+			}
+		}
+		ts = append(ts, multireq.NewTarget(u, opts...))
+		byName[t] = ts[len(ts)-1]
+	}
+
+	e, err := c.buildExperiment(byName)
+	if err != nil {
+		return "", nil, err
+	}
+	var primary *multireq.Target
+	if c.primary != "" {
+		if primary = byName[c.primary]; primary == nil {
+			return "", nil, fmt.Errorf("-primary: %s is not a target", c.primary)
+		}
+	}
+
+	fb, err := multireq.NewFallbacks(c.fallbacks)
+	if err != nil {
+		return "", nil, fmt.Errorf("-fallback: %s", err)
+	}
+	sigs, err := multireq.NewSignatures(c.signatures)
+	if err != nil {
+		return "", nil, fmt.Errorf("-verify-signature: %s", err)
+	}
+	adaptive, err := multireq.NewAdaptiveTimeouts(c.adaptiveTimeouts)
+	if err != nil {
+		return "", nil, fmt.Errorf("-adaptive-timeout: %s", err)
+	}
+	var diffs *multireq.MirrorDiffs
+	if c.diffLog != "" {
+		if diffs, err = multireq.NewMirrorDiffs(c.output(c.diffLog), c.diffHeaders, c.diffJSON); err != nil {
+			return "", nil, fmt.Errorf("-mirror-diff-log: %s", err)
+		}
+	}
+	var staging *multireq.Staging
+	if len(c.staging) > 0 {
+		var sts []*multireq.Target
+		for _, s := range c.staging {
+			u, err := url.Parse(s)
+			if err != nil {
+				return "", nil, fmt.Errorf("-staging: %s", err)
+			}
+			sts = append(sts, multireq.NewTarget(u, common...))
+		}
+		if staging, err = multireq.NewStaging(sts, c.stagingPercent, c.stagingRate, c.stagingInFlight); err != nil {
+			return "", nil, fmt.Errorf("-staging: %s", err)
+		}
+	}
+	// Each worker would try to serve its own admin API on the same address,
+	// and only knows about its own share of the traffic.
+	if c.adminAddr != "" && c.workers > 1 {
+		return "", nil, errors.New("-admin can't be used with -workers")
+	}
+	// Only one process at a time may deliver from a spool.
+	if len(c.deliver) > 0 && c.workers > 1 {
+		return "", nil, errors.New("-deliver can't be used with -workers")
+	}
+	// Nor should workers write over each other's files.
+	if c.workers > 1 {
+		for _, f := range []struct{ flag, path string }{
+			{"-head-cache-file", c.headCacheFile},
+			{"-audit-log", c.auditLog},
+			{"-decision-log", c.decisionsDir},
+			{"-exposure-log", c.exposureLog},
+			{"-mirror-diff-log", c.diffLog},
+		} {
+			if f.path != "" {
+				return "", nil, fmt.Errorf("%s can't be used with -workers", f.flag)
+			}
+		}
+	}
+	if c.canaryPercent < 0 || c.canaryPercent > 100 {
+		return "", nil, errors.New("-reload-canary: a percentage must be from 0 to 100")
+	}
+	if c.canaryPercent > 0 && c.canaryDuration <= 0 {
+		return "", nil, errors.New("-reload-canary-duration must be positive")
+	}
+	var adminToken *multireq.Secret
+	if c.adminToken != "" {
+		if adminToken, err = multireq.ParseSecret(c.adminToken); err != nil {
+			return "", nil, fmt.Errorf("-admin-token: %s", err)
+		}
+	}
+	// Targets added through the admin API get the options every target
+	// does, and those of an https one.
+	added, err := c.tlsOptions("", true)
+	if err != nil {
+		return "", nil, err
+	}
+	added = append(slices.Clone(common), added...)
+	var transforms *multireq.Transforms
+	if len(c.transforms) > 0 {
+		routes := map[string][]string{}
+		for _, s := range c.transforms {
+			prefix, spec, ok := strings.Cut(s, "=")
+			if !ok {
+				return "", nil, fmt.Errorf("-transform: %q is not of the form <path prefix>=<transform>", s)
+			}
+			routes[prefix] = append(routes[prefix], spec)
+		}
+		if transforms, err = multireq.NewTransforms(routes); err != nil {
+			return "", nil, fmt.Errorf("-transform: %s", err)
+		}
+	}
+	accept, err := multireq.ParseStatusSet(c.accept)
+	if err != nil {
+		return "", nil, fmt.Errorf("-accept: %s", err)
+	}
+	failOn, err := multireq.ParseStatusSet(c.failOn)
+	if err != nil {
+		return "", nil, fmt.Errorf("-fail-on: %s", err)
+	}
+	var bodyCheck *multireq.BodyCheck
+	if c.acceptBody != "" {
+		if bodyCheck, err = multireq.ParseBodyCheck(c.acceptBody, c.acceptBodyLimit); err != nil {
+			return "", nil, fmt.Errorf("-accept-body: %s", err)
+		}
+	}
+	var negotiation *multireq.Negotiation
+	if len(c.negotiate) > 0 {
+		if negotiation, err = multireq.NewNegotiation(c.negotiate); err != nil {
+			return "", nil, fmt.Errorf("-negotiate: %s", err)
+		}
+	}
+	var delays *multireq.Delays
+	if c.injectDelay != "" {
+		if delays, err = multireq.NewDelays(c.injectDelay, c.injectDelayPercent); err != nil {
+			return "", nil, fmt.Errorf("-inject-delay: %s", err)
+		}
+		slog.Warn("holding back winning responses, for testing", "delay", c.injectDelay, "percent", c.injectDelayPercent)
+	}
+	var fair *multireq.FairQueue
+	if c.maxRaces > 0 {
+		weights := map[string]string{}
+		if c.tenantWeights != "" {
+			if weights, err = multireq.ParseLabelList(c.tenantWeights); err != nil {
+				return "", nil, fmt.Errorf("-tenant-weights: %s", err)
+			}
+		}
+		if fair, err = multireq.NewFairQueue(c.maxRaces, c.tenantHeader, weights, c.queueWait); err != nil {
+			return "", nil, fmt.Errorf("-max-races: %s", err)
+		}
+	}
+	if c.healthCheck != "" {
+		if _, ok := c.checks[c.healthCheck]; ok {
+			return "", nil, fmt.Errorf("-health-check: %s is already a -check", c.healthCheck)
+		}
+		c.checks[c.healthCheck] = fmt.Sprintf("every=%s,timeout=%s,healthy=%d,unhealthy=%d",
+			c.healthInterval, min(c.healthInterval, 10*time.Second), c.healthyThreshold, c.unhealthyThreshold)
+	}
+	var checks *multireq.Checks
+	if len(c.checks) > 0 {
+		if checks, err = multireq.NewChecks(c.checks, c.checkWebhook); err != nil {
+			return "", nil, fmt.Errorf("-check: %s", err)
+		}
+	}
+	var deliveries *multireq.Deliveries
+	if len(c.deliver) > 0 {
+		if c.deliverySpool == "" {
+			return "", nil, errors.New("-deliver needs -delivery-spool")
+		}
+		if deliveries, err = multireq.NewDeliveries(c.deliverySpool, c.deliver, c.deliveryRetry, c.deliveryRetryMax, c.deliveryAttempts); err != nil {
+			return "", nil, fmt.Errorf("-deliver: %s", err)
+		}
+	}
+	pages, err := multireq.NewErrorPages(c.errorPages)
+	if err != nil {
+		return "", nil, fmt.Errorf("-error-page: %s", err)
+	}
+
+	sels, err := multireq.ParseSelectors(c.selectors)
+	if err != nil {
+		return "", nil, fmt.Errorf("-select: %s", err)
+	}
+	trusted, err := multireq.ParseTrusted(c.trusted)
+	if err != nil {
+		return "", nil, fmt.Errorf("-trust-overrides-from: %s", err)
+	}
+
+	var decisions *multireq.DecisionLog
+	if c.decisionsDir != "" && !c.dryRun {
+		if decisions, err = multireq.NewDecisionLog(c.decisionsDir); err != nil {
+			return "", nil, fmt.Errorf("-decision-log: %s", err)
+		}
+	}
+
+	var audit *multireq.AuditLog
+	if c.auditLog != "" {
+		scrub, err := multireq.NewScrubber(c.auditHeaders, c.auditFields, c.auditPatterns)
+		if err != nil {
+			return "", nil, fmt.Errorf("-audit-log: %s", err)
+		}
+		if audit, err = multireq.NewAuditLog(c.output(c.auditLog), c.auditSample, c.auditMaxBody, scrub); err != nil {
+			return "", nil, fmt.Errorf("-audit-log: %s", err)
+		}
+	}
+
+	strategy, err := multireq.NewStrategy(c.strategy)
+	if err != nil {
+		return "", nil, fmt.Errorf("-strategy: %s", err)
+	}
+
+	var fullRaces *multireq.FullRaces
+	if len(c.fullRace) > 0 || len(c.fullRaceHeaders) > 0 {
+		headers := map[string]string{}
+		for _, s := range c.fullRaceHeaders {
+			h, re, ok := strings.Cut(s, "=")
+			if !ok {
+				return "", nil, fmt.Errorf("-full-race-header: %q is not of the form <header>=<regexp>", s)
+			}
+			headers[h] = re
+		}
+		if fullRaces, err = multireq.NewFullRaces(c.fullRace, headers); err != nil {
+			return "", nil, fmt.Errorf("-full-race: %s", err)
+		}
+	}
+	var longPolls *multireq.LongPolls
+	if len(c.longPoll) > 0 {
+		if longPolls, err = multireq.NewLongPolls(c.longPoll); err != nil {
+			return "", nil, fmt.Errorf("-long-poll: %s", err)
+		}
+	}
+	var access *slog.Logger
+	if c.accessLog {
+		access = slog.Default()
+	}
+	p := multireq.New(ts,
+		multireq.WithMetrics(reg),
+		multireq.WithAccessLog(access),
+		multireq.WithStrategy(strategy),
+		multireq.WithQuorum(c.quorum),
+		multireq.WithPrimary(primary),
+		multireq.WithMirrorDiffs(diffs),
+		multireq.WithStaging(staging),
+		multireq.WithAdminToken(adminToken),
+		multireq.WithTargetOptions(added...),
+		multireq.WithDelays(delays),
+		multireq.WithTransforms(transforms),
+		multireq.WithNegotiation(negotiation),
+		multireq.WithHeadCache(c.headCacheSize),
+		multireq.WithNegativeCache(c.negativeCache, c.negativeCacheSize),
+		multireq.WithFamilies(c.familyTTL, c.familySize),
+		multireq.WithFullRaces(fullRaces),
+		multireq.WithLongPolls(longPolls),
+		multireq.WithDegrade(c.degradeAt, c.degradeFanout),
+		multireq.WithFairQueue(fair),
+		multireq.WithFallbacks(fb),
+		multireq.WithErrorPages(pages),
+		multireq.WithOutageBanner(c.banner),
+		multireq.WithRedundancyHeader(c.redundancy),
+		multireq.WithResume(c.resume),
+		multireq.WithReportTrailer(c.reportTrailer),
+		multireq.WithFlushInterval(c.flushInterval),
+		multireq.WithStatuses(accept, failOn),
+		multireq.WithBodyCheck(bodyCheck),
+		multireq.WithStripPrefix(c.stripPrefix),
+		multireq.WithXForwarded(c.xForwarded),
+		multireq.WithVia(c.via),
+		multireq.WithForwarded(c.forwarded),
+		multireq.WithBroadcastUpgrades(c.broadcastUpgrades),
+		multireq.WithDecisionLog(decisions),
+		multireq.WithAuditLog(audit),
+		multireq.WithBodyBuffer(c.bodyMemory, c.maxBody, c.spillDir),
+		multireq.WithTimeout(c.timeout),
+		multireq.WithAdaptiveTimeouts(adaptive),
+		multireq.WithHedgeDelay(c.hedge),
+		multireq.WithHedgePercentile(c.hedgePercentile),
+		multireq.WithLearnedHedging(c.hedgeLearn),
+		multireq.WithSignatures(sigs),
+		multireq.WithDeliveries(deliveries),
+		multireq.WithChecks(checks),
+		multireq.WithExperiment(e),
+		multireq.WithTrustedOverrides(trusted),
+		multireq.WithSelectors(sels),
+		multireq.WithAffinityHeader(c.affinity),
+		multireq.WithErrorBudget(c.budget, c.budgetWindow, c.budgetMin, c.budgetWebhook),
+		multireq.WithCircuitBreaker(c.breaker, c.breakerWindow, c.breakerMin, c.breakerOpen),
+	)
+	if err := p.Validate(); err != nil {
+		return "", nil, err
+	}
+	return listenAddr, p, nil
+}
+
+// output returns the file at path to write to, or in a dry run, a file that
+// takes writes without creating anything.
+func (c *serveConfig) output(path string) string {
+	if c.dryRun {
+		return os.DevNull
+	}
+	return path
+}
+
+// buildExperiment returns the experiment described by the flags, if any,
+// looking its variants' targets up in byName.
+func (c *serveConfig) buildExperiment(byName map[string]*multireq.Target) (*multireq.Experiment, error) {
+	if c.experiment == "" {
+		if len(c.variants) > 0 {
+			return nil, fmt.Errorf("-variant needs -experiment")
+		}
+		return nil, nil
+	}
+	e := multireq.NewExperiment(c.experiment, c.experimentKey)
+	for _, s := range c.variants {
+		name, weight, names, err := parseVariant(s)
+		if err != nil {
+			return nil, fmt.Errorf("-variant: %s", err)
+		}
+		var targets []*multireq.Target
+		for _, t := range names {
+			if byName[t] == nil {
+				return nil, fmt.Errorf("-variant: %s is not a target", t)
+			}
+			targets = append(targets, byName[t])
+		}
+		e.AddVariant(name, weight, targets)
+	}
+	if c.exposureLog != "" {
+		f, err := os.OpenFile(c.output(c.exposureLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("-exposure-log: %s", err)
+		}
+		e.LogExposures(f)
+	}
+	return e, nil
+}
+
+// parseVariant reads a variant given as <name>[:<weight>]=<target>,<target>...
+// returning its name, weight and targets as written.
+func parseVariant(s string) (string, int, []string, error) {
+	spec, list, ok := strings.Cut(s, "=")
+	if !ok || list == "" {
+		return "", 0, nil, fmt.Errorf("%q is not of the form <name>[:<weight>]=<target>,<target>...", s)
+	}
+	name, w, hasWeight := strings.Cut(spec, ":")
+	weight := 1
+	if hasWeight {
+		if _, err := fmt.Sscanf(w, "%d", &weight); err != nil || weight < 1 {
+			return "", 0, nil, fmt.Errorf("variant %s: weight must be a positive integer", name)
+		}
+	}
+	var targets []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return name, weight, targets, nil
+}
+
+// tlsOptions returns the TLS settings for target t. The -ca-bundle and
+// -insecure-skip-verify defaults apply only to https targets.
+func (c *serveConfig) tlsOptions(t string, https bool) ([]multireq.TargetOption, error) {
+	var opts []multireq.TargetOption
+	bundle, ok := c.targetCABundle[t]
+	if !ok && https {
+		bundle = c.caBundle
+	}
+	if bundle != "" {
+		pem, err := os.ReadFile(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("-ca-bundle: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-ca-bundle: no certificates in %s", bundle)
+		}
+		opts = append(opts, multireq.WithRootCAs(pool))
+	}
+	insecure := c.insecure && https
+	if s, ok := c.targetInsecure[t]; ok {
+		var err error
+		if insecure, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("-target-insecure-skip-verify: %s", err)
+		}
+	}
+	if insecure {
+		slog.Warn("not verifying the certificate of a target", "target", t)
+		opts = append(opts, multireq.WithInsecureSkipVerify(true))
+	}
+	if name, ok := c.targetSNI[t]; ok {
+		opts = append(opts, multireq.WithServerName(name))
+	}
+	if profile, ok := c.targetTLSProfile[t]; ok {
+		policy, err := multireq.NewTLSPolicy(profile, "", nil)
+		if err != nil {
+			return nil, fmt.Errorf("-target-tls-profile: %s", err)
+		}
+		opts = append(opts, multireq.WithTLSPolicy(policy))
+	} else if https {
+		opts = append(opts, multireq.WithTLSPolicy(c.tlsPolicy))
+	}
+	return opts, nil
+}
+
+// listenerTLS returns the TLS configuration to serve with, or nil to serve
+// plain HTTP.
+func (c *serveConfig) listenerTLS() (*tls.Config, error) {
+	if c.tlsCert == "" && c.tlsKey == "" {
+		return nil, nil
+	}
+	if c.tlsCert == "" || c.tlsKey == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := loadCertFile(c.tlsCert, c.tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("-tls-cert: %s", err)
+	}
+	conf := &tls.Config{GetCertificate: cert.get}
+	c.tlsPolicy.Apply(conf)
+	return conf, nil
+}
+
+// serveListener runs srv on ln, over TLS if srv has a TLS configuration,
+// until SIGINT, SIGTERM or stop being closed tells it to stop accepting
+// connections. It returns once the requests in flight are done, waiting at
+// most drain before cancelling those left.
+func serveListener(srv *http.Server, ln net.Listener, stop <-chan struct{}, drain time.Duration) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	drained := make(chan struct{})
+	go func() {
+		select {
+		case s := <-sig:
+			slog.Info("stopping; draining in-flight requests", "signal", s.String(), "drain_timeout", drain.String())
+		case <-stop:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		shut := make(chan error, 1)
+		go func() { shut <- srv.Shutdown(ctx) }()
+		// Closing the connections left cancels their requests, and the
+		// requests sent upstream for them.
+		select {
+		case err := <-shut:
+			if err != nil {
+				slog.Warn("requests still in flight after draining; cancelling them", "err", err)
+				srv.Close()
+			}
+		case s := <-sig:
+			slog.Warn("cancelling in-flight requests", "signal", s.String())
+			srv.Close()
+			<-shut
+		}
+		close(drained)
+	}()
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-drained
+	return nil
+}
+
+// setupLogging sends the log to stderr in the chosen format, from the
+// chosen level up.
+func (c *serveConfig) setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.logLevel)); err != nil {
+		return fmt.Errorf("-log-level: %s", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch c.logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("-log-format: %q is not text or json", c.logFormat)
+	}
+	return nil
+}
+
+// keepHeadCache loads the head cache of the current proxy from path, and
+// returns a func saving that of whichever is current there, for when serving
+// ends.
+func keepHeadCache(current func() *multireq.Proxy, path string) (save func(), err error) {
+	n, err := current().LoadHeadCache(path)
+	if err != nil {
+		return nil, fmt.Errorf("-head-cache-file: %s", err)
+	}
+	slog.Info("loaded cached HEAD responses", "responses", n, "file", path)
+	var once sync.Once
+	save = func() {
+		once.Do(func() {
+			if err := current().SaveHeadCache(path); err != nil {
+				slog.Error("saving the head cache", "err", err)
+			}
+		})
+	}
+	return save, nil
+}
+
+// serveAdmin serves the admin API with srv on ln until srv is shut down.
+func serveAdmin(srv *http.Server, ln net.Listener) {
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("admin server", "err", err)
+	}
+}
+
+func setupServe(fs *flag.FlagSet) func([]string) error {
+	var c serveConfig
+	c.register(fs)
+	return func(args []string) error {
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		c, args, err := c.load(args, set)
+		if err != nil {
+			return err
+		}
+		supervisor := c.workers > 1 && !isWorker()
+		// The workers serve, so the supervisor only checks the settings,
+		// as check does, without opening the files they name.
+		c.dryRun = supervisor
+		reg := &multireq.Registry{}
+		listenAddr, p, err := c.build(args, reg)
+		if err != nil {
+			return err
+		}
+		tlsConf, err := c.listenerTLS()
+		if err != nil {
+			return err
+		}
+
+		if supervisor {
+			if !reusePortSupported {
+				return fmt.Errorf("-workers: SO_REUSEPORT is not supported on this platform")
+			}
+			p.Close()
+			return supervise(c.workers, c.pidFile)
+		}
+
+		rl := &reloader{}
+		g := newGeneration(c, listenAddr, p, reg)
+		rl.cur.Store(g)
+		var admin *http.Server
+		var adminLn net.Listener
+		if c.adminAddr != "" {
+			if adminLn, err = listenAdmin(c.adminAddr); err != nil {
+				return fmt.Errorf("-admin: %s", err)
+			}
+			admin = &http.Server{Handler: rl.adminHandler(), ReadHeaderTimeout: readHeaderTimeout}
+			go serveAdmin(admin, adminLn)
+		}
+
+		ln, err := listen(listenAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{
+			Handler:           rl,
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			ConnContext:       rl.ConnContext,
+			ConnState:         rl.ConnState,
+			TLSConfig:         tlsConf,
+		}
+		defer func() {
+			if cn := rl.canary.Load(); cn != nil {
+				cn.g.p.Close()
+			}
+			rl.current().p.Close()
+		}()
+		if c.headCacheFile != "" && c.headCacheSize == 0 {
+			return errors.New("-head-cache-file needs -head-cache")
+		}
+		if c.headCacheFile != "" {
+			save, err := keepHeadCache(func() *multireq.Proxy { return rl.current().p }, c.headCacheFile)
+			if err != nil {
+				return err
+			}
+			defer save()
+		}
+		if err := g.start(nil); err != nil {
+			return err
+		}
+		if c.configFile != "" && len(reloadSignals) > 0 {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, reloadSignals...)
+			go func() {
+				for range hup {
+					rl.reload(c)
+				}
+			}()
+		}
+		// The replacement serves the admin API on the socket it
+		// inherited, and can't deliver queued events until we stop.
+		handoff := func() {
+			if admin != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), c.drainTimeout)
+				admin.Shutdown(ctx)
+				cancel()
+			}
+			rl.current().p.StopDeliveries()
+		}
+		return serve(srv, ln, adminLn, c.pidFile, c.drainTimeout, handoff)
+	}
+}
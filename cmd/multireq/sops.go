@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// sopsTimeout bounds a sops run, which may have to ask a KMS or Vault for
+// the file's key.
+const sopsTimeout = 30 * time.Second
+
+// sopsEncrypted reports whether b is a file sops encrypted whole, as it
+// does files in a format it doesn't know: a JSON object holding the
+// encrypted data and a sops member describing the keys it can be opened
+// with.
+func sopsEncrypted(b []byte) bool {
+	var f struct {
+		Data *string        `json:"data"`
+		Sops map[string]any `json:"sops"`
+	}
+	return json.Unmarshal(b, &f) == nil && f.Data != nil && f.Sops != nil
+}
+
+// sopsDecrypt runs sops to decrypt the file at path, returning what was
+// encrypted. sops finds the key itself, through age, gpg, a cloud KMS or
+// Vault, as it would on the command line, so multireq needs none of their
+// libraries.
+func sopsDecrypt(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sopsTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "sops", "--decrypt", "--input-type", "binary", "--output-type", "binary", path).Output()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && len(bytes.TrimSpace(ee.Stderr)) > 0 {
+		return nil, fmt.Errorf("%s: sops: %s", path, bytes.TrimSpace(ee.Stderr))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: decrypting with sops: %s", path, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func setupStatus(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		addr := args[0]
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		resp, err := http.Get(addr + "/metrics")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", addr, resp.Status)
+		}
+
+		// Sum and count series of the phase histogram, keyed by their
+		// labels.
+		sums := make(map[string]float64)
+		counts := make(map[string]float64)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			name, labels, value, ok := parseSample(sc.Text())
+			if !ok {
+				continue
+			}
+			switch name {
+			case "multireq_upstream_phase_seconds_sum":
+				sums[labels] = value
+			case "multireq_upstream_phase_seconds_count":
+				counts[labels] = value
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TARGET\tPHASE\tCOUNT\tMEAN")
+		for _, k := range keys {
+			l := parseLabels(k)
+			mean := 0.0
+			if counts[k] > 0 {
+				mean = sums[k] / counts[k] * 1000
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%.0f\t%.2fms\n", l["target"], l["phase"], counts[k], mean)
+		}
+		return tw.Flush()
+	}
+}
+
+// parseSample splits a line of the Prometheus text format into the metric
+// name, its raw label set and value.
+func parseSample(line string) (name, labels string, value float64, ok bool) {
+	if line == "" || line[0] == '#' {
+		return
+	}
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return
+	}
+	value, err := strconv.ParseFloat(line[i+1:], 64)
+	if err != nil {
+		return
+	}
+	name = line[:i]
+	if j := strings.IndexByte(name, '{'); j >= 0 {
+		name, labels = name[:j], name[j:]
+	}
+	return name, labels, value, true
+}
+
+// parseLabels reads a label set such as {a="1",b="2"}.
+func parseLabels(s string) map[string]string {
+	m := make(map[string]string)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	for s != "" {
+		name, rest, ok := strings.Cut(s, `="`)
+		if !ok {
+			break
+		}
+		var val strings.Builder
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+				if rest[i] == 'n' {
+					val.WriteByte('\n')
+					continue
+				}
+			}
+			val.WriteByte(rest[i])
+		}
+		m[name] = val.String()
+		s = strings.TrimPrefix(rest[min(i+1, len(rest)):], ",")
+	}
+	return m
+}
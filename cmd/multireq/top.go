@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whyrusleeping/multireq"
+)
+
+func setupTop(fs *flag.FlagSet) func([]string) error {
+	interval := fs.Duration("interval", time.Second, "how often to refresh")
+	errorLines := fs.Int("errors", 10, "number of recent errors to show")
+	return func(args []string) error {
+		if len(args) != 1 || *interval <= 0 {
+			return errUsage
+		}
+		base := args[0]
+		if !strings.Contains(base, "://") {
+			base = "http://" + base
+		}
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		fmt.Print("\x1b[?25l") // hide the cursor
+		defer fmt.Print("\x1b[?25h")
+
+		var prev map[string]float64
+		var prevAt time.Time
+		tick := time.NewTicker(*interval)
+		defer tick.Stop()
+		for {
+			cur, err := fetchSamples(base + "/metrics")
+			now := time.Now()
+			var b strings.Builder
+			fmt.Fprintf(&b, "multireq top - %s - %s (ctrl-c to quit)\n\n", base, now.Format("15:04:05"))
+			if err != nil {
+				fmt.Fprintf(&b, "error: %s\n", err)
+			} else {
+				renderTop(&b, cur, prev, now.Sub(prevAt))
+				renderErrors(&b, base+"/errors", *errorLines)
+				prev, prevAt = cur, now
+			}
+			// Redraw from the top left, clearing what was below.
+			fmt.Print("\x1b[H" + strings.ReplaceAll(b.String(), "\n", "\x1b[K\n") + "\x1b[J")
+
+			select {
+			case <-sig:
+				return nil
+			case <-tick.C:
+			}
+		}
+	}
+}
+
+// fetchSamples reads the metrics at url, keyed by name and raw label set.
+func fetchSamples(url string) (map[string]float64, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	m := make(map[string]float64)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if name, labels, v, ok := parseSample(sc.Text()); ok {
+			m[name+labels] = v
+		}
+	}
+	return m, sc.Err()
+}
+
+// renderTop writes current in-flight races and per-target rates, computed
+// from the change in counters since prev was fetched, elapsed ago.
+func renderTop(w io.Writer, cur, prev map[string]float64, elapsed time.Duration) {
+	rate := func(key string) float64 {
+		if prev == nil || elapsed <= 0 {
+			return 0
+		}
+		return (cur[key] - prev[key]) / elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "races in flight: %.0f   won/s: %.1f   failed/s: %.1f\n\n",
+		cur["multireq_races_in_flight"],
+		rate(`multireq_races_total{result="won"}`),
+		rate(`multireq_races_total{result="failed"}`))
+
+	outcomes := []string{"won", "lost", "failed"}
+	targets := make(map[string]bool)
+	const prefix = "multireq_upstream_outcomes_total"
+	for k := range cur {
+		if strings.HasPrefix(k, prefix+"{") {
+			targets[parseLabels(k[len(prefix):])["target"]] = true
+		}
+	}
+	names := make([]string, 0, len(targets))
+	for t := range targets {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "TARGET\t")
+	for _, o := range outcomes {
+		fmt.Fprintf(tw, "%s/s\t", strings.ToUpper(o))
+	}
+	fmt.Fprint(tw, "WIN%\t\n")
+	for _, t := range names {
+		fmt.Fprintf(tw, "%s\t", t)
+		total, won := 0.0, 0.0
+		for _, o := range outcomes {
+			key := fmt.Sprintf("%s{target=%q,outcome=%q}", prefix, t, o)
+			r := rate(key)
+			fmt.Fprintf(tw, "%.1f\t", r)
+			total += r
+			if o == "won" {
+				won = r
+			}
+		}
+		if total > 0 {
+			fmt.Fprintf(tw, "%.0f%%\t\n", won/total*100)
+		} else {
+			fmt.Fprint(tw, "-\t\n")
+		}
+	}
+	tw.Flush()
+}
+
+func renderErrors(w io.Writer, url string, n int) {
+	fmt.Fprint(w, "\nrecent errors:\n")
+	resp, err := http.Get(url)
+	if err != nil {
+		fmt.Fprintf(w, "  %s\n", err)
+		return
+	}
+	defer resp.Body.Close()
+	var entries []multireq.ErrorEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		fmt.Fprintf(w, "  %s\n", err)
+		return
+	}
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		fmt.Fprintf(w, "  %s  %s  %s  %s\n", e.Time.Local().Format("15:04:05"), e.Target, e.Code, e.Error)
+	}
+}
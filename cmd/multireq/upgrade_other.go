@@ -0,0 +1,40 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var upgradeSignals, reloadSignals []os.Signal
+
+func listen(addr string) (net.Listener, error) {
+	if isWorker() {
+		return listenReusePort(addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenAdmin(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func replacing() bool { return false }
+
+func serve(srv *http.Server, ln, admin net.Listener, pidFile string, drain time.Duration, handoff func()) error {
+	if isWorker() {
+		return serveListener(srv, ln, nil, drain)
+	}
+	if err := writePidFile(pidFile); err != nil {
+		return err
+	}
+	return serveListener(srv, ln, nil, drain)
+}
+
+func upgrade(pidFile string) error {
+	return errors.New("upgrades are only supported on unix")
+}
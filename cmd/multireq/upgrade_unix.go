@@ -0,0 +1,185 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A process started by an upgrade finds its listening sockets and a pipe
+// back to its parent at these descriptors.
+const (
+	listenFDEnv = "MULTIREQ_LISTEN_FD"
+	readyFDEnv  = "MULTIREQ_READY_FD"
+	adminFDEnv  = "MULTIREQ_ADMIN_FD"
+)
+
+// upgradeSignals ask a running multireq to replace itself.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals ask a running multireq to reload its config file.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// startTimeout bounds how long an upgrade waits for the new process.
+const startTimeout = time.Minute
+
+// listen returns the socket inherited from the process being replaced, or a
+// new one bound to addr.
+func listen(addr string) (net.Listener, error) {
+	if isWorker() {
+		return listenReusePort(addr)
+	}
+	return inherit(listenFDEnv, addr)
+}
+
+// listenAdmin returns the admin API's socket inherited from the process
+// being replaced, or a new one bound to addr.
+func listenAdmin(addr string) (net.Listener, error) {
+	return inherit(adminFDEnv, addr)
+}
+
+// inherit returns the socket at the descriptor named by the environment
+// variable env, or if it isn't set, a new one bound to addr.
+func inherit(env, addr string) (net.Listener, error) {
+	fd := os.Getenv(env)
+	if fd == "" {
+		return net.Listen("tcp", addr)
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %s", env, err)
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// replacing reports whether we were started by an upgrade, to replace a
+// process that is still serving.
+func replacing() bool {
+	return os.Getenv(listenFDEnv) != ""
+}
+
+// serve runs srv on ln until it is told to stop. On SIGUSR2 it starts a
+// fresh copy of the binary that inherits ln and admin, the admin API's
+// socket if there is one, and once the new process reports it is serving,
+// calls handoff, stops accepting connections and returns after the
+// in-flight ones are done, waiting at most drain.
+func serve(srv *http.Server, ln, admin net.Listener, pidFile string, drain time.Duration, handoff func()) error {
+	if isWorker() {
+		// The supervisor owns the pid file, and restarts rather than
+		// upgrades its workers.
+		return serveListener(srv, ln, nil, drain)
+	}
+	if err := writePidFile(pidFile); err != nil {
+		return err
+	}
+	signalReady()
+
+	replaced := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, upgradeSignals...)
+		for range sig {
+			if err := startReplacement(ln, admin); err != nil {
+				slog.Error("upgrade failed, still serving", "err", err)
+				continue
+			}
+			slog.Info("replacement is serving, draining")
+			handoff()
+			close(replaced)
+			return
+		}
+	}()
+	return serveListener(srv, ln, replaced, drain)
+}
+
+// startReplacement execs the current binary with the same arguments, handing
+// it ln and admin, if not nil, and waits until it is serving or has failed.
+func startReplacement(ln, admin net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	lf, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	env := append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, lf, w}
+	if admin != nil {
+		af, err := admin.(*net.TCPListener).File()
+		if err != nil {
+			w.Close()
+			return err
+		}
+		defer af.Close()
+		env = append(env, adminFDEnv+"=5")
+		files = append(files, af)
+	}
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+	w.Close()
+	if err != nil {
+		return err
+	}
+	go p.Wait()
+
+	// The child writes to the pipe once it serves, and the pipe closes
+	// empty if it dies first.
+	r.SetReadDeadline(time.Now().Add(startTimeout))
+	msg, _ := io.ReadAll(r)
+	if strings.TrimSpace(string(msg)) != "ready" {
+		p.Kill()
+		return fmt.Errorf("new process %d did not start serving", p.Pid)
+	}
+	return nil
+}
+
+// signalReady tells the process that started us, if any, that we have taken
+// over the listener.
+func signalReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	fmt.Fprintln(f, "ready")
+	f.Close()
+	os.Unsetenv(listenFDEnv)
+	os.Unsetenv(readyFDEnv)
+	os.Unsetenv(adminFDEnv)
+}
+
+// upgrade asks the multireq whose pid is in pidFile to replace itself with
+// the binary now installed at its path.
+func upgrade(pidFile string) error {
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("bad pid file %s: %s", pidFile, err)
+	}
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
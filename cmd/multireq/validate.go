@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// validator holds the rules every inbound request must pass before it is
+// fanned out to the targets. Each rule is given for every request, under
+// the empty prefix, or for the requests under a path prefix, and the rule
+// of the longest prefix a request's path has applies to it. A zero
+// validator accepts everything.
+type validator struct {
+	// prefixes are those any rule is given for, shortest first.
+	prefixes        []string
+	maxURLLength    map[string]int
+	methods         map[string]map[string]bool
+	requiredHeaders map[string][]string
+	contentTypes    map[string]map[string]bool
+}
+
+// newValidator returns the rules given by the flags of the same names.
+func newValidator(maxURLLength ruleFlag, methods, requiredHeaders, contentTypes ruleListFlag) (validator, error) {
+	v := validator{
+		maxURLLength:    make(map[string]int),
+		methods:         make(map[string]map[string]bool),
+		requiredHeaders: make(map[string][]string),
+		contentTypes:    make(map[string]map[string]bool),
+	}
+	for prefix, s := range maxURLLength {
+		n, err := strconv.Atoi(cmp.Or(s, "0"))
+		if err != nil || n < 0 {
+			return validator{}, fmt.Errorf("-max-url-length: %q is not a length", s)
+		}
+		v.maxURLLength[prefix] = n
+		v.prefixes = append(v.prefixes, prefix)
+	}
+	for prefix, l := range methods {
+		v.methods[prefix] = l.set(strings.ToUpper)
+		v.prefixes = append(v.prefixes, prefix)
+	}
+	for prefix, l := range requiredHeaders {
+		v.requiredHeaders[prefix] = l
+		v.prefixes = append(v.prefixes, prefix)
+	}
+	for prefix, l := range contentTypes {
+		v.contentTypes[prefix] = l.set(strings.ToLower)
+		v.prefixes = append(v.prefixes, prefix)
+	}
+	slices.SortFunc(v.prefixes, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+	v.prefixes = slices.Compact(v.prefixes)
+	return v, nil
+}
+
+type validationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (v *validator) check(r *http.Request) []validationError {
+	var (
+		maxURLLength int
+		methods      map[string]bool
+		headers      []string
+		contentTypes map[string]bool
+	)
+	// Shortest first, so the longest prefix's rule is the one kept.
+	for _, prefix := range v.prefixes {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			continue
+		}
+		if n, ok := v.maxURLLength[prefix]; ok {
+			maxURLLength = n
+		}
+		if m, ok := v.methods[prefix]; ok {
+			methods = m
+		}
+		if h, ok := v.requiredHeaders[prefix]; ok {
+			headers = h
+		}
+		if t, ok := v.contentTypes[prefix]; ok {
+			contentTypes = t
+		}
+	}
+
+	var errs []validationError
+	if maxURLLength > 0 && len(r.RequestURI) > maxURLLength {
+		errs = append(errs, validationError{
+			Field:   "url",
+			Message: fmt.Sprintf("url is %d bytes, limit is %d", len(r.RequestURI), maxURLLength),
+		})
+	}
+	if methods != nil && !methods[r.Method] {
+		errs = append(errs, validationError{
+			Field:   "method",
+			Message: fmt.Sprintf("method %s is not allowed", r.Method),
+		})
+	}
+	for _, h := range headers {
+		if r.Header.Get(h) == "" {
+			errs = append(errs, validationError{
+				Field:   "header." + http.CanonicalHeaderKey(h),
+				Message: "required header is missing",
+			})
+		}
+	}
+	if ct := r.Header.Get("Content-Type"); contentTypes != nil && (ct != "" || r.ContentLength > 0) {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || !contentTypes[strings.ToLower(mt)] {
+			errs = append(errs, validationError{
+				Field:   "header.Content-Type",
+				Message: fmt.Sprintf("content type %q is not allowed", ct),
+			})
+		}
+	}
+	return errs
+}
+
+// wrap rejects requests that fail validation with a 400 and a JSON list of
+// the rules they broke, and passes the rest on to h.
+func (v *validator) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs := v.check(r)
+		if len(errs) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct {
+			Errors []validationError `json:"errors"`
+		}{errs})
+	})
+}
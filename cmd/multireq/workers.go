@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// workerEnv is set in the environment of processes started by a supervisor.
+const workerEnv = "MULTIREQ_WORKER"
+
+// isWorker reports whether we were started by a supervisor.
+func isWorker() bool {
+	return os.Getenv(workerEnv) != ""
+}
+
+// crashBackoff is how long the supervisor waits before restarting a worker
+// that died soon after it was started, so a broken worker doesn't spin.
+const crashBackoff = time.Second
+
+// restartBackoffMax is the longest the supervisor waits between attempts to
+// start a worker that it failed to start, doubling the wait from
+// crashBackoff with each failure.
+const restartBackoffMax = time.Minute
+
+// supervise runs n copies of ourselves as workers sharing the listen socket,
+// restarting any that exit until we are asked to stop.
+func supervise(n int, pidFile string) error {
+	if err := writePidFile(pidFile); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	type exit struct {
+		slot    int
+		state   *os.ProcessState
+		err     error
+		started time.Time
+	}
+	exits := make(chan exit)
+	procs := make([]*os.Process, n)
+	start := func(slot int) error {
+		p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+			Env:   append(os.Environ(), workerEnv+"=1"),
+			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		})
+		if err != nil {
+			return err
+		}
+		procs[slot] = p
+		started := time.Now()
+		go func() {
+			st, err := p.Wait()
+			exits <- exit{slot, st, err, started}
+		}()
+		return nil
+	}
+
+	for i := range procs {
+		if err := start(i); err != nil {
+			return err
+		}
+	}
+	slog.Info("started workers", "workers", n)
+
+	// Workers are restarted rather than upgraded, so don't let a stray
+	// `multireq upgrade` kill the supervisor.
+	if len(upgradeSignals) > 0 {
+		signal.Ignore(upgradeSignals...)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	// Each worker reloads its own config.
+	reload := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(reload, reloadSignals...)
+	}
+	running := n
+	// A worker that couldn't be restarted is retried later through retry,
+	// waiting longer after each failure.
+	retry := make(chan int, n)
+	backoff := make([]time.Duration, n)
+	restart := func(slot int) {
+		if err := start(slot); err != nil {
+			backoff[slot] = min(max(2*backoff[slot], crashBackoff), restartBackoffMax)
+			slog.Error("restarting worker", "worker", slot, "err", err, "retry", backoff[slot])
+			time.AfterFunc(backoff[slot], func() { retry <- slot })
+			return
+		}
+		backoff[slot] = 0
+		running++
+	}
+	for {
+		select {
+		case s := <-reload:
+			for _, p := range procs {
+				if p != nil {
+					p.Signal(s)
+				}
+			}
+		case s := <-sig:
+			for _, p := range procs {
+				if p != nil {
+					p.Signal(s)
+				}
+			}
+			for ; running > 0; running-- {
+				<-exits
+			}
+			return nil
+		case e := <-exits:
+			running--
+			procs[e.slot] = nil
+			if e.err != nil {
+				slog.Error("worker failed", "worker", e.slot, "err", e.err)
+			} else {
+				slog.Warn("worker exited", "worker", e.slot, "state", e.state.String())
+			}
+			if time.Since(e.started) < crashBackoff {
+				// Wait without holding up the other workers or
+				// signals.
+				time.AfterFunc(crashBackoff, func() { retry <- e.slot })
+				continue
+			}
+			restart(e.slot)
+		case slot := <-retry:
+			restart(slot)
+		}
+	}
+}
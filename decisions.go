@@ -0,0 +1,139 @@
+package multireq
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Decision batches are closed after this many rows, or this long after they
+// were opened, whichever comes first.
+const (
+	decisionBatchRows = 10000
+	decisionBatchAge  = time.Minute
+)
+
+// decisionColumns heads every decision batch. There is one row per target
+// per race.
+var decisionColumns = []string{
+	"time", "race", "method", "host", "path", "raced",
+	"target", "outcome", "status", "dns_ms", "connect_ms", "tls_ms", "ttfb_ms",
+}
+
+// DecisionLog writes a record of every race decision to CSV batches in a
+// directory, for offline analysis of which targets win and when. A batch is
+// written as a .csv.tmp file and renamed to .csv once complete, so readers
+// only ever see whole batches.
+type DecisionLog struct {
+	dir     string
+	rows    chan []string
+	done    chan struct{}
+	dropped *metricVec
+}
+
+// NewDecisionLog returns a decision log writing batches to dir, which is
+// created if need be.
+func NewDecisionLog(dir string) (*DecisionLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &DecisionLog{dir: dir, rows: make(chan []string, 4096), done: make(chan struct{})}
+	go d.run()
+	return d, nil
+}
+
+// record logs the race rt decided for r. It never blocks: rows are dropped
+// if the writer falls behind.
+func (d *DecisionLog) record(r *http.Request, id string, rt *raceTrace) {
+	if d == nil {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	raced := strconv.Itoa(len(rt.targets))
+	for _, tt := range rt.targets {
+		outcome := tt.Outcome
+		if outcome == "pending" {
+			outcome = "lost"
+		}
+		row := []string{now, id, r.Method, r.Host, r.URL.Path, raced, tt.Target, outcome, "", "", "", "", ""}
+		if tt.Status != 0 {
+			row[8] = strconv.Itoa(tt.Status)
+		}
+		for i, phase := range []string{"dns", "connect", "tls", "ttfb"} {
+			if ms, ok := tt.Phases[phase]; ok {
+				row[9+i] = strconv.FormatFloat(ms, 'f', 3, 64)
+			}
+		}
+		select {
+		case d.rows <- row:
+		default:
+			d.dropped.inc()
+		}
+	}
+}
+
+// close writes out the current batch.
+func (d *DecisionLog) close() {
+	if d == nil {
+		return
+	}
+	close(d.rows)
+	<-d.done
+}
+
+func (d *DecisionLog) run() {
+	defer close(d.done)
+	var f *os.File
+	var w *csv.Writer
+	var n int
+	finish := func() {
+		if f == nil {
+			return
+		}
+		w.Flush()
+		err := w.Error()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), f.Name()[:len(f.Name())-len(".tmp")])
+		}
+		if err != nil {
+			slog.Error("writing the decision log", "err", err)
+		}
+		f, w, n = nil, nil, 0
+	}
+	tick := time.NewTicker(decisionBatchAge)
+	defer tick.Stop()
+	for {
+		select {
+		case row, ok := <-d.rows:
+			if !ok {
+				finish()
+				return
+			}
+			if f == nil {
+				name := fmt.Sprintf("decisions-%s-%d.csv.tmp", time.Now().UTC().Format("20060102T150405.000000"), os.Getpid())
+				var err error
+				if f, err = os.Create(filepath.Join(d.dir, name)); err != nil {
+					slog.Error("writing the decision log", "err", err)
+					f = nil
+					continue
+				}
+				w = csv.NewWriter(f)
+				w.Write(decisionColumns)
+			}
+			w.Write(row)
+			if n++; n == decisionBatchRows {
+				finish()
+			}
+		case <-tick.C:
+			finish()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package multireq
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// degrader races fewer targets per request while the proxy is overloaded.
+// It enters degraded mode when races in flight reach high and leaves once
+// they fall to half that, so it doesn't flap around the threshold.
+type degrader struct {
+	high   int64
+	fanout int
+
+	mu       sync.Mutex
+	degraded bool
+	gauge    *metricVec
+}
+
+// trim returns the targets to race with inFlight races running, which is all
+// of them unless degraded, in which case it is the fanout fastest.
+func (d *degrader) trim(targets []*Target, inFlight int64) []*Target {
+	d.mu.Lock()
+	switch {
+	case !d.degraded && inFlight >= d.high:
+		d.degraded = true
+		d.gauge.set(1)
+		slog.Warn("degraded: cutting fan-out", "in_flight", inFlight, "fanout", d.fanout)
+	case d.degraded && inFlight <= d.high/2:
+		d.degraded = false
+		d.gauge.set(0)
+		slog.Info("no longer degraded: restoring full fan-out", "in_flight", inFlight)
+	}
+	degraded := d.degraded
+	d.mu.Unlock()
+
+	if !degraded || len(targets) <= d.fanout {
+		return targets
+	}
+	return byLatency(targets)[:d.fanout]
+}
+
+// byLatency returns targets sorted fastest first by their moving average
+// latency.
+func byLatency(targets []*Target) []*Target {
+	ts := slices.Clone(targets)
+	slices.SortStableFunc(ts, func(a, b *Target) int {
+		return cmp.Compare(a.latency.Load(), b.latency.Load())
+	})
+	return ts
+}
+
+// observeLatency folds the time a target took to respond into its moving
+// average, its percentiles and its heatmap.
+func (t *Target) observeLatency(d time.Duration) {
+	now := time.Now()
+	t.latencies.observe(d, now)
+	t.heatmap.observe(d, now)
+	for {
+		old := t.latency.Load()
+		avg := int64(d)
+		if old != 0 {
+			avg = old + (int64(d)-old)/8
+		}
+		if t.latency.CompareAndSwap(old, avg) {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// errDelayed is why a response held back past the request's timeout is
+// never sent.
+var errDelayed = errors.New("timed out during an injected delay")
+
+// Delays hold back a share of winning responses before the client is sent
+// them, for a time drawn from a distribution. They are for testing: the
+// response still takes the real path through the proxy, only late, so a
+// client's timeouts and retries can be tried against it.
+type Delays struct {
+	percent float64
+	draw    func() time.Duration
+
+	injected *metricVec
+}
+
+// NewDelays delays percent of winning responses by a time drawn from the
+// distribution dist, one of:
+//
+//	500ms                  always 500ms
+//	uniform:100ms,2s       evenly between 100ms and 2s
+//	normal:300ms,100ms     normally around 300ms, with a deviation of 100ms
+//	exponential:200ms      exponentially, 200ms on average
+//
+// Draws below zero are no delay.
+func NewDelays(dist string, percent float64) (*Delays, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, errors.New("percentage must be over 0 and at most 100")
+	}
+	kind, params, ok := strings.Cut(dist, ":")
+	if !ok {
+		kind, params = "fixed", dist
+	}
+	var ds []time.Duration
+	for _, s := range strings.Split(params, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", dist, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("%q: negative duration", dist)
+		}
+		ds = append(ds, d)
+	}
+	want := map[string]int{"fixed": 1, "uniform": 2, "normal": 2, "exponential": 1}[kind]
+	if want == 0 {
+		return nil, fmt.Errorf("%q: unknown distribution %s", dist, kind)
+	}
+	if len(ds) != want {
+		return nil, fmt.Errorf("%q: %s takes %d durations", dist, kind, want)
+	}
+	d := &Delays{percent: percent}
+	switch kind {
+	case "fixed":
+		d.draw = func() time.Duration { return ds[0] }
+	case "uniform":
+		lo, hi := min(ds[0], ds[1]), max(ds[0], ds[1])
+		d.draw = func() time.Duration { return lo + rand.N(hi-lo+1) }
+	case "normal":
+		d.draw = func() time.Duration { return ds[0] + time.Duration(rand.NormFloat64()*float64(ds[1])) }
+	case "exponential":
+		d.draw = func() time.Duration { return time.Duration(rand.ExpFloat64() * float64(ds[0])) }
+	}
+	return d, nil
+}
+
+// WithDelays holds back winning responses as d says.
+func WithDelays(d *Delays) Option {
+	return func(p *Proxy) { p.delays = d }
+}
+
+// wait holds back a winning response, if it is picked for a delay. It
+// returns false if ctx is done first.
+func (d *Delays) wait(ctx context.Context) bool {
+	if d == nil || rand.Float64()*100 >= d.percent {
+		return true
+	}
+	delay := max(d.draw(), 0)
+	d.injected.observe(delay.Seconds())
+	if delay == 0 {
+		return true
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,642 @@
+package multireq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadDir is the subdirectory of a target's queue holding its dead
+// letters: events it was never delivered.
+const deadDir = "dead"
+
+// errRejected is a response no retry will change, a 4xx other than those
+// asking to be retried.
+var errRejected = errors.New("rejected")
+
+// ErrSpoolInUse is returned by StartDeliveries when another process is
+// delivering from the same spool.
+var ErrSpoolInUse = errors.New("the delivery spool is in use by another process")
+
+// Deliveries take requests under path prefixes, webhooks typically, off the
+// client's hands: each is answered with a 202 as soon as it is on disk, and
+// then delivered to every target, rather than raced, retrying each target
+// until it accepts it with a 2xx. An event a target keeps failing, or
+// rejects outright, becomes a dead letter, kept for inspection and
+// requeueing through the admin API.
+type Deliveries struct {
+	dir    string
+	routes []string
+
+	// Failed deliveries are retried after retry, doubling with each
+	// attempt up to retryMax, until attempts have been made.
+	retry, retryMax time.Duration
+	attempts        int
+
+	// mu guards running, queues and lock. Storing an event holds it for
+	// reading, so that none is stored once deliveries stop and another
+	// process may have taken the spool.
+	mu      sync.RWMutex
+	running bool
+	queues  []*deliveryQueue
+	lock    *os.File
+	stop    context.CancelFunc
+	done    sync.WaitGroup
+
+	delivered, depth, dead *metricVec
+}
+
+// NewDeliveries returns deliveries for requests under the prefixes routes,
+// spooled in dir, retried after retry and then twice as long each time up
+// to retryMax. An event is given up on after attempts tries, or never if
+// attempts is zero. Events already in dir, left by an earlier run, are
+// delivered once the proxy starts, which creates dir if need be.
+func NewDeliveries(dir string, routes []string, retry, retryMax time.Duration, attempts int) (*Deliveries, error) {
+	if retry <= 0 || retryMax < retry {
+		return nil, errors.New("retry delays must be positive, the longest no shorter than the first")
+	}
+	if attempts < 0 {
+		return nil, errors.New("negative number of attempts")
+	}
+	return &Deliveries{dir: dir, routes: routes, retry: retry, retryMax: retryMax, attempts: attempts}, nil
+}
+
+// WithDeliveries delivers the requests d takes to every target.
+func WithDeliveries(d *Deliveries) Option {
+	return func(p *Proxy) { p.deliveries = d }
+}
+
+// delivery is an event waiting in a target's queue, as kept on disk.
+type delivery struct {
+	ID       string      `json:"id"`
+	Received time.Time   `json:"received"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+
+	Attempts  int       `json:"attempts"`
+	Next      time.Time `json:"next"`
+	LastError string    `json:"last_error,omitempty"`
+
+	file string
+}
+
+// deliveryQueue holds one target's undelivered events, oldest first.
+type deliveryQueue struct {
+	t   *Target
+	dir string
+	d   *Deliveries
+
+	mu      sync.Mutex
+	pending []*delivery
+	wake    chan struct{}
+
+	// stop ends q's deliverer, which closes stopped as it returns.
+	stop    context.CancelFunc
+	stopped chan struct{}
+
+	// removed is set, with d.mu held, once q's target is no longer one.
+	removed bool
+}
+
+// StartDeliveries locks the spool, loads each target's queue of events from
+// disk and starts delivering them, if the proxy has deliveries. It must be
+// called before the proxy serves; until it is, requests for delivery get a
+// 503. Only one process may deliver from a spool at a time: if another
+// holds it, StartDeliveries returns ErrSpoolInUse.
+func (p *Proxy) StartDeliveries() error {
+	d := p.deliveries
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		return nil
+	}
+	if err := os.MkdirAll(d.dir, 0o700); err != nil {
+		return err
+	}
+	lock, err := lockSpool(d.dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", d.dir, err)
+	}
+	var queues []*deliveryQueue
+	known := make(map[string]bool)
+	for _, t := range p.Targets() {
+		q := &deliveryQueue{t: t, d: d, dir: filepath.Join(d.dir, url.QueryEscape(t.url.String())), wake: make(chan struct{}, 1)}
+		known[filepath.Base(q.dir)] = true
+		if err := os.MkdirAll(filepath.Join(q.dir, deadDir), 0o700); err != nil {
+			lock.Close()
+			return err
+		}
+		if err := q.load(); err != nil {
+			lock.Close()
+			return err
+		}
+		queues = append(queues, q)
+	}
+	if entries, err := os.ReadDir(d.dir); err == nil {
+		for _, e := range entries {
+			if e.IsDir() && !known[e.Name()] {
+				name, _ := url.QueryUnescape(e.Name())
+				slog.Warn("delivery spool holds events for a target that is no longer one; they will not be delivered", "dir", filepath.Join(d.dir, e.Name()), "target", name)
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.queues, d.lock, d.stop, d.running = queues, lock, cancel, true
+	for _, q := range d.queues {
+		qctx, stop := context.WithCancel(ctx)
+		q.stop, q.stopped = stop, make(chan struct{})
+		d.done.Add(1)
+		go func() {
+			defer d.done.Done()
+			defer close(q.stopped)
+			q.run(qctx)
+		}()
+	}
+	return nil
+}
+
+// StopDeliveries stops delivering queued events, which stay on disk, and
+// unlocks the spool for another process once no more will be stored or
+// delivered. Requests for delivery then get a 503. Close stops them too.
+func (p *Proxy) StopDeliveries() {
+	p.deliveries.close()
+}
+
+func (d *Deliveries) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.running {
+		return
+	}
+	d.stop()
+	d.done.Wait()
+	d.lock.Close()
+	d.running = false
+}
+
+// remove stops delivering to t, which is no longer a target, and buries
+// the events still queued for it. They can't be requeued while the proxy
+// runs, but are delivered to t again on restart if it is a target then.
+func (d *Deliveries) remove(t *Target) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.running {
+		return
+	}
+	for _, q := range d.queues {
+		if q.t != t || q.removed {
+			continue
+		}
+		q.removed = true
+		q.stop()
+		<-q.stopped
+		q.mu.Lock()
+		for _, ev := range slices.Clone(q.pending) {
+			ev.LastError = "the target was removed"
+			q.bury(ev)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// Delivers reports whether r would be taken for delivery rather than
+// raced.
+func (p *Proxy) Delivers(r *http.Request) bool {
+	return p.deliveries.takes(p.strip(r))
+}
+
+// takes reports whether r is for delivery rather than racing.
+func (d *Deliveries) takes(r *http.Request) bool {
+	if d == nil {
+		return false
+	}
+	for _, prefix := range d.routes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept queues r, with its buffered body, for every target, and answers
+// 202 once it is safely on disk, or 503 if it couldn't be stored.
+func (p *Proxy) accept(w http.ResponseWriter, r *http.Request, id string, body *buffered) {
+	defer body.close()
+	p.deliveries.mu.RLock()
+	defer p.deliveries.mu.RUnlock()
+	if !p.deliveries.running {
+		p.errorPages.write(w, r, http.StatusServiceUnavailable, errorBody{Error: "deliveries have not started"})
+		return
+	}
+	ev := &delivery{
+		ID:       id,
+		Received: time.Now().UTC(),
+		Method:   r.Method,
+		URL:      r.URL.RequestURI(),
+		Header:   r.Header.Clone(),
+	}
+	removeProxyHeaders(ev.Header)
+	if body != nil {
+		rd, _ := body.open()
+		var err error
+		if ev.Body, err = io.ReadAll(rd); err != nil {
+			p.errorPages.write(w, r, http.StatusServiceUnavailable, errorBody{Error: fmt.Sprintf("storing event: %s", err)})
+			return
+		}
+	}
+	var queues []*deliveryQueue
+	var stored []*delivery
+	for _, q := range p.deliveries.queues {
+		if q.removed {
+			continue
+		}
+		c, err := q.push(ev)
+		if err != nil {
+			slog.Error("storing event", "event", id, "target", q.t.String(), "err", err)
+			for i, c := range stored {
+				queues[i].drop(c)
+			}
+			p.errorPages.write(w, r, http.StatusServiceUnavailable, errorBody{Error: "event could not be stored"})
+			return
+		}
+		queues, stored = append(queues, q), append(stored, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		ID      string `json:"id"`
+		Targets int    `json:"targets"`
+	}{id, len(stored)})
+}
+
+// load reads the events left in q's directory.
+func (q *deliveryQueue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(q.dir, e.Name())
+		b, err := os.ReadFile(file)
+		ev := &delivery{file: file}
+		if err == nil {
+			err = json.Unmarshal(b, ev)
+		}
+		if err != nil {
+			slog.Warn("skipping unreadable event", "file", file, "err", err)
+			continue
+		}
+		q.pending = append(q.pending, ev)
+	}
+	// File names start with the time the event was received.
+	slices.SortFunc(q.pending, func(a, b *delivery) int { return strings.Compare(a.file, b.file) })
+	q.d.depth.set(float64(len(q.pending)), q.t.String())
+	dead, err := q.deadLetters()
+	if err != nil {
+		return err
+	}
+	q.d.dead.set(float64(len(dead)), q.t.String())
+	return nil
+}
+
+// push stores a copy of ev in q, wakes q's deliverer and returns the copy.
+func (q *deliveryQueue) push(ev *delivery) (*delivery, error) {
+	c := *ev
+	c.file = filepath.Join(q.dir, fmt.Sprintf("%d-%08x.json", ev.Received.UnixNano(), rand.Uint32()))
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	q.pending = append(q.pending, &c)
+	q.d.depth.set(float64(len(q.pending)), q.t.String())
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return &c, nil
+}
+
+// drop removes ev from q.
+func (q *deliveryQueue) drop(ev *delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i := slices.Index(q.pending, ev); i >= 0 {
+		q.pending = slices.Delete(q.pending, i, i+1)
+	}
+	os.Remove(ev.file)
+	q.d.depth.set(float64(len(q.pending)), q.t.String())
+}
+
+// save writes ev to its file, replacing it whole, and syncs it to disk.
+func (ev *delivery) save() error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	tmp := ev.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, ev.file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(ev.file)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// run delivers q's events as they come due, until ctx is done.
+func (q *deliveryQueue) run(ctx context.Context) {
+	for {
+		wait := q.d.retryMax
+		now := time.Now()
+		q.mu.Lock()
+		due := make([]*delivery, 0, len(q.pending))
+		for _, ev := range q.pending {
+			if !ev.Next.After(now) {
+				due = append(due, ev)
+			} else {
+				wait = min(wait, ev.Next.Sub(now))
+			}
+		}
+		q.mu.Unlock()
+
+		for _, ev := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			q.attempt(ctx, ev)
+		}
+		if len(due) > 0 {
+			// Delivering took time; look again at once.
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// attempt sends ev to q's target once, removing it from q if the target
+// accepts it, and otherwise scheduling the next attempt or, if there are to
+// be no more, burying it.
+func (q *deliveryQueue) attempt(ctx context.Context, ev *delivery) {
+	err := q.send(ctx, ev)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		q.d.delivered.inc(q.t.String(), "delivered")
+		q.drop(ev)
+		return
+	}
+	q.d.delivered.inc(q.t.String(), "failed")
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ev.Attempts++
+	ev.LastError = err.Error()
+	if errors.Is(err, errRejected) || q.d.attempts > 0 && ev.Attempts >= q.d.attempts {
+		q.bury(ev)
+		return
+	}
+	backoff := min(q.d.retry<<min(ev.Attempts-1, 20), q.d.retryMax)
+	// Jitter keeps a target that comes back from being hit by every
+	// retry at once.
+	ev.Next = time.Now().Add(backoff/2 + rand.N(backoff/2+1))
+	if err := ev.save(); err != nil {
+		slog.Error("saving event", "event", ev.ID, "target", q.t.String(), "err", err)
+	}
+	slog.Warn("delivering event failed", "event", ev.ID, "target", q.t.String(), "attempt", ev.Attempts, "err", err, "retry_in", time.Until(ev.Next).Round(time.Second).String())
+}
+
+// send delivers ev to q's target, which must answer with a 2xx.
+func (q *deliveryQueue) send(ctx context.Context, ev *delivery) error {
+	t := q.t
+	ctx, cancel := context.WithTimeout(ctx, max(t.headerTimeout, t.attemptTimeout, time.Minute))
+	defer cancel()
+	u, err := url.Parse(ev.URL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, ev.Method, t.join(u).String(), bytes.NewReader(ev.Body))
+	if err != nil {
+		return err
+	}
+	req.Header = ev.Header.Clone()
+	req.Header.Set("X-Multireq-Delivery-Id", ev.ID)
+	req.Header.Set("X-Multireq-Delivery-Attempt", strconv.Itoa(ev.Attempts+1))
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if err := t.prepare(ctx, req); err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch c := resp.StatusCode; {
+	case c >= 200 && c <= 299:
+		return nil
+	case c >= 400 && c <= 499 && c != http.StatusRequestTimeout && c != http.StatusTooEarly && c != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", errRejected, resp.Status)
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
+
+// bury moves ev from q to q's dead letters. q.mu must be held.
+func (q *deliveryQueue) bury(ev *delivery) {
+	old := ev.file
+	ev.file = filepath.Join(q.dir, deadDir, filepath.Base(old))
+	if err := ev.save(); err != nil {
+		slog.Error("burying event", "event", ev.ID, "target", q.t.String(), "err", err)
+		ev.file = old
+		return
+	}
+	os.Remove(old)
+	if i := slices.Index(q.pending, ev); i >= 0 {
+		q.pending = slices.Delete(q.pending, i, i+1)
+	}
+	q.d.depth.set(float64(len(q.pending)), q.t.String())
+	q.d.dead.add(1, q.t.String())
+	slog.Warn("gave up delivering event", "event", ev.ID, "target", q.t.String(), "attempts", ev.Attempts, "err", ev.LastError)
+}
+
+// deadLetters reads q's dead letters, oldest first.
+func (q *deliveryQueue) deadLetters() ([]*delivery, error) {
+	entries, err := os.ReadDir(filepath.Join(q.dir, deadDir))
+	if err != nil {
+		return nil, err
+	}
+	var dead []*delivery
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(q.dir, deadDir, e.Name())
+		b, err := os.ReadFile(file)
+		ev := &delivery{file: file}
+		if err == nil {
+			err = json.Unmarshal(b, ev)
+		}
+		if err == nil {
+			dead = append(dead, ev)
+		}
+	}
+	return dead, nil
+}
+
+// requeue moves the dead letter named name back into q, to be tried afresh.
+func (q *deliveryQueue) requeue(name string) error {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".json") {
+		return fmt.Errorf("no dead letter %q", name)
+	}
+	dead := filepath.Join(q.dir, deadDir, name)
+	b, err := os.ReadFile(dead)
+	if err != nil {
+		return err
+	}
+	ev := &delivery{file: filepath.Join(q.dir, name)}
+	if err := json.Unmarshal(b, ev); err != nil {
+		return err
+	}
+	ev.Attempts, ev.Next = 0, time.Time{}
+	if err := ev.save(); err != nil {
+		return err
+	}
+	os.Remove(dead)
+	q.mu.Lock()
+	q.pending = append(q.pending, ev)
+	q.d.depth.set(float64(len(q.pending)), q.t.String())
+	q.mu.Unlock()
+	q.d.dead.add(-1, q.t.String())
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deadLetter is a dead letter as listed by the admin API.
+type deadLetter struct {
+	Target    string    `json:"target"`
+	Name      string    `json:"name"`
+	ID        string    `json:"id"`
+	Received  time.Time `json:"received"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+}
+
+// serveDeadLetters lists every target's dead letters on GET, and on POST
+// requeues those the target and name form values pick: all of a target's
+// if name is left out, or every target's if both are. Those of removed
+// targets are listed but not requeued.
+func (p *Proxy) serveDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if p.deliveries == nil {
+		http.Error(w, "deliveries are not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodPost && !p.authorized(w, r) {
+		return
+	}
+	p.deliveries.mu.RLock()
+	defer p.deliveries.mu.RUnlock()
+	target, name := r.FormValue("target"), r.FormValue("name")
+	var list []deadLetter
+	requeued := 0
+	for _, q := range p.deliveries.queues {
+		if target != "" && target != q.t.String() || r.Method == http.MethodPost && q.removed {
+			continue
+		}
+		dead, err := q.deadLetters()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, ev := range dead {
+			base := filepath.Base(ev.file)
+			switch {
+			case r.Method == http.MethodGet:
+				list = append(list, deadLetter{q.t.String(), base, ev.ID, ev.Received, ev.Method, ev.URL, ev.Attempts, ev.LastError})
+			case name == "" || name == base:
+				if err := q.requeue(base); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				requeued++
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodGet {
+		if list == nil {
+			list = []deadLetter{}
+		}
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	if name != "" && requeued == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Requeued int `json:"requeued"`
+	}{requeued})
+}
@@ -0,0 +1,85 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNSCache resolves target hosts with a floor and a ceiling on how long an
+// answer is used. The standard resolver doesn't report TTLs, so every answer
+// is treated as expiring at once and held for minTTL, which keeps a flapping
+// record from changing the addresses on every connection. If re-resolving
+// fails, the last answer is used until it is maxTTL old.
+type DNSCache struct {
+	minTTL, maxTTL time.Duration
+	resolver       *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs    []net.IPAddr
+	resolved time.Time
+}
+
+// NewDNSCache returns a cache holding answers from minTTL to maxTTL.
+func NewDNSCache(minTTL, maxTTL time.Duration) *DNSCache {
+	return &DNSCache{
+		minTTL:   minTTL,
+		maxTTL:   maxTTL,
+		resolver: net.DefaultResolver,
+		entries:  make(map[string]dnsEntry),
+	}
+}
+
+func (c *DNSCache) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Sub(e.resolved) < c.minTTL {
+		return e.addrs, nil
+	}
+
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if ok && now.Sub(e.resolved) < c.maxTTL {
+			slog.Warn("resolving failed; using the addresses resolved before", "host", host, "err", err, "age", now.Sub(e.resolved).Round(time.Second).String())
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs, now}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// wrap returns a dial function that resolves hosts through the cache and
+// dials their addresses in turn with dial.
+func (c *DNSCache) wrap(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, a := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(a.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
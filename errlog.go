@@ -0,0 +1,51 @@
+package multireq
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errorLog is a fixed size ring of recent upstream failures.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []ErrorEntry
+	next    int
+	full    bool
+}
+
+// ErrorEntry is an upstream failure, as the admin API's /errors lists it.
+type ErrorEntry struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Code   string    `json:"code"`
+	Error  string    `json:"error"`
+}
+
+func newErrorLog(n int) *errorLog {
+	return &errorLog{entries: make([]ErrorEntry, n)}
+}
+
+func (l *errorLog) add(t *Target, f *failure) {
+	l.mu.Lock()
+	l.entries[l.next] = ErrorEntry{time.Now(), t.String(), f.code, f.err.Error()}
+	l.next = (l.next + 1) % len(l.entries)
+	l.full = l.full || l.next == 0
+	l.mu.Unlock()
+}
+
+// recent returns the logged failures, oldest first.
+func (l *errorLog) recent() []ErrorEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]ErrorEntry(nil), l.entries[:l.next]...)
+	}
+	return append(append([]ErrorEntry(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+func (l *errorLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.recent())
+}
@@ -0,0 +1,135 @@
+package multireq
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrorPages are HTML templates shown to browsers instead of the JSON error
+// body, by route, longest prefix first.
+type ErrorPages []errorPage
+
+type errorPage struct {
+	route string
+	tmpl  *template.Template
+}
+
+// errorBody describes a request multireq couldn't get an answer for. It is
+// sent as JSON, or is the data an error page template is executed with.
+type errorBody struct {
+	Error      string          `json:"error"`
+	Route      string          `json:"-"`
+	RequestID  string          `json:"request_id"`
+	Status     int             `json:"-"`
+	RetryAfter int             `json:"retry_after,omitempty"` // seconds
+	Targets    []targetFailure `json:"targets,omitempty"`
+}
+
+type targetFailure struct {
+	Target  string `json:"target"`
+	Code    string `json:"code"`
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message"`
+}
+
+// NewErrorPages parses the template files routes maps path prefixes to. A
+// page for / applies to every route without one of its own.
+func NewErrorPages(routes map[string]string) (ErrorPages, error) {
+	var pages ErrorPages
+	for route, file := range routes {
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, errorPage{route, tmpl})
+	}
+	slices.SortFunc(pages, func(a, b errorPage) int { return len(b.route) - len(a.route) })
+	return pages, nil
+}
+
+// write answers r with status and body: an error page if the client prefers
+// HTML and the route has one, otherwise JSON.
+func (pages ErrorPages) write(w http.ResponseWriter, r *http.Request, status int, body errorBody) {
+	body.Status = status
+	body.RequestID = requestID(r)
+	w.Header().Set("X-Request-Id", body.RequestID)
+	if body.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(body.RetryAfter))
+	}
+
+	if wantsHTML(r.Header.Get("Accept")) {
+		for _, page := range pages {
+			if !strings.HasPrefix(r.URL.Path, page.route) {
+				continue
+			}
+			body.Route = page.route
+			var buf bytes.Buffer
+			if err := page.tmpl.Execute(&buf, body); err != nil {
+				slog.Error("rendering the error page", "route", page.route, "err", err)
+				break
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			w.Write(buf.Bytes())
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// requestID returns the client's X-Request-Id, or a new one if it sent none.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// wantsHTML reports whether an Accept header ranks text/html above
+// application/json, as browsers' do and API clients' don't.
+func wantsHTML(accept string) bool {
+	return acceptQ(accept, "text/html") > acceptQ(accept, "application/json")
+}
+
+// acceptQ returns the quality an Accept header gives a media type, going by
+// its most specific matching range.
+func acceptQ(accept, mediaType string) float64 {
+	major, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch t {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+	}
+	return q
+}
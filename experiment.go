@@ -0,0 +1,111 @@
+package multireq
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Experiment splits clients deterministically between variants, each racing
+// its own group of targets, so their outcomes can be compared.
+type Experiment struct {
+	name string
+
+	// keyHeader names the header identifying a client. Without one,
+	// clients are told apart by IP.
+	keyHeader string
+
+	variants []*variant
+	total    int // sum of the variants' weights
+
+	// exposures, if set, gets a JSON line for every request assigned to a
+	// variant.
+	mu        sync.Mutex
+	exposures *os.File
+
+	races    *metricVec
+	duration *metricVec
+}
+
+type variant struct {
+	name    string
+	weight  int
+	targets []*Target
+}
+
+// NewExperiment returns an experiment named name, which tells clients apart
+// by keyHeader, or by IP if it is empty or missing from a request.
+func NewExperiment(name, keyHeader string) *Experiment {
+	return &Experiment{name: name, keyHeader: keyHeader}
+}
+
+// AddVariant adds a variant racing targets, which gets weight shares of the
+// clients.
+func (e *Experiment) AddVariant(name string, weight int, targets []*Target) {
+	e.variants = append(e.variants, &variant{name: name, weight: weight, targets: targets})
+	e.total += weight
+}
+
+// LogExposures writes a JSON line to f for every request assigned to a
+// variant.
+func (e *Experiment) LogExposures(f *os.File) {
+	e.exposures = f
+}
+
+// assign returns the variant for r's client, which is always the same for
+// the same client.
+func (e *Experiment) assign(r *http.Request) (*variant, string) {
+	key := r.Header.Get(e.keyHeader)
+	if e.keyHeader == "" || key == "" {
+		key, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(e.name + "\x00" + key))
+	sum := h.Sum64()
+	unit := fmt.Sprintf("%016x", sum)
+	n := int(sum % uint64(e.total))
+	for _, v := range e.variants {
+		if n < v.weight {
+			return v, unit
+		}
+		n -= v.weight
+	}
+	panic("unreachable")
+}
+
+// expose logs that r's client, identified by a hash of its key so the log
+// holds no client data, was exposed to v.
+func (e *Experiment) expose(r *http.Request, id string, v *variant, unit string) {
+	if e.exposures == nil {
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Time       time.Time `json:"time"`
+		Experiment string    `json:"experiment"`
+		Variant    string    `json:"variant"`
+		Unit       string    `json:"unit"`
+		Race       string    `json:"race"`
+		Method     string    `json:"method"`
+		Path       string    `json:"path"`
+	}{time.Now().UTC(), e.name, v.name, unit, id, r.Method, r.URL.Path})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.exposures.Write(append(b, '\n')); err != nil {
+		slog.Error("writing the exposure log", "err", err)
+	}
+}
+
+// done records how a race for variant v ended, since start.
+func (e *Experiment) done(v *variant, result string, start time.Time) {
+	if e == nil || v == nil {
+		return
+	}
+	e.races.inc(v.name, result)
+	e.duration.observe(time.Since(start).Seconds(), v.name, result)
+}
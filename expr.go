@@ -0,0 +1,308 @@
+package multireq
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// An expression selects targets by their labels, in the context of a
+// request. The grammar is
+//
+//	expr    = and { "||" and }
+//	and     = not { "&&" not }
+//	not     = "!" not | compare
+//	compare = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand = label | "name" | "url" | header( "<name>" ) | "<string>" | number | "(" expr ")"
+//
+// A label that the target doesn't have is the empty string. Comparisons
+// order runs of digits numerically, so "2.10" > "2.3" as versions would.
+// Where a condition is needed, a string is true unless it is empty.
+type expr interface {
+	eval(t *Target, r *http.Request) any
+}
+
+type (
+	literal   string
+	labelRef  string
+	headerRef string
+	notExpr   struct{ x expr }
+	binExpr   struct {
+		op   string
+		l, r expr
+	}
+)
+
+func (e literal) eval(*Target, *http.Request) any { return string(e) }
+
+func (e labelRef) eval(t *Target, _ *http.Request) any {
+	switch e {
+	case "name":
+		return t.String()
+	case "url":
+		return t.url.String()
+	}
+	return t.labels[string(e)]
+}
+
+func (e headerRef) eval(_ *Target, r *http.Request) any { return r.Header.Get(string(e)) }
+
+func (e notExpr) eval(t *Target, r *http.Request) any { return !truthy(e.x.eval(t, r)) }
+
+func (e binExpr) eval(t *Target, r *http.Request) any {
+	switch e.op {
+	case "&&":
+		return truthy(e.l.eval(t, r)) && truthy(e.r.eval(t, r))
+	case "||":
+		return truthy(e.l.eval(t, r)) || truthy(e.r.eval(t, r))
+	}
+	c := compareNatural(fmt.Sprint(e.l.eval(t, r)), fmt.Sprint(e.r.eval(t, r)))
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func truthy(v any) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return v != ""
+}
+
+// compareNatural compares strings, treating runs of digits as numbers.
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		da, db := digitRun(a), digitRun(b)
+		if da > 0 && db > 0 {
+			na := strings.TrimLeft(a[:da], "0")
+			nb := strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return cmpInt(len(na), len(nb))
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return cmpInt(int(a[0]), int(b[0]))
+		}
+		a, b = a[1:], b[1:]
+	}
+	return cmpInt(len(a), len(b))
+}
+
+func digitRun(s string) int {
+	n := 0
+	for n < len(s) && '0' <= s[n] && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// parseExpr parses an expression in the grammar above.
+func parseExpr(src string) (expr, error) {
+	p := &exprParser{src: src}
+	p.next()
+	e, err := p.or()
+	if err == nil && p.tok != "" {
+		err = p.errorf("unexpected %s", p.tok)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	src string
+	pos int    // of the byte after tok
+	at  int    // of tok
+	tok string // "" at the end
+	str bool   // tok is a string literal, unquoted
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at %d: %s", p.at, fmt.Sprintf(format, args...))
+}
+
+// next advances to the next token.
+func (p *exprParser) next() error {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	p.at, p.str = p.pos, false
+	rest := p.src[p.pos:]
+	switch {
+	case rest == "":
+		p.tok = ""
+		return nil
+	case rest[0] == '"':
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return p.errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return p.errorf("bad string %s", rest[:end+1])
+		}
+		p.tok, p.str = s, true
+		p.pos += end + 1
+		return nil
+	}
+	for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+		if strings.HasPrefix(rest, op) {
+			p.tok = op
+			p.pos += len(op)
+			return nil
+		}
+	}
+	n := 0
+	for n < len(rest) && (rest[n] == '_' || rest[n] == '.' || unicode.IsLetter(rune(rest[n])) || unicode.IsDigit(rune(rest[n]))) {
+		n++
+	}
+	if n == 0 {
+		return p.errorf("unexpected %q", rest[:1])
+	}
+	p.tok = rest[:n]
+	p.pos += n
+	return nil
+}
+
+// is reports whether the current token is the operator op.
+func (p *exprParser) is(op string) bool {
+	return !p.str && p.tok == op
+}
+
+func (p *exprParser) or() (expr, error) {
+	l, err := p.and()
+	for err == nil && p.is("||") {
+		if err = p.next(); err != nil {
+			break
+		}
+		var r expr
+		if r, err = p.and(); err == nil {
+			l = binExpr{"||", l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) and() (expr, error) {
+	l, err := p.not()
+	for err == nil && p.is("&&") {
+		if err = p.next(); err != nil {
+			break
+		}
+		var r expr
+		if r, err = p.not(); err == nil {
+			l = binExpr{"&&", l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) not() (expr, error) {
+	if p.is("!") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.not()
+		return notExpr{x}, err
+	}
+	return p.compare()
+}
+
+func (p *exprParser) compare() (expr, error) {
+	l, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<", "<=", ">", ">="} {
+		if p.is(op) {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			r, err := p.operand()
+			return binExpr{op, l, r}, err
+		}
+	}
+	return l, nil
+}
+
+func (p *exprParser) operand() (expr, error) {
+	tok, str := p.tok, p.str
+	switch {
+	case tok == "" && !str:
+		return nil, p.errorf("unexpected end of expression")
+	case str:
+		return literal(tok), p.next()
+	case tok == "(":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.is(")") {
+			return nil, p.errorf("missing )")
+		}
+		return e, p.next()
+	case '0' <= tok[0] && tok[0] <= '9':
+		return literal(tok), p.next()
+	case tok == "header":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if !p.is("(") {
+			return nil, p.errorf(`header must be called as header("<name>")`)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if !p.str {
+			return nil, p.errorf(`header must be called as header("<name>")`)
+		}
+		name := p.tok
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if !p.is(")") {
+			return nil, p.errorf("missing )")
+		}
+		return headerRef(name), p.next()
+	case validLabelKey(tok):
+		return labelRef(tok), p.next()
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
@@ -0,0 +1,124 @@
+package multireq
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// Failure codes say why an upstream attempt gave no usable response. They are
+// stable, and shared by logs, metric labels and the body of the response sent
+// when every target fails.
+const (
+	codePreflight   = "preflight_failure" // a step before sending, such as fetching a token
+	codeDial        = "dial_failure"      // resolving or connecting to the target
+	codeTLS         = "tls_failure"       // handshake or certificate verification
+	codeTimeout     = "timeout"           // a deadline passed
+	codeHeaders     = "header_timeout"    // no response headers within -header-timeout
+	codeBodyStall   = "body_stall"        // the winner's body stalled for -body-stall-timeout
+	codeConnection  = "connection_error"  // the connection broke before a response
+	codeBadStatus   = "bad_status"        // a response with a status we don't accept
+	codeStale       = "stale_response"    // a response older than the target allows
+	codeBadBody     = "bad_body"          // a response whose body the body check rejects
+	codeBody        = "body_error"        // the winner's body failed part way
+	codeNoQuorum    = "no_quorum"         // too few other targets returned the same response
+	codeClientAbort = "client_abort"      // the client went away
+)
+
+// failure is an upstream attempt that didn't produce a usable response.
+type failure struct {
+	code   string
+	status int // the response status, for bad_status and stale_response
+	err    error
+}
+
+func (f *failure) Error() string {
+	return f.code + ": " + f.err.Error()
+}
+
+// classify works out why a request made on behalf of the client whose
+// request context is ctx failed with err.
+func classify(ctx context.Context, err error) *failure {
+	var pre *failure
+	if errors.As(err, &pre) {
+		return pre
+	}
+	f := &failure{code: codeConnection, err: err}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	switch {
+	case ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded):
+		f.code = codeClientAbort
+	case errors.Is(err, errHeaderTimeout):
+		f.code = codeHeaders
+	case errors.Is(err, errAttemptTimeout):
+		f.code = codeTimeout
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+		f.code = codeTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		f.code = codeTimeout
+	case errors.As(err, &dnsErr), errors.As(err, &opErr) && opErr.Op == "dial":
+		f.code = codeDial
+	}
+	return f
+}
+
+func badStatus(status int) *failure {
+	return &failure{code: codeBadStatus, status: status, err: fmt.Errorf("status %d", status)}
+}
+
+// fail records that the attempt on t failed with f.
+func (p *Proxy) fail(t *Target, f *failure) {
+	// Unacceptable statuses are routine, and would drown out the rest.
+	if f.code != codeBadStatus {
+		slog.Warn("request failed", "target", t.String(), "code", f.code, "err", f.err)
+		p.errors.add(t, f)
+	}
+	p.metrics.errors.inc(t.String(), f.code)
+	if f.blames() {
+		p.settle(t, false)
+	}
+}
+
+// writeFailure answers a request none of whose targets gave a usable
+// response. If every target answered with the same status, that status is
+// passed on; otherwise it is a 504 when they all timed out and a 502 when
+// not. The body lists what went wrong with each target.
+func (p *Proxy) writeFailure(w http.ResponseWriter, r *http.Request, targets []*Target, failures []*failure) {
+	body := errorBody{Error: "no target returned an acceptable response"}
+	status := failures[0].status
+	timeouts := 0
+	for i, f := range failures {
+		if f.code == codeNoQuorum {
+			body.Error = "too few targets returned the same response"
+		}
+		body.Targets = append(body.Targets, targetFailure{targets[i].String(), f.code, f.status, f.err.Error()})
+		if f.code != codeBadStatus || f.status != status {
+			status = 0
+		}
+		if f.code == codeTimeout {
+			timeouts++
+		}
+	}
+	switch {
+	case status != 0:
+	case timeouts == len(failures):
+		status = http.StatusGatewayTimeout
+	default:
+		status = http.StatusBadGateway
+	}
+	p.errorPages.write(w, r, status, body)
+}
@@ -0,0 +1,181 @@
+package multireq
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FairQueue caps the races the proxy runs at once. Requests beyond the cap
+// wait their turn, taken fairly across tenants rather than first come, first
+// served: each tenant gets a share of the capacity in proportion to its
+// weight, so one sending a flood of requests only delays its own.
+type FairQueue struct {
+	limit   int
+	header  string
+	weights map[string]float64
+	wait    time.Duration
+
+	mu      sync.Mutex
+	running int
+	waiting waiters
+
+	// Turns are taken by start-time fair queuing: a waiting request's start
+	// tag is the later of the virtual time and its tenant's last finish
+	// tag, and its finish tag adds one over the tenant's weight. The request
+	// with the lowest start tag goes next, and the virtual time becomes its
+	// start tag.
+	vtime  float64
+	finish map[string]float64
+	seq    uint64
+
+	queued, timeouts *metricVec
+}
+
+// NewFairQueue runs no more than limit races at once. A request's tenant is
+// the value of header, or if that is missing, the client's IP address.
+// weights gives tenants other than the default weight of 1, and wait is how
+// long a request may wait for its turn before it is turned away.
+func NewFairQueue(limit int, header string, weights map[string]string, wait time.Duration) (*FairQueue, error) {
+	if limit < 1 {
+		return nil, errors.New("limit must be at least 1")
+	}
+	q := &FairQueue{limit: limit, header: http.CanonicalHeaderKey(header), weights: map[string]float64{}, wait: wait, finish: map[string]float64{}}
+	for tenant, v := range weights {
+		w, err := strconv.ParseFloat(v, 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("weight of %s: %q is not a positive number", tenant, v)
+		}
+		q.weights[tenant] = w
+	}
+	return q, nil
+}
+
+// WithFairQueue caps the races the proxy runs at once, queueing the rest
+// fairly across tenants with q.
+func WithFairQueue(q *FairQueue) Option {
+	return func(p *Proxy) { p.fair = q }
+}
+
+type waiter struct {
+	start float64
+	seq   uint64
+	ready chan struct{}
+	index int // in the heap, or -1 once given its turn
+}
+
+// waiters is a heap of waiting requests by start tag, and by arrival
+// between equal ones.
+type waiters []*waiter
+
+func (ws waiters) Len() int { return len(ws) }
+func (ws waiters) Less(i, j int) bool {
+	if ws[i].start != ws[j].start {
+		return ws[i].start < ws[j].start
+	}
+	return ws[i].seq < ws[j].seq
+}
+func (ws waiters) Swap(i, j int) {
+	ws[i], ws[j] = ws[j], ws[i]
+	ws[i].index, ws[j].index = i, j
+}
+func (ws *waiters) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*ws)
+	*ws = append(*ws, w)
+}
+func (ws *waiters) Pop() any {
+	old := *ws
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*ws = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+func (q *FairQueue) tenant(r *http.Request) string {
+	if q.header != "" {
+		if v := r.Header.Get(q.header); v != "" {
+			return v
+		}
+	}
+	return clientIP(r)
+}
+
+// acquire waits for r's turn to race, and reports whether it came before
+// ctx was done or the queue's wait was up. If it did, release must be
+// called once the race is over.
+func (q *FairQueue) acquire(ctx context.Context, r *http.Request) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return true
+	}
+	tenant := q.tenant(r)
+	weight, ok := q.weights[tenant]
+	if !ok {
+		weight = 1
+	}
+	w := &waiter{start: max(q.vtime, q.finish[tenant]), seq: q.seq, ready: make(chan struct{})}
+	q.seq++
+	q.finish[tenant] = w.start + 1/weight
+	heap.Push(&q.waiting, w)
+	q.queued.set(float64(len(q.waiting)))
+	q.mu.Unlock()
+
+	timer := time.NewTimer(q.wait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-ctx.Done():
+	case <-timer.C:
+		q.timeouts.inc()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.index < 0 {
+		// Its turn came just as it gave up; pass it on.
+		q.next()
+		return false
+	}
+	heap.Remove(&q.waiting, w.index)
+	q.queued.set(float64(len(q.waiting)))
+	return false
+}
+
+// release ends a race, giving its place to the next request in line.
+func (q *FairQueue) release() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next()
+}
+
+// next hands a running race's place to the request whose turn is next, or
+// frees it if none is waiting. q.mu must be held.
+func (q *FairQueue) next() {
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+	w := heap.Pop(&q.waiting).(*waiter)
+	q.vtime = w.start
+	if len(q.waiting) == 0 {
+		// With no one waiting, past shares no longer matter.
+		clear(q.finish)
+	}
+	q.queued.set(float64(len(q.waiting)))
+	close(w.ready)
+}
@@ -0,0 +1,63 @@
+package multireq
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Fallbacks serve local files for routes none of whose targets could answer,
+// longest prefix first.
+type Fallbacks []fallback
+
+type fallback struct {
+	prefix string
+	h      http.Handler
+}
+
+// NewFallbacks builds fallbacks from path prefixes to local paths. A directory
+// is served as the tree under its prefix; a file is served for every path
+// under it, as an SPA shell or status page would be.
+func NewFallbacks(routes map[string]string) (Fallbacks, error) {
+	var fb Fallbacks
+	for prefix, path := range routes {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		var h http.Handler
+		if fi.IsDir() {
+			h = http.StripPrefix(strings.TrimSuffix(prefix, "/"), http.FileServer(http.Dir(path)))
+		} else {
+			path, err = filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
+			h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.ServeFile(w, r, path)
+			})
+		}
+		fb = append(fb, fallback{prefix, h})
+	}
+	slices.SortFunc(fb, func(a, b fallback) int { return len(b.prefix) - len(a.prefix) })
+	return fb, nil
+}
+
+// serve answers r from the fallback for its route, if it has one and is a
+// GET or HEAD.
+func (fb Fallbacks) serve(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, f := range fb {
+		if strings.HasPrefix(r.URL.Path, f.prefix) {
+			slog.Info("no target answered; serving the fallback", "path", r.URL.Path, "route", f.prefix)
+			f.h.ServeHTTP(w, r)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package multireq
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// familyHeader tags related requests, such as the steps of an upload, that
+// should all be answered by the same target.
+const familyHeader = "X-Multireq-Family"
+
+// families remembers which target won each family's last race, so that the
+// family's next request goes to it first.
+type families struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]familyEntry
+}
+
+type familyEntry struct {
+	t       *Target
+	expires time.Time
+}
+
+// WithFamilies sends each request tagged with an X-Multireq-Family header
+// to the target that won the last race of a request with the same tag, if
+// there was one within ttl, racing the others only if it fails. The target
+// that answers then stands for the family from then on. Up to n families
+// are remembered.
+func WithFamilies(ttl time.Duration, n int) Option {
+	return func(p *Proxy) {
+		p.families = nil
+		if ttl > 0 && n > 0 {
+			p.families = &families{ttl: ttl, max: n, entries: make(map[string]familyEntry)}
+		}
+	}
+}
+
+// order moves the target standing for r's family to the front of targets.
+// It reports whether it did: if so, only that target is raced to begin
+// with.
+func (f *families) order(r *http.Request, targets []*Target) ([]*Target, bool) {
+	if f == nil || len(targets) < 2 {
+		return targets, false
+	}
+	id := r.Header.Get(familyHeader)
+	if id == "" {
+		return targets, false
+	}
+	f.mu.Lock()
+	e, ok := f.entries[id]
+	f.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		return targets, false
+	}
+	i := slices.Index(targets, e.t)
+	if i < 0 {
+		return targets, false
+	}
+	ts := make([]*Target, 0, len(targets))
+	ts = append(ts, e.t)
+	ts = append(ts, targets[:i]...)
+	ts = append(ts, targets[i+1:]...)
+	return ts, true
+}
+
+// remember makes t, which won the race for r, stand for r's family for
+// another ttl.
+func (f *families) remember(r *http.Request, t *Target) {
+	if f == nil {
+		return
+	}
+	id := r.Header.Get(familyHeader)
+	if id == "" {
+		return
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.entries[id]; !ok && len(f.entries) >= f.max {
+		for id, e := range f.entries {
+			if now.After(e.expires) {
+				delete(f.entries, id)
+			}
+		}
+		if len(f.entries) >= f.max {
+			return
+		}
+	}
+	f.entries[id] = familyEntry{t: t, expires: now.Add(f.ttl)}
+}
@@ -0,0 +1,92 @@
+package multireq
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is the longest a winning response's body waits in
+// the server's write buffer before being flushed to the client.
+const DefaultFlushInterval = 100 * time.Millisecond
+
+// WithFlushInterval flushes what has been written of a winning response to
+// the client at most d after each write, so that a body streaming in slowly
+// reaches the client as it arrives rather than once a buffer fills. A
+// negative d flushes after every write, and zero leaves it to the buffer.
+// Event streams are always flushed after every write.
+func WithFlushInterval(d time.Duration) Option {
+	return func(p *Proxy) { p.flushInterval = d }
+}
+
+// flushDelay returns how long the body of resp may wait to be flushed.
+func (p *Proxy) flushDelay(resp *http.Response) time.Duration {
+	if mediaType(resp) == "text/event-stream" {
+		return -1
+	}
+	return p.flushInterval
+}
+
+// flushWriter flushes what is written through it to the client at most d
+// later, or at once if d is negative.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+	d  time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+// newFlushWriter returns a writer flushing to w after d. Written at once,
+// the response headers are flushed too, so an event stream's client knows
+// it is open before the first event.
+func newFlushWriter(w http.ResponseWriter, d time.Duration) *flushWriter {
+	f := &flushWriter{w: w, rc: http.NewResponseController(w), d: d}
+	if d < 0 {
+		f.rc.Flush()
+	}
+	return f
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(b)
+	switch {
+	case f.d < 0:
+		f.rc.Flush()
+	case f.pending:
+	case f.timer == nil:
+		f.pending = true
+		f.timer = time.AfterFunc(f.d, f.flush)
+	default:
+		f.pending = true
+		f.timer.Reset(f.d)
+	}
+	return n, err
+}
+
+func (f *flushWriter) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending {
+		f.pending = false
+		f.rc.Flush()
+	}
+}
+
+// stop ends flushing, so that nothing is flushed once the handler returns.
+func (f *flushWriter) stop() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = false
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
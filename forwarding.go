@@ -0,0 +1,117 @@
+package multireq
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// via is how multireq names itself in Via headers.
+const via = "multireq"
+
+// hopHeaders are meant for one connection only, and aren't passed on in
+// either direction (RFC 7230, section 6.1), as aren't those a message's
+// Connection header lists.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// WithXForwarded tells targets who each request came from with
+// X-Forwarded-For, which the client's address is appended to, and the host
+// and scheme it asked for with X-Forwarded-Host and X-Forwarded-Proto. It
+// is on by default.
+func WithXForwarded(on bool) Option {
+	return func(p *Proxy) { p.xForwarded = on }
+}
+
+// WithVia appends multireq to the Via header of requests and responses it
+// passes on. It is on by default.
+func WithVia(on bool) Option {
+	return func(p *Proxy) { p.via = on }
+}
+
+// WithForwarded tells targets who each request came from, and the host and
+// scheme it asked for, in a Forwarded header (RFC 7239), which the request's
+// hop is appended to.
+func WithForwarded(on bool) Option {
+	return func(p *Proxy) { p.forwarded = on }
+}
+
+// forward returns r with the forwarding headers p adds to the requests it
+// sends, or r itself if it adds none. Like p.strip, it doesn't change r.
+func (p *Proxy) forward(r *http.Request) *http.Request {
+	if !p.xForwarded && !p.via && !p.forwarded {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	h := r2.Header
+	ip, proto := clientIP(r), "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if p.xForwarded {
+		if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+			h.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip)
+		} else {
+			h.Set("X-Forwarded-For", ip)
+		}
+		h.Set("X-Forwarded-Host", r.Host)
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if p.forwarded {
+		node := ip
+		if strings.Contains(ip, ":") {
+			node = strconv.Quote("[" + ip + "]")
+		} else if net.ParseIP(ip) == nil {
+			node = "unknown"
+		}
+		h.Add("Forwarded", "for="+node+";host="+strconv.Quote(r.Host)+";proto="+proto)
+	}
+	if p.via {
+		h.Add("Via", viaEntry(r.ProtoMajor, r.ProtoMinor))
+	}
+	return r2
+}
+
+// forwardResponse removes resp's hop-by-hop headers before it is passed on,
+// and appends multireq to its Via header.
+func (p *Proxy) forwardResponse(resp *http.Response) {
+	removeHopHeaders(resp.Header)
+	if p.via {
+		resp.Header.Add("Via", viaEntry(resp.ProtoMajor, resp.ProtoMinor))
+	}
+}
+
+// viaEntry is multireq's entry in the Via header of a message received
+// over HTTP major.minor.
+func viaEntry(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major) + " " + via
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor) + " " + via
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,28 @@
+package multireq
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// responseAge estimates how long ago the response with header h was
+// generated by its origin, from the larger of its Age header and the time
+// since its Date.
+func responseAge(h http.Header, now time.Time) time.Duration {
+	var age time.Duration
+	if secs, err := strconv.Atoi(h.Get("Age")); err == nil && secs > 0 {
+		age = time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		if d := now.Sub(date); d > age {
+			age = d
+		}
+	}
+	return age
+}
+
+// tooOld reports whether resp from t is older than t allows.
+func (t *Target) tooOld(resp *http.Response) bool {
+	return t.maxAge > 0 && responseAge(resp.Header, time.Now()) > t.maxAge
+}
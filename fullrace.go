@@ -0,0 +1,69 @@
+package multireq
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// FullRaces pick out requests that are exempt from the proxy's
+// optimizations: they are never answered from or stored in a cache, and
+// are raced against every candidate at once whatever the strategy,
+// affinity, hedging or degraded mode would do. Safety measures still apply:
+// targets that are backing off, paced, evicted or whose circuit is open
+// are left out as usual.
+type FullRaces struct {
+	prefixes []string
+	headers  map[string]*regexp.Regexp
+
+	matched *metricVec
+}
+
+// NewFullRaces exempts requests whose path starts with any of prefixes,
+// and those carrying any of the headers with a value matching its regular
+// expression in full.
+func NewFullRaces(prefixes []string, headers map[string]string) (*FullRaces, error) {
+	f := &FullRaces{prefixes: prefixes, headers: make(map[string]*regexp.Regexp)}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%q is not a path prefix", prefix)
+		}
+	}
+	for h, re := range headers {
+		c, err := regexp.Compile("^(?:" + re + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %s", h, err)
+		}
+		f.headers[http.CanonicalHeaderKey(h)] = c
+	}
+	return f, nil
+}
+
+// WithFullRaces exempts the requests f picks out from the proxy's
+// optimizations.
+func WithFullRaces(f *FullRaces) Option {
+	return func(p *Proxy) { p.fullRaces = f }
+}
+
+// match reports whether r is exempt.
+func (f *FullRaces) match(r *http.Request) bool {
+	if f == nil {
+		return false
+	}
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			f.matched.inc()
+			return true
+		}
+	}
+	for h, re := range f.headers {
+		for _, v := range r.Header.Values(h) {
+			if re.MatchString(v) {
+				f.matched.inc()
+				return true
+			}
+		}
+	}
+	return false
+}
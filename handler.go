@@ -0,0 +1,40 @@
+// Package multireq races each HTTP request across several targets and
+// answers with the first acceptable response. The multireq command in
+// cmd/multireq serves it from the command line; NewHandler mounts the same
+// proxy in another program.
+package multireq
+
+import "net/url"
+
+// NewHandler returns a proxy that races every request across targets, each
+// with its own connection pool and the defaults of NewTarget, as
+// configured by opts.
+func NewHandler(targets []*url.URL, opts ...Option) (*Proxy, error) {
+	ts := make([]*Target, len(targets))
+	for i, u := range targets {
+		ts[i] = NewTarget(u)
+	}
+	p := New(ts, opts...)
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Targets returns the targets requests are raced across.
+func (p *Proxy) Targets() []*Target {
+	return *p.targets.Load()
+}
+
+// Close writes out what the proxy's decision log has buffered, closes its
+// audit log, stops delivering queued events, which stay on disk for the
+// next run, and cancels the copies still being sent to staging. The proxy
+// must not serve requests after it is closed.
+func (p *Proxy) Close() {
+	p.decisions.close()
+	p.audit.close()
+	p.deliveries.close()
+	p.checks.close()
+	p.diffs.close()
+	p.staging.close()
+}
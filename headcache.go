@@ -0,0 +1,264 @@
+package multireq
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headCache remembers the status and headers of recent GET responses so that
+// HEAD requests for the same resource can be answered without a race.
+type headCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*headEntry
+}
+
+type headEntry struct {
+	status  int
+	header  http.Header
+	stored  time.Time
+	expires time.Time
+}
+
+func newHeadCache(max int) *headCache {
+	return &headCache{max: max, entries: make(map[string]*headEntry)}
+}
+
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// store records resp as the metadata for the GET request r, provided the
+// response says it may be cached and for how long. A response to a request
+// with credentials is only stored if it says a shared cache may keep it
+// (RFC 9111, section 3.5).
+func (c *headCache) store(r *http.Request, resp *http.Response) {
+	if r.Header.Get("Authorization") != "" && !sharedWithAuthorization(resp.Header) {
+		return
+	}
+	now := time.Now()
+	ttl, ok := freshness(resp.Header, now)
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+	if !ok || ttl <= 0 || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.max {
+			return
+		}
+	}
+	c.entries[cacheKey(r)] = &headEntry{
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+// savedHead is a head cache entry as SaveHeadCache writes it.
+type savedHead struct {
+	Key     string      `json:"key"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// SaveHeadCache writes the head cache's fresh entries to path as JSON, so
+// that a process started after this one can answer HEAD requests from them
+// rather than racing them all again. The file is replaced whole, never left
+// half written.
+func (p *Proxy) SaveHeadCache(path string) error {
+	c := p.heads
+	if c == nil {
+		return nil
+	}
+	now := time.Now()
+	var saved []savedHead
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if now.Before(e.expires) {
+			saved = append(saved, savedHead{k, e.status, e.header, e.stored, e.expires})
+		}
+	}
+	c.mu.Unlock()
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".head-cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadHeadCache fills the head cache with the entries SaveHeadCache wrote
+// to path that are still fresh, up to its size, and returns how many it
+// loaded. A missing file loads nothing.
+func (p *Proxy) LoadHeadCache(path string) (int, error) {
+	c := p.heads
+	if c == nil {
+		return 0, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var saved []savedHead
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	n := 0
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range saved {
+		if len(c.entries) >= c.max {
+			break
+		}
+		if now.Before(s.Expires) && c.entries[s.Key] == nil {
+			c.entries[s.Key] = &headEntry{status: s.Status, header: s.Header, stored: s.Stored, expires: s.Expires}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CopyHeadCache fills the head cache with the fresh entries of from's, up
+// to its size, and returns how many it copied: a proxy taking over from
+// another in the same process, as on a config reload, needn't race them
+// all again.
+func (p *Proxy) CopyHeadCache(from *Proxy) int {
+	c, fc := p.heads, from.heads
+	if c == nil || fc == nil || c == fc {
+		return 0
+	}
+	now := time.Now()
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range fc.entries {
+		if len(c.entries) >= c.max {
+			break
+		}
+		if now.Before(e.expires) && c.entries[k] == nil {
+			c.entries[k] = &headEntry{status: e.status, header: e.header.Clone(), stored: e.stored, expires: e.expires}
+			n++
+		}
+	}
+	return n
+}
+
+// serve answers the HEAD request r from the cache and reports whether it did.
+func (c *headCache) serve(w http.ResponseWriter, r *http.Request) bool {
+	key := cacheKey(r)
+	now := time.Now()
+
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil && now.After(e.expires) {
+		delete(c.entries, key)
+		e = nil
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return false
+	}
+
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	age := int(now.Sub(e.stored) / time.Second)
+	if s, err := strconv.Atoi(e.header.Get("Age")); err == nil {
+		age += s
+	}
+	w.Header().Set("Age", strconv.Itoa(age))
+	w.WriteHeader(e.status)
+	return true
+}
+
+// sharedWithAuthorization reports whether a response with header h to a
+// request carrying Authorization may be stored by a shared cache.
+func sharedWithAuthorization(h http.Header) bool {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(d)), "=")
+		switch name {
+		case "public", "s-maxage", "must-revalidate":
+			return true
+		}
+	}
+	return false
+}
+
+// freshness reports how long a response with header h stays fresh, and
+// whether it may be stored at all.
+func freshness(h http.Header, now time.Time) (time.Duration, bool) {
+	if h.Get("Vary") != "" || h.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	maxAge, sMaxAge := -1, -1
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		name, val, _ := strings.Cut(d, "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "s-maxage":
+			if secs, err := strconv.Atoi(val); err == nil {
+				sMaxAge = secs
+			}
+		case "max-age":
+			if secs, err := strconv.Atoi(val); err == nil {
+				maxAge = secs
+			}
+		}
+	}
+	// A shared cache prefers s-maxage over max-age.
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, maxAge > 0
+	}
+	if exp, err := http.ParseTime(h.Get("Expires")); err == nil {
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		if ttl := exp.Sub(date); ttl > 0 {
+			return ttl, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package multireq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// secretPlaceholder is a secret reference in a header value, such as
+// {env:API_TOKEN}.
+var secretPlaceholder = regexp.MustCompile(`\{((?:env|file|vault):[^{}]+)\}`)
+
+// HeaderRules change the headers of each request sent to a target, such as
+// to send each target its own credentials. They run as a preflight step, on
+// the target's copy of the request.
+type HeaderRules struct {
+	rules []headerRule
+}
+
+type headerRule struct {
+	op    string // set, add or remove
+	name  string
+	value []any // strings and *Secrets, joined
+}
+
+// ParseHeaderRules returns the rules specs describe, applied in order, each
+// one of
+//
+//	set: <name>: <value>    replace the header
+//	add: <name>: <value>    add a value to the header
+//	remove: <name>          remove the header
+//
+// A value may refer to secrets in braces, as in Bearer {env:API_TOKEN},
+// which are read each time a request is sent. Setting Host changes the host
+// the request is sent for.
+func ParseHeaderRules(specs []string) (*HeaderRules, error) {
+	h := &HeaderRules{}
+	for _, spec := range specs {
+		op, rest, _ := strings.Cut(spec, ":")
+		op, rest = strings.TrimSpace(op), strings.TrimSpace(rest)
+		rule := headerRule{op: op}
+		switch op {
+		case "set", "add":
+			name, value, ok := strings.Cut(rest, ":")
+			if !ok {
+				return nil, fmt.Errorf("%q is not of the form %s: <name>: <value>", spec, op)
+			}
+			rule.name = strings.TrimSpace(name)
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("%q: a header value can't span lines", spec)
+			}
+			var err error
+			if rule.value, err = parseHeaderValue(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("%q: %s", spec, err)
+			}
+		case "remove":
+			rule.name = rest
+		default:
+			return nil, fmt.Errorf("%q is not a set:, add: or remove: rule", spec)
+		}
+		if rule.name == "" || strings.ContainsAny(rule.name, " \t\r\n:") {
+			return nil, fmt.Errorf("%q: %q is not a header name", spec, rule.name)
+		}
+		h.rules = append(h.rules, rule)
+	}
+	return h, nil
+}
+
+// parseHeaderValue splits s into its literal text and the secrets it
+// refers to.
+func parseHeaderValue(s string) ([]any, error) {
+	var parts []any
+	last := 0
+	for _, m := range secretPlaceholder.FindAllStringSubmatchIndex(s, -1) {
+		secret, err := ParseSecret(s[m[2]:m[3]])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, s[last:m[0]], secret)
+		last = m[1]
+	}
+	return append(parts, s[last:]), nil
+}
+
+// Prepare applies the rules to req.
+func (h *HeaderRules) Prepare(ctx context.Context, req *http.Request) error {
+	for _, rule := range h.rules {
+		if rule.op == "remove" {
+			req.Header.Del(rule.name)
+			continue
+		}
+		var b strings.Builder
+		for _, part := range rule.value {
+			switch part := part.(type) {
+			case string:
+				b.WriteString(part)
+			case *Secret:
+				v, err := part.Value(ctx)
+				if err != nil {
+					return fmt.Errorf("header %s: %s", rule.name, err)
+				}
+				b.WriteString(v)
+			}
+		}
+		switch {
+		case http.CanonicalHeaderKey(rule.name) == "Host":
+			req.Host = b.String()
+		case rule.op == "set":
+			req.Header.Set(rule.name, b.String())
+		default:
+			req.Header.Add(rule.name, b.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package multireq
+
+import "time"
+
+// healthy reports whether t is in a state to win races: not backing off,
+// not shadowed, its circuit closed, not failing its most recent attempt and
+// not failing any synthetic check. A target evicted by a check is failing
+// it.
+func (t *Target) healthy(now time.Time) bool {
+	_, off := t.backingOff(now)
+	return !off && !t.shadowed.Load() && !t.failing.Load() && t.checksFailing.Load() == 0 && t.circuitState() == "closed"
+}
+
+// healthyTargets counts the proxy's healthy targets.
+func (p *Proxy) healthyTargets(now time.Time) int {
+	n := 0
+	for _, t := range p.Targets() {
+		if t.healthy(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// blames reports whether f says something is wrong with the target, rather
+// than with the client or the request.
+func (f *failure) blames() bool {
+	switch f.code {
+	case codeClientAbort:
+		return false
+	case codeBadStatus:
+		return f.status >= 500
+	}
+	return true
+}
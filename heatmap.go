@@ -0,0 +1,132 @@
+package multireq
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// heatmapHours is how many hours of response times a target's heatmap
+// keeps.
+const heatmapHours = 7 * 24
+
+// latencyHeatmap counts a target's response times by the hour they were
+// seen in and the bucket of latencyBuckets they fall in, so that the times
+// of day it is slow stand out.
+type latencyHeatmap struct {
+	mu   sync.Mutex
+	rows [heatmapHours]heatmapRow
+}
+
+type heatmapRow struct {
+	hour   int64    // since the epoch
+	counts []uint64 // by bucket, the last past latencyBuckets
+	sum    time.Duration
+}
+
+func (h *latencyHeatmap) observe(d time.Duration, now time.Time) {
+	hour := now.Unix() / 3600
+	s := d.Seconds()
+	b, _ := slices.BinarySearch(latencyBuckets, s)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	row := &h.rows[hour%heatmapHours]
+	if row.hour != hour || row.counts == nil {
+		*row = heatmapRow{hour: hour, counts: make([]uint64, len(latencyBuckets)+1)}
+	}
+	row.counts[b]++
+	row.sum += d
+}
+
+// since returns copies of the rows from the hour of from on, oldest first.
+func (h *latencyHeatmap) since(from time.Time) []heatmapRow {
+	first := from.Unix() / 3600
+	var rows []heatmapRow
+	h.mu.Lock()
+	for _, row := range h.rows {
+		if row.counts != nil && row.hour >= first {
+			row.counts = slices.Clone(row.counts)
+			rows = append(rows, row)
+		}
+	}
+	h.mu.Unlock()
+	slices.SortFunc(rows, func(a, b heatmapRow) int { return int(a.hour - b.hour) })
+	return rows
+}
+
+type heatmapJSON struct {
+	BucketsMS []float64        `json:"buckets_ms"`
+	Targets   []heatmapTargets `json:"targets"`
+}
+
+type heatmapTargets struct {
+	Target string        `json:"target"`
+	Hours  []heatmapHour `json:"hours"`
+}
+
+type heatmapHour struct {
+	Hour   time.Time `json:"hour"`
+	Count  uint64    `json:"count"`
+	MeanMS float64   `json:"mean_ms"`
+	Counts []uint64  `json:"counts"`
+}
+
+// serveHeatmap serves how long each target took to start answering, hour
+// by hour over the last week, or the last hours form value's worth of
+// hours. Each hour counts the responses in each latency bucket, the last
+// being those slower than every bucket. /heatmap.json serves it as JSON,
+// and /heatmap.csv as CSV, one row per target, hour and bucket.
+func (p *Proxy) serveHeatmap(w http.ResponseWriter, r *http.Request) {
+	hours := heatmapHours
+	if s := r.FormValue("hours"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "hours must be a positive number", http.StatusBadRequest)
+			return
+		}
+		hours = min(n, heatmapHours)
+	}
+	now := time.Now()
+	from := now.Add(-time.Duration(hours-1) * time.Hour)
+	hm := heatmapJSON{BucketsMS: make([]float64, len(latencyBuckets))}
+	for i, b := range latencyBuckets {
+		hm.BucketsMS[i] = b * 1000
+	}
+	for _, t := range p.Targets() {
+		ht := heatmapTargets{Target: t.String(), Hours: []heatmapHour{}}
+		for _, row := range t.heatmap.since(from) {
+			h := heatmapHour{Hour: time.Unix(row.hour*3600, 0).UTC(), Counts: row.counts}
+			for _, c := range row.counts {
+				h.Count += c
+			}
+			h.MeanMS = float64(row.sum) / float64(h.Count) / float64(time.Millisecond)
+			ht.Hours = append(ht.Hours, h)
+		}
+		hm.Targets = append(hm.Targets, ht)
+	}
+
+	if r.URL.Path == "/heatmap.csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"target", "hour", "le_ms", "count"})
+		for _, ht := range hm.Targets {
+			for _, h := range ht.Hours {
+				for i, c := range h.Counts {
+					le := "+Inf"
+					if i < len(hm.BucketsMS) {
+						le = strconv.FormatFloat(hm.BucketsMS[i], 'f', -1, 64)
+					}
+					cw.Write([]string{ht.Target, h.Hour.Format(time.RFC3339), le, strconv.FormatUint(c, 10)})
+				}
+			}
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hm)
+}
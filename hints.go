@@ -0,0 +1,75 @@
+package multireq
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+// maxInformational is the most informational responses a target may send
+// before its final one. Some send 102 Processing every few seconds while
+// they work, but one that never stops is broken.
+const maxInformational = 100
+
+// earlyHints forwards 103 Early Hints to the client while the race is still
+// undecided. Only the first target to send one is listened to, so the client
+// never sees hints from two backends interleaved. Other informational
+// responses are absorbed: the race is decided on final responses only.
+type earlyHints struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	leader int
+	done   bool
+}
+
+func (e *earlyHints) trace(i int) *httptrace.ClientTrace {
+	n := 0
+	return &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if n++; n > maxInformational {
+				return fmt.Errorf("sent more than %d informational responses", maxInformational)
+			}
+			e.forward(i, code, http.Header(header))
+			return nil
+		},
+	}
+}
+
+func (e *earlyHints) forward(i, code int, header http.Header) {
+	// 100 Continue is answered by our own server, 101 ends the exchange
+	// and 102 Processing only says the target is still busy.
+	if code != http.StatusEarlyHints {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.done {
+		return
+	}
+	if e.leader < 0 {
+		e.leader = i
+	}
+	if e.leader != i {
+		return
+	}
+
+	h := e.w.Header()
+	for k, v := range header {
+		h[k] = v
+	}
+	// WriteHeader sends and flushes an informational response straight
+	// away, but leaves its headers in place for the final one.
+	e.w.WriteHeader(code)
+	clear(h)
+}
+
+// stop prevents any further informational responses from being written, and
+// must be called before the final response headers are.
+func (e *earlyHints) stop() {
+	e.mu.Lock()
+	e.done = true
+	e.mu.Unlock()
+}
@@ -0,0 +1,73 @@
+package multireq
+
+import "net/http"
+
+// raceHooks are the callbacks an embedding program gave for the events of
+// each race. They are called on the goroutine serving the request, so they
+// hold it up for as long as they take, and they are called for many
+// requests at once.
+type raceHooks struct {
+	dispatch func(r *http.Request, t *Target)
+	response func(r *http.Request, t *Target, resp *http.Response, err error)
+	winner   func(r *http.Request, t *Target, resp *http.Response)
+	failed   func(r *http.Request, targets []*Target, errs []error)
+}
+
+// OnDispatch calls f as the request r is sent to each target t of its
+// race, hedges and escalations included.
+func OnDispatch(f func(r *http.Request, t *Target)) Option {
+	return func(p *Proxy) { p.hooks.dispatch = f }
+}
+
+// OnTargetResponse calls f with the response or error of each target t
+// that answers r before its race is decided, whether or not the answer
+// can win. f must neither read nor close resp's body. Answers arriving once
+// the race is decided aren't reported.
+func OnTargetResponse(f func(r *http.Request, t *Target, resp *http.Response, err error)) Option {
+	return func(p *Proxy) { p.hooks.response = f }
+}
+
+// OnWinner calls f with the target t that won the race for r and its
+// response, before the response is passed on. f must neither read nor close
+// resp's body.
+func OnWinner(f func(r *http.Request, t *Target, resp *http.Response)) Option {
+	return func(p *Proxy) { p.hooks.winner = f }
+}
+
+// OnAllFailed calls f when no target could answer r, with the targets it
+// was sent to and why each failed: errs[i] is nil for a target that hadn't
+// answered. targets is empty if no target could be sent r at all.
+func OnAllFailed(f func(r *http.Request, targets []*Target, errs []error)) Option {
+	return func(p *Proxy) { p.hooks.failed = f }
+}
+
+func (h *raceHooks) dispatched(r *http.Request, t *Target) {
+	if h.dispatch != nil {
+		h.dispatch(r, t)
+	}
+}
+
+func (h *raceHooks) answered(r *http.Request, t *Target, res result) {
+	if h.response != nil {
+		h.response(r, t, res.resp, res.err)
+	}
+}
+
+func (h *raceHooks) won(r *http.Request, t *Target, resp *http.Response) {
+	if h.winner != nil {
+		h.winner(r, t, resp)
+	}
+}
+
+func (h *raceHooks) allFailed(r *http.Request, targets []*Target, failures []*failure) {
+	if h.failed == nil {
+		return
+	}
+	errs := make([]error, len(failures))
+	for i, f := range failures {
+		if f != nil {
+			errs[i] = f
+		}
+	}
+	h.failed(r, targets, errs)
+}
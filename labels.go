@@ -0,0 +1,29 @@
+package multireq
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseLabelList reads labels given as <key>=<value>,<key>=<value>... Keys
+// are letters, digits and underscores, so they can be metric label names.
+func ParseLabelList(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || !validLabelKey(k) {
+			return nil, fmt.Errorf("%q is not of the form <key>=<value>", kv)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+func validLabelKey(k string) bool {
+	for i, c := range k {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !(i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return k != ""
+}
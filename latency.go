@@ -0,0 +1,104 @@
+package multireq
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A target's latency percentiles are taken over the responses of the last
+// latencyWindow, kept in slots of latencySlot, and need minLatencySamples
+// to be trusted.
+const (
+	latencyWindow     = time.Minute
+	latencySlot       = 10 * time.Second
+	minLatencySamples = 20
+)
+
+// Latency bins grow by latencyGrowth from a microsecond, so a
+// percentile is never off by more than 5%, up to about 100s.
+const (
+	latencyGrowth = 1.05
+	latencyBins   = 380
+)
+
+var logLatencyGrowth = math.Log(latencyGrowth)
+
+// latencyHistogram counts a target's recent response times in
+// logarithmic buckets, as an HDR histogram does, so that percentiles are
+// cheap to read.
+type latencyHistogram struct {
+	mu    sync.Mutex
+	slots [int(latencyWindow / latencySlot)]struct {
+		start  int64
+		counts [latencyBins]uint32
+	}
+}
+
+func latencyBin(d time.Duration) int {
+	us := d.Microseconds()
+	if us < 1 {
+		return 0
+	}
+	return min(int(math.Log(float64(us))/logLatencyGrowth)+1, latencyBins-1)
+}
+
+func (h *latencyHistogram) observe(d time.Duration, now time.Time) {
+	n := now.UnixNano() / int64(latencySlot)
+	s := &h.slots[n%int64(len(h.slots))]
+	h.mu.Lock()
+	if s.start != n {
+		s.start, s.counts = n, [latencyBins]uint32{}
+	}
+	s.counts[latencyBin(d)]++
+	h.mu.Unlock()
+}
+
+// percentile returns the response time q percent of the responses in the
+// window took no longer than, or false if there are too few to tell.
+func (h *latencyHistogram) percentile(q float64, now time.Time) (time.Duration, bool) {
+	since := now.UnixNano()/int64(latencySlot) - int64(len(h.slots))
+	var counts [latencyBins]uint64
+	var total uint64
+	h.mu.Lock()
+	for i := range h.slots {
+		if s := &h.slots[i]; s.start > since {
+			for b, c := range s.counts {
+				counts[b] += uint64(c)
+				total += uint64(c)
+			}
+		}
+	}
+	h.mu.Unlock()
+	if total < minLatencySamples {
+		return 0, false
+	}
+	rank := uint64(math.Ceil(q / 100 * float64(total)))
+	var seen uint64
+	for b, c := range counts {
+		if seen += c; seen >= max(rank, 1) {
+			// The bucket's upper bound.
+			return time.Duration(math.Exp(float64(b)*logLatencyGrowth) * float64(time.Microsecond)), true
+		}
+	}
+	return 0, false
+}
+
+// WithHedgePercentile waits, before hedging a request sent to a target, for
+// as long as q percent of that target's recent responses have taken, if
+// that is longer than the hedge delay. A target that is usually fast is
+// soon hedged, and one that is often slow is given its usual time first.
+func WithHedgePercentile(q float64) Option {
+	return func(p *Proxy) { p.hedgePercentile = q }
+}
+
+// hedgeAfter returns how long a hedged race waits for t before sending the
+// request to the next target.
+func (p *Proxy) hedgeAfter(t *Target) time.Duration {
+	if p.hedgePercentile > 0 {
+		if d, ok := t.latencies.percentile(p.hedgePercentile, time.Now()); ok {
+			return max(d, p.hedge)
+		}
+	}
+	return p.hedge
+}
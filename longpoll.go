@@ -0,0 +1,58 @@
+package multireq
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// LongPolls pick out long-poll requests, which a target holds until it has
+// something to say. Racing them would only hold a connection open on every
+// target, so each is sent to one target at a time, moving to the next only
+// if it fails, and none of the proxy's timeouts or hedging apply to it.
+type LongPolls struct {
+	patterns []string
+
+	matched *metricVec
+}
+
+// NewLongPolls picks out requests whose path starts with any of patterns,
+// or, for patterns with wildcards, matches it in full, as path.Match
+// would: /users/*/events matches /users/7/events.
+func NewLongPolls(patterns []string) (*LongPolls, error) {
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("%q is not a path pattern", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %s", pattern, err)
+		}
+	}
+	return &LongPolls{patterns: patterns}, nil
+}
+
+// WithLongPolls holds the requests l picks out on one target at a time.
+func WithLongPolls(l *LongPolls) Option {
+	return func(p *Proxy) { p.longPolls = l }
+}
+
+// match reports whether r is a long poll.
+func (l *LongPolls) match(r *http.Request) bool {
+	if l == nil {
+		return false
+	}
+	for _, pattern := range l.patterns {
+		var ok bool
+		if strings.ContainsAny(pattern, `*?[\`) {
+			ok, _ = path.Match(pattern, r.URL.Path)
+		} else {
+			ok = strings.HasPrefix(r.URL.Path, pattern)
+		}
+		if ok {
+			l.matched.inc()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package multireq
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and writes them in the Prometheus text format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metricVec
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.write(w)
+}
+
+func (r *Registry) write(w io.Writer) {
+	r.mu.Lock()
+	ms := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+// add registers m, unless a metric of the same name is registered already,
+// as by an earlier proxy given the same registry, in which case that one is
+// returned and its series carry on.
+func (r *Registry) add(m *metricVec) *metricVec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.metrics {
+		if o.name == m.name {
+			return o
+		}
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// counter registers a monotonically increasing metric.
+func (r *Registry) counter(name, help string, labels ...string) *metricVec {
+	return r.add(&metricVec{name: name, help: help, kind: "counter", labels: labels})
+}
+
+// gauge registers a metric that can go up and down.
+func (r *Registry) gauge(name, help string, labels ...string) *metricVec {
+	return r.add(&metricVec{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+// histogram registers a distribution of observations over buckets, given as
+// their inclusive upper bounds in increasing order.
+func (r *Registry) histogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return r.add(&metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+// latencyBuckets suit request phases measured in seconds.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricVec is a metric partitioned by label values.
+type metricVec struct {
+	name, help string
+	kind       string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // per bucket, for histograms
+	count  uint64
+}
+
+func (m *metricVec) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("%s: got %d label values, want %d", m.name, len(values), len(m.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	if m.series == nil {
+		m.series = make(map[string]*series)
+	}
+	s := m.series[key]
+	if s == nil {
+		s = &series{labels: slices.Clone(values)}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to a counter or gauge.
+func (m *metricVec) add(v float64, labels ...string) {
+	m.mu.Lock()
+	m.get(labels).value += v
+	m.mu.Unlock()
+}
+
+// inc adds one to a counter or gauge.
+func (m *metricVec) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+// set sets a gauge to v.
+func (m *metricVec) set(v float64, labels ...string) {
+	m.mu.Lock()
+	m.get(labels).value = v
+	m.mu.Unlock()
+}
+
+// observe records v in a histogram.
+func (m *metricVec) observe(v float64, labels ...string) {
+	m.mu.Lock()
+	s := m.get(labels)
+	if i, _ := slices.BinarySearch(m.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.value += v
+	s.count++
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(s.labels), formatFloat(s.value))
+			continue
+		}
+		var cum uint64
+		for i, b := range m.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s.labels, "le", formatFloat(b)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(s.labels), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelString(s.labels), s.count)
+	}
+}
+
+// labelString formats label values, followed by any extra name/value pairs.
+func (m *metricVec) labelString(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	pair := func(name, value string) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	for i, v := range values {
+		pair(m.labels[i], v)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pair(extra[i], extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,80 @@
+package multireq
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// WithPrimary makes t the primary target: every request is sent to it,
+// and only its answer is ever returned. The other targets are sent a
+// mirrored copy of each request as it is, so a new backend can be tried on
+// real traffic without answering any of it. Their answers are counted,
+// and logged if their status differs from the primary's.
+func WithPrimary(t *Target) Option {
+	return func(p *Proxy) { p.primary = t }
+}
+
+// withPrimary returns candidates with primary first.
+func withPrimary(candidates []*Target, primary *Target) []*Target {
+	ts := []*Target{primary}
+	for _, t := range candidates {
+		if t != primary {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// mirroring is what a race run in mirror mode leaves to be accounted for
+// once the mirrors have all answered.
+type mirroring struct {
+	r *http.Request
+
+	// primary is the status the primary answered with, or 0 if it didn't.
+	primary int
+
+	// early are the results of mirrors that answered before the primary.
+	early []result
+
+	// When diffing, the primary's answer is compared with the mirrors' once
+	// done is closed, after the primary's body has been sent.
+	id      string
+	answer  *answer
+	answers []*answer
+	done    chan struct{}
+}
+
+// mirrored counts the answer of mirror t, and logs it if it isn't the
+// primary's.
+func (p *Proxy) mirrored(m *mirroring, t *Target, res result) {
+	if m.done != nil {
+		m.answers = append(m.answers, keep(t, res))
+	}
+	status, outcome := 0, ""
+	switch {
+	case res.err != nil:
+		outcome = classify(context.Background(), res.err).code
+	default:
+		status = res.resp.StatusCode
+		outcome = strconv.Itoa(status)
+	}
+	p.metrics.mirrored.inc(t.String(), outcome)
+	if status == m.primary {
+		return
+	}
+	p.metrics.mirrorMismatches.inc(t.String())
+	if m.primary == 0 {
+		slog.Info("mirror answered a request the primary failed", "target", t.String(), "method", m.r.Method, "path", m.r.URL.Path, "result", outcome)
+	} else {
+		slog.Info("mirror answered unlike the primary", "target", t.String(), "method", m.r.Method, "path", m.r.URL.Path, "result", outcome, "primary_status", m.primary)
+	}
+}
+
+// isPrimaryMode reports whether the proxy mirrors requests from a primary,
+// and the overrides o, if any, don't ask for a request to be sent some
+// other way.
+func (p *Proxy) isPrimaryMode(o *overrides) bool {
+	return p.primary != nil && (o == nil || o.targets == nil && o.pin == nil && !o.mirror)
+}
@@ -0,0 +1,281 @@
+package multireq
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDiffBody is how much of each body a mirror diff compares. Bodies
+// longer than that are reported as too large rather than compared.
+const maxDiffBody = 1 << 20
+
+// maxDiffs is how many differences are reported for one mirror's answer.
+const maxDiffs = 20
+
+// MirrorDiffs compare each mirror's answer with the primary's, by status,
+// chosen headers and body, and log the requests where they differ, one
+// JSON object per line.
+type MirrorDiffs struct {
+	headers    []string
+	structural bool
+
+	mu sync.Mutex
+	f  *os.File
+
+	compared *metricVec
+}
+
+// NewMirrorDiffs appends diffs to the file at path, comparing the headers
+// named as well as status and body. If structural is set, JSON bodies are
+// compared value by value, naming each that differs, rather than byte by
+// byte.
+func NewMirrorDiffs(path string, headers []string, structural bool) (*MirrorDiffs, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range headers {
+		headers[i] = http.CanonicalHeaderKey(h)
+	}
+	return &MirrorDiffs{headers: headers, structural: structural, f: f}, nil
+}
+
+// WithMirrorDiffs compares the answers of mirrors with the primary's, in
+// mirror mode, recording differences in d.
+func WithMirrorDiffs(d *MirrorDiffs) Option {
+	return func(p *Proxy) { p.diffs = d }
+}
+
+func (d *MirrorDiffs) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.f.Close()
+}
+
+// answer is a response kept for comparing.
+type answer struct {
+	target string
+	status int
+	err    string // the failure code, if there was no response
+
+	// header and body are nil for a response that was not kept, such as
+	// one failed for its status before it could be compared.
+	header http.Header
+	body   *capped
+}
+
+// keep reads the answer res of t, up to maxDiffBody of its body.
+func keep(t *Target, res result) *answer {
+	a := &answer{target: t.String()}
+	if res.err != nil {
+		a.err = classify(context.Background(), res.err).code
+		return a
+	}
+	a.status = res.resp.StatusCode
+	body := &capped{max: maxDiffBody}
+	if _, err := io.Copy(body, res.resp.Body); err == nil {
+		a.header, a.body = res.resp.Header, body
+	}
+	return a
+}
+
+// capture keeps the primary's answer resp as it is read.
+func (d *MirrorDiffs) capture(resp *http.Response) *answer {
+	a := &answer{status: resp.StatusCode, header: resp.Header.Clone(), body: &capped{max: maxDiffBody}}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, a.body), resp.Body}
+	return a
+}
+
+// diffRecord is a line of the diff log.
+type diffRecord struct {
+	Time      time.Time    `json:"time"`
+	RequestID string       `json:"request_id"`
+	Method    string       `json:"method"`
+	URL       string       `json:"url"`
+	Primary   string       `json:"primary"`
+	Status    int          `json:"status,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Mirrors   []mirrorDiff `json:"mirrors"`
+}
+
+type mirrorDiff struct {
+	Target      string   `json:"target"`
+	Status      int      `json:"status,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Differences []string `json:"differences"`
+}
+
+// record compares the mirrors' answers with the primary's, and logs them if
+// any differs.
+func (d *MirrorDiffs) record(r *http.Request, id string, primary *answer, mirrors []*answer) {
+	rec := diffRecord{
+		Time:      time.Now().UTC(),
+		RequestID: id,
+		Method:    r.Method,
+		URL:       r.URL.RequestURI(),
+		Primary:   primary.target,
+		Status:    primary.status,
+		Error:     primary.err,
+	}
+	for _, m := range mirrors {
+		diffs := d.compare(primary, m)
+		if len(diffs) == 0 {
+			d.compared.inc(m.target, "same")
+			continue
+		}
+		d.compared.inc(m.target, "different")
+		rec.Mirrors = append(rec.Mirrors, mirrorDiff{m.target, m.status, m.err, diffs})
+	}
+	if len(rec.Mirrors) == 0 {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.f.Write(append(b, '\n')); err != nil {
+		slog.Error("writing the mirror diff log", "err", err)
+	}
+}
+
+// compare lists how m differs from the primary's answer p.
+func (d *MirrorDiffs) compare(p, m *answer) []string {
+	var diffs []string
+	if p.err != "" || m.err != "" {
+		if p.err != m.err || p.status != m.status {
+			diffs = append(diffs, fmt.Sprintf("response: %s != %s", p.outcome(), m.outcome()))
+		}
+		return diffs
+	}
+	if p.status != m.status {
+		// Bodies of different statuses are bound to differ.
+		return append(diffs, fmt.Sprintf("status: %d != %d", p.status, m.status))
+	}
+	if p.body == nil || m.body == nil {
+		return diffs
+	}
+	for _, h := range d.headers {
+		if pv, mv := strings.Join(p.header.Values(h), ", "), strings.Join(m.header.Values(h), ", "); pv != mv {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", h, pv, mv))
+		}
+	}
+	if p.body.truncated || m.body.truncated {
+		if !bytes.Equal(p.body.buf.Bytes(), m.body.buf.Bytes()) || p.body.truncated != m.body.truncated {
+			diffs = append(diffs, fmt.Sprintf("body: over %d bytes, not compared", maxDiffBody))
+		}
+		return diffs
+	}
+	pb, mb := p.body.buf.Bytes(), m.body.buf.Bytes()
+	if bytes.Equal(pb, mb) {
+		return diffs
+	}
+	if d.structural {
+		pj, perr := decodeJSON(pb)
+		mj, merr := decodeJSON(mb)
+		if perr == nil && merr == nil {
+			return append(diffs, jsonDiff("$", pj, mj, nil)...)
+		}
+	}
+	ph, mh := sha256.Sum256(pb), sha256.Sum256(mb)
+	return append(diffs, fmt.Sprintf("body: %d bytes, sha256 %s != %d bytes, sha256 %s",
+		len(pb), hex.EncodeToString(ph[:8]), len(mb), hex.EncodeToString(mh[:8])))
+}
+
+func (a *answer) outcome() string {
+	if a.err != "" {
+		return a.err
+	}
+	return fmt.Sprint(a.status)
+}
+
+func decodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("more than one JSON value")
+	}
+	return v, nil
+}
+
+// jsonDiff appends to diffs, up to maxDiffs of them, how the JSON value b
+// differs from a, naming each difference by its path from path.
+func jsonDiff(path string, a, b any, diffs []string) []string {
+	if len(diffs) >= maxDiffs {
+		return diffs
+	}
+	switch a := a.(type) {
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				av, inA := a[k]
+				bv, inB := b[k]
+				switch {
+				case !inB:
+					diffs = append(diffs, fmt.Sprintf("%s.%s: missing from the mirror", path, k))
+				case !inA:
+					diffs = append(diffs, fmt.Sprintf("%s.%s: only in the mirror, %s", path, k, jsonText(bv)))
+				default:
+					diffs = jsonDiff(path+"."+k, av, bv, diffs)
+				}
+			}
+			return diffs[:min(len(diffs), maxDiffs)]
+		}
+	case []any:
+		if b, ok := b.([]any); ok {
+			if len(a) != len(b) {
+				diffs = append(diffs, fmt.Sprintf("%s: %d elements != %d", path, len(a), len(b)))
+			}
+			for i := range min(len(a), len(b)) {
+				diffs = jsonDiff(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], diffs)
+			}
+			return diffs[:min(len(diffs), maxDiffs)]
+		}
+	}
+	if at, bt := jsonText(a), jsonText(b); at != bt {
+		diffs = append(diffs, fmt.Sprintf("%s: %s != %s", path, at, bt))
+	}
+	return diffs
+}
+
+// jsonText writes v as JSON, cut short if it is long.
+func jsonText(v any) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 80 {
+		return string(b[:77]) + "..."
+	}
+	return string(b)
+}
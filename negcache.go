@@ -0,0 +1,101 @@
+package multireq
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// negativeCache remembers which targets recently answered a GET or HEAD
+// for a resource with 404 or 410, so that later requests for it aren't
+// raced against them. Over time a path's races narrow to the targets that
+// have it.
+type negativeCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[negativeKey]time.Time // to when each entry expires
+
+	skipped *metricVec
+}
+
+type negativeKey struct {
+	t   *Target
+	key string
+}
+
+// WithNegativeCache leaves a target out of races for a resource for ttl
+// after it answers a GET or HEAD for it with 404 or 410, remembering up to
+// n such answers. A target is raced again for the resource once the entry
+// expires, or when every target the request could go to has one.
+func WithNegativeCache(ttl time.Duration, n int) Option {
+	return func(p *Proxy) {
+		p.negative = nil
+		if ttl > 0 && n > 0 {
+			p.negative = &negativeCache{ttl: ttl, max: n, entries: make(map[negativeKey]time.Time)}
+		}
+	}
+}
+
+// cacheable reports whether r is a request whose 404s are remembered.
+func (c *negativeCache) cacheable(r *http.Request) bool {
+	return c != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// filter returns the candidates not known to lack the resource r asks for,
+// or all of them if every one is.
+func (c *negativeCache) filter(r *http.Request, candidates []*Target, now time.Time) []*Target {
+	if !c.cacheable(r) {
+		return candidates
+	}
+	key := cacheKey(r)
+	var ts, skipped []*Target
+	c.mu.Lock()
+	for _, t := range candidates {
+		k := negativeKey{t, key}
+		if expires, ok := c.entries[k]; ok {
+			if now.Before(expires) {
+				skipped = append(skipped, t)
+				continue
+			}
+			delete(c.entries, k)
+		}
+		ts = append(ts, t)
+	}
+	c.mu.Unlock()
+	if len(ts) == 0 {
+		return candidates
+	}
+	for _, t := range skipped {
+		c.skipped.inc(t.String())
+	}
+	return ts
+}
+
+// record notes that t answered r with status: a missing resource is
+// remembered, and anything else forgets it was.
+func (c *negativeCache) record(r *http.Request, t *Target, status int) {
+	if !c.cacheable(r) {
+		return
+	}
+	k := negativeKey{t, cacheKey(r)}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if status != http.StatusNotFound && status != http.StatusGone {
+		delete(c.entries, k)
+		return
+	}
+	if _, ok := c.entries[k]; !ok && len(c.entries) >= c.max {
+		for k, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.max {
+			return
+		}
+	}
+	c.entries[k] = now.Add(c.ttl)
+}
@@ -0,0 +1,114 @@
+package multireq
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Negotiation asks targets for a variant of a static asset that a client
+// says it accepts, such as a WebP copy of a JPEG, in place of the asset it
+// asked for. A target that hasn't the variant is asked for the original
+// instead, in the same attempt, so a race is never lost for want of one.
+type Negotiation struct {
+	rules []negotiationRule
+
+	requests *metricVec
+}
+
+type negotiationRule struct {
+	suffix, variant, mediaType string
+}
+
+// NewNegotiation returns a negotiation following rules, each of the form
+// <suffix>=<variant suffix>, such as .jpg=.webp, or, for a variant whose
+// media type its suffix doesn't tell, <suffix>=<variant suffix>:<media
+// type>. A request for a path with the suffix is sent for the path with the
+// variant suffix in its place if its Accept header names the media type.
+// Rules for the same suffix are tried in the order given, so the most
+// preferred variant goes first.
+func NewNegotiation(rules []string) (*Negotiation, error) {
+	n := &Negotiation{}
+	for _, rule := range rules {
+		suffix, variant, ok := strings.Cut(rule, "=")
+		variant, mt, typed := strings.Cut(variant, ":")
+		if !ok || suffix == "" || variant == "" || suffix == variant {
+			return nil, fmt.Errorf("%q is not of the form <suffix>=<variant suffix>", rule)
+		}
+		if !typed {
+			mt, _, _ = mime.ParseMediaType(mime.TypeByExtension(variant))
+			if mt == "" {
+				return nil, fmt.Errorf("%q: the media type of %s isn't known; give it as %s:<media type>", rule, variant, variant)
+			}
+		}
+		n.rules = append(n.rules, negotiationRule{suffix: suffix, variant: variant, mediaType: strings.ToLower(mt)})
+	}
+	return n, nil
+}
+
+// WithNegotiation asks targets for the variants of assets n gives.
+func WithNegotiation(n *Negotiation) Option {
+	return func(p *Proxy) { p.negotiation = n }
+}
+
+// pick returns the path of the variant to ask targets for in place of the
+// one r asks for, if any, and whether any rule covers r's path, so that
+// the answer varies by Accept.
+func (n *Negotiation) pick(r *http.Request) (string, bool) {
+	if n == nil || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	covered := false
+	accept := r.Header.Get("Accept")
+	for _, rule := range n.rules {
+		if !strings.HasSuffix(r.URL.Path, rule.suffix) {
+			continue
+		}
+		covered = true
+		if namesType(accept, rule.mediaType) {
+			return strings.TrimSuffix(r.URL.Path, rule.suffix) + rule.variant, true
+		}
+	}
+	return "", covered
+}
+
+// count notes whether t had the variant it was asked for.
+func (n *Negotiation) count(t *Target, status int) {
+	if status == http.StatusNotFound || status == http.StatusGone {
+		n.requests.inc(t.String(), "missing")
+	} else {
+		n.requests.inc(t.String(), "served")
+	}
+}
+
+// namesType reports whether an Accept header names a media type itself,
+// with a quality above zero. Ranges such as image/* don't count: clients
+// send them whether or not they can read every type they match.
+func namesType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(part)
+		if err != nil || t != mediaType {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+// varyByAccept adds Accept to the Vary header of h, if it isn't there.
+func varyByAccept(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, "Accept") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept")
+}
@@ -0,0 +1,411 @@
+package multireq
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are refreshed in the background once this fraction of their
+// lifetime has passed, so requests never wait for one while it is still
+// good. A refresh that fails is retried every tokenRetry until the token
+// expires, after which requests fetch a new one themselves.
+const (
+	tokenRefreshAt = 0.8
+	tokenRetry     = 10 * time.Second
+)
+
+// jwtBearerGrant is the grant type of RFC 7523, which trades a JWT signed
+// with our own key for an access token.
+const jwtBearerGrant = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// TokenCache shares OAuth2 tokens between targets with the same credential
+// settings.
+type TokenCache struct {
+	mu       sync.Mutex
+	sources  map[string]*TokenSource
+	fetches  *metricVec
+	failures *metricVec
+}
+
+// NewTokenCache returns a token cache recording its fetches in reg.
+func NewTokenCache(reg *Registry) *TokenCache {
+	return &TokenCache{
+		sources: make(map[string]*TokenSource),
+		fetches: reg.counter("multireq_oauth2_token_fetches_total",
+			"OAuth2 token fetches by credential and result: ok or failed.",
+			"credential", "result"),
+		failures: reg.gauge("multireq_oauth2_token_failing",
+			"1 while the latest fetch of a credential's token failed, otherwise 0.",
+			"credential"),
+	}
+}
+
+// Source returns the token source for the comma separated settings, making
+// it if no target has used those settings before. The settings are
+//
+//	grant              client_credentials (the default) or jwt_bearer
+//	token_url          the token endpoint
+//	client_id          the client to authenticate as
+//	client_secret      a reference to the client's secret, as for ParseSecret
+//	client_secret_file short for client_secret=file:<path>
+//	scope              the scope to ask for, if any
+//
+// and, for jwt_bearer, which needs no client secret,
+//
+//	key                a reference to a PEM RSA or EC private key to sign
+//	                   assertions with
+//	key_file           short for key=file:<path>
+//	issuer, subject    the assertion's iss and sub, subject defaulting to issuer
+//	audience           its aud, defaulting to token_url
+func (c *TokenCache) Source(s string) (*TokenSource, error) {
+	settings, err := ParseLabelList(s)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k, v := range settings {
+		keys = append(keys, k+"="+v)
+	}
+	slices.Sort(keys)
+	key := strings.Join(keys, ",")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts := c.sources[key]; ts != nil {
+		return ts, nil
+	}
+	ts, err := newTokenSource(settings)
+	if err != nil {
+		return nil, err
+	}
+	ts.fetches, ts.failures = c.fetches, c.failures
+	c.sources[key] = ts
+	return ts, nil
+}
+
+// TokenSource fetches an OAuth2 access token and sends it to targets as a
+// bearer token, refreshing it before it expires.
+type TokenSource struct {
+	name         string // for logs and metrics
+	tokenURL     string
+	clientID     string
+	clientSecret *Secret
+	grant        func(context.Context) (url.Values, error)
+	client       *http.Client
+
+	fetches, failures *metricVec
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	refresh *time.Timer
+}
+
+func newTokenSource(settings map[string]string) (*TokenSource, error) {
+	ts := &TokenSource{
+		tokenURL: settings["token_url"],
+		clientID: settings["client_id"],
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if ts.tokenURL == "" {
+		return nil, errors.New("token_url is required")
+	}
+	var err error
+	if ts.clientSecret, err = secretSetting(settings, "client_secret"); err != nil {
+		return nil, err
+	}
+	scope := settings["scope"]
+
+	switch settings["grant"] {
+	case "", "client_credentials":
+		if ts.clientID == "" || ts.clientSecret == nil {
+			return nil, errors.New("client_credentials needs client_id and client_secret")
+		}
+		ts.name = ts.clientID + "@" + ts.tokenURL
+		ts.grant = func(context.Context) (url.Values, error) {
+			form := url.Values{"grant_type": {"client_credentials"}}
+			if scope != "" {
+				form.Set("scope", scope)
+			}
+			return form, nil
+		}
+	case "jwt_bearer":
+		key, err := secretSetting(settings, "key")
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, errors.New("jwt_bearer needs key")
+		}
+		// The key is parsed up front to catch a bad one, and again for
+		// each assertion in case it has been rotated.
+		if _, err := signingKey(context.Background(), key); err != nil {
+			return nil, err
+		}
+		iss, sub, aud := settings["issuer"], settings["subject"], settings["audience"]
+		if iss == "" {
+			return nil, errors.New("jwt_bearer needs issuer")
+		}
+		if sub == "" {
+			sub = iss
+		}
+		if aud == "" {
+			aud = ts.tokenURL
+		}
+		ts.name = sub + "@" + ts.tokenURL
+		ts.grant = func(ctx context.Context) (url.Values, error) {
+			k, err := signingKey(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			assertion, err := signJWT(k, iss, sub, aud)
+			if err != nil {
+				return nil, err
+			}
+			form := url.Values{"grant_type": {jwtBearerGrant}, "assertion": {assertion}}
+			if scope != "" {
+				form.Set("scope", scope)
+			}
+			return form, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown grant %q", settings["grant"])
+	}
+	return ts, nil
+}
+
+// Prepare sets req's bearer token.
+func (ts *TokenSource) Prepare(ctx context.Context, req *http.Request) error {
+	token, err := ts.get(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// get returns a token that hasn't expired, fetching one if there is none.
+func (ts *TokenSource) get(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Before(ts.expires) {
+		return ts.token, nil
+	}
+	if err := ts.fetch(ctx); err != nil {
+		return "", err
+	}
+	return ts.token, nil
+}
+
+// fetch replaces the token, and schedules its refresh. ts.mu must be held.
+func (ts *TokenSource) fetch(ctx context.Context) error {
+	form, err := ts.grant(ctx)
+	var secret string
+	if err == nil && ts.clientSecret != nil {
+		secret, err = ts.clientSecret.Value(ctx)
+	}
+	if err == nil {
+		var token string
+		var lifetime time.Duration
+		token, lifetime, err = fetchToken(ctx, ts.client, ts.tokenURL, form, ts.clientID, secret)
+		if err == nil {
+			now := time.Now()
+			ts.token, ts.expires = token, now.Add(lifetime)
+			ts.schedule(time.Duration(float64(lifetime) * tokenRefreshAt))
+			ts.fetches.inc(ts.name, "ok")
+			ts.failures.set(0, ts.name)
+			return nil
+		}
+	}
+	ts.fetches.inc(ts.name, "failed")
+	ts.failures.set(1, ts.name)
+	return err
+}
+
+func (ts *TokenSource) schedule(after time.Duration) {
+	if ts.refresh != nil {
+		ts.refresh.Stop()
+	}
+	ts.refresh = time.AfterFunc(after, ts.refreshNow)
+}
+
+// refreshNow fetches a new token ahead of the current one expiring.
+func (ts *TokenSource) refreshNow() {
+	ctx, cancel := context.WithTimeout(context.Background(), ts.client.Timeout)
+	defer cancel()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.fetch(ctx); err != nil {
+		slog.Warn("refreshing OAuth2 token", "name", ts.name, "err", err)
+		if left := time.Until(ts.expires); left > 0 {
+			ts.schedule(min(tokenRetry, left))
+		}
+	}
+}
+
+// fetchToken posts form to an OAuth2 token endpoint, authenticating as
+// clientID with its secret if there is one, and returns the access token
+// and how long it lasts.
+func fetchToken(ctx context.Context, client *http.Client, tokenURL string, form url.Values, clientID, clientSecret string) (string, time.Duration, error) {
+	if clientID != "" && clientSecret == "" {
+		form.Set("client_id", clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", 0, fmt.Errorf("token endpoint: %s", err)
+	}
+	if tok.AccessToken == "" {
+		return "", 0, errors.New("token endpoint: no access_token in response")
+	}
+	lifetime := time.Duration(tok.ExpiresIn) * time.Second
+	if tok.ExpiresIn <= 0 {
+		// The token's lifetime wasn't given; take a fresh one hourly.
+		lifetime = time.Hour
+	}
+	return tok.AccessToken, lifetime, nil
+}
+
+// secretSetting returns the secret the setting name refers to, or that
+// name_file names the file of, or nil if neither is set.
+func secretSetting(settings map[string]string, name string) (*Secret, error) {
+	ref, file := settings[name], settings[name+"_file"]
+	switch {
+	case ref != "" && file != "":
+		return nil, fmt.Errorf("%s and %s_file are both set", name, name)
+	case file != "":
+		ref = "file:" + file
+	case ref == "":
+		return nil, nil
+	}
+	s, err := ParseSecret(ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return s, nil
+}
+
+// signingKey returns the PEM encoded RSA or EC private key in secret.
+func signingKey(ctx context.Context, secret *Secret) (crypto.Signer, error) {
+	v, err := secret.Value(ctx)
+	if err != nil {
+		return nil, err
+	}
+	k, err := parseSigningKey([]byte(v))
+	if err != nil {
+		return nil, fmt.Errorf("key: %s: %s", secret, err)
+	}
+	return k, nil
+}
+
+// parseSigningKey parses a PEM encoded RSA or EC private key.
+func parseSigningKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().BitSize != 256 {
+			return nil, errors.New("EC keys must be P-256, for ES256")
+		}
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// signJWT returns an assertion for the JWT bearer grant, valid for five
+// minutes, signed with RS256 or ES256 according to key.
+func signJWT(key crypto.Signer, iss, sub, aud string) (string, error) {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	jti := make([]byte, 16)
+	rand.Read(jti)
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss": iss, "sub": sub, "aud": aud,
+		"iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(),
+		"jti": hex.EncodeToString(jti),
+	})
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS wants r and s as fixed width big-endian integers.
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
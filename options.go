@@ -0,0 +1,488 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Defaults used by NewTarget and New, chosen to be safe for a proxy
+// exposed to real traffic rather than to match net/http's zero values.
+const (
+	// DefaultHeaderTimeout bounds how long a target may take to start
+	// answering. Without it a hung target holds its connection open
+	// forever.
+	DefaultHeaderTimeout = time.Minute
+
+	// DefaultMaxIdleConns keeps enough warm connections to each target for
+	// concurrent races; net/http's default is 2.
+	DefaultMaxIdleConns = 32
+
+	// DefaultIdleConnTimeout is how long an idle connection to a target
+	// is kept, as in net/http.
+	DefaultIdleConnTimeout = 90 * time.Second
+
+	// DefaultTLSSessionCache is how many TLS sessions are kept per target
+	// for resumption, which net/http does not do by default.
+	DefaultTLSSessionCache = 64
+
+	// recentErrors is how many upstream failures are kept for the admin
+	// API.
+	recentErrors = 100
+)
+
+// DefaultUserAgent is sent to targets unless overridden.
+var DefaultUserAgent = "multireq/" + Version
+
+// TargetOption configures a target built by NewTarget.
+type TargetOption func(*Target)
+
+// NewTarget returns a target for u with its own pool of keep-alive
+// connections, a multireq User-Agent, a minute to send response headers
+// and no response age limit, resuming TLS sessions, as changed by opts.
+func NewTarget(u *url.URL, opts ...TargetOption) *Target {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	t := &Target{
+		url:           u,
+		userAgent:     DefaultUserAgent,
+		transport:     tr,
+		headerTimeout: DefaultHeaderTimeout,
+		removed:       make(chan struct{}),
+	}
+	WithMaxIdleConns(DefaultMaxIdleConns)(t)
+	WithIdleConnTimeout(DefaultIdleConnTimeout)(t)
+	WithTLSSessionCache(DefaultTLSSessionCache)(t)
+	for _, o := range opts {
+		o(t)
+	}
+	if t.dns != nil {
+		t.transport.DialContext = t.dns.wrap(t.transport.DialContext)
+	}
+	t.client = &http.Client{Transport: t.transport}
+	if t.roundTripper != nil {
+		t.client.Transport = t.roundTripper
+	}
+	return t
+}
+
+// WithName names the target.
+func WithName(name string) TargetOption {
+	return func(t *Target) { t.name = name }
+}
+
+// WithLabels adds labels to the target.
+func WithLabels(labels map[string]string) TargetOption {
+	return func(t *Target) {
+		if t.labels == nil {
+			t.labels = make(map[string]string)
+		}
+		for k, v := range labels {
+			t.labels[k] = v
+		}
+	}
+}
+
+// WithUserAgent sets the User-Agent sent to the target. An empty ua passes
+// the client's User-Agent through.
+func WithUserAgent(ua string) TargetOption {
+	return func(t *Target) { t.userAgent = ua }
+}
+
+// WithSourcePool dials the target from the addresses in pool.
+func WithSourcePool(pool *SourcePool) TargetOption {
+	return func(t *Target) { t.transport.DialContext = pool.dial }
+}
+
+// WithDNSCache resolves the target's host through c, whatever it is dialed
+// with.
+func WithDNSCache(c *DNSCache) TargetOption {
+	return func(t *Target) { t.dns = c }
+}
+
+// WithHeaderTimeout fails requests to the target that have no response
+// headers d after being sent. Zero waits forever.
+func WithHeaderTimeout(d time.Duration) TargetOption {
+	return func(t *Target) { t.headerTimeout = d }
+}
+
+// WithAttemptTimeout fails requests to the target that haven't been
+// answered in full, headers and body, within d. Zero waits forever.
+func WithAttemptTimeout(d time.Duration) TargetOption {
+	return func(t *Target) { t.attemptTimeout = d }
+}
+
+// WithBodyStallTimeout fails a winning response from the target whose body
+// delivers nothing for d. Zero waits forever.
+func WithBodyStallTimeout(d time.Duration) TargetOption {
+	return func(t *Target) { t.bodyStall = d }
+}
+
+// WithPreflight runs pf before each request to the target.
+func WithPreflight(pf Preflight) TargetOption {
+	return func(t *Target) { t.preflights = append(t.preflights, pf) }
+}
+
+// WithMaxAge rejects responses from the target that are older than d.
+func WithMaxAge(d time.Duration) TargetOption {
+	return func(t *Target) { t.maxAge = d }
+}
+
+// WithMaxRate limits the requests sent to the target to rate per second,
+// leaving it out of races that would exceed that. Zero means no limit.
+func WithMaxRate(rate float64) TargetOption {
+	return func(t *Target) {
+		t.pace = nil
+		if rate != 0 {
+			t.pace = newTokenBucket(rate)
+		}
+	}
+}
+
+// WithPrewarm opens n connections to the target on startup, up to its idle
+// pool's size.
+func WithPrewarm(n int) TargetOption {
+	return func(t *Target) { t.prewarm = n }
+}
+
+// WithMaxIdleConns keeps up to n idle connections to the target for later
+// requests to reuse, rather than each paying for a TCP and TLS handshake.
+func WithMaxIdleConns(n int) TargetOption {
+	return func(t *Target) {
+		t.transport.MaxIdleConnsPerHost = n
+		t.transport.MaxIdleConns = max(t.transport.MaxIdleConns, n)
+	}
+}
+
+// WithIdleConnTimeout closes connections to the target that have been idle
+// for d. Zero keeps them until the target closes them.
+func WithIdleConnTimeout(d time.Duration) TargetOption {
+	return func(t *Target) { t.transport.IdleConnTimeout = d }
+}
+
+// WithTransport sends the target's requests through rt rather than a
+// transport of its own, as for tests or instrumentation. The options
+// setting up connections, such as WithMaxIdleConns, WithSourcePool and the
+// TLS ones, then have no effect, and requests switching protocols need rt
+// to return a response whose Body is an io.ReadWriter, as http.Transport
+// does.
+func WithTransport(rt http.RoundTripper) TargetOption {
+	return func(t *Target) { t.roundTripper = rt }
+}
+
+// Option configures a proxy built by New.
+type Option func(*Proxy)
+
+// New returns a proxy racing requests across targets. Unless changed by
+// opts it has no HEAD cache and records metrics in a registry of its own.
+func New(targets []*Target, opts ...Option) *Proxy {
+	p := &Proxy{
+		strategy:      raceStrategy{},
+		accepted:      allowedCodes,
+		resume:        true,
+		xForwarded:    true,
+		via:           true,
+		flushInterval: DefaultFlushInterval,
+		bodies:        bodyBuffer{memory: defaultBodyMemory, dir: os.TempDir()},
+	}
+	p.targets.Store(&targets)
+	for _, o := range opts {
+		o(p)
+	}
+	if p.metrics == nil {
+		p.metrics = newProxyMetrics(&Registry{})
+	}
+	p.metrics.describe(targets)
+	if p.degrade != nil {
+		p.degrade.gauge = p.metrics.degraded
+	}
+	if p.fullRaces != nil {
+		p.fullRaces.matched = p.metrics.fullRaces
+	}
+	if p.longPolls != nil {
+		p.longPolls.matched = p.metrics.longPolls
+	}
+	if p.negative != nil {
+		p.negative.skipped = p.metrics.negativeSkips
+	}
+	if p.fair != nil {
+		p.fair.queued, p.fair.timeouts = p.metrics.fairQueued, p.metrics.fairTimeouts
+	}
+	if p.decisions != nil {
+		p.decisions.dropped = p.metrics.decisionsDropped
+	}
+	if p.breaker != nil {
+		p.breaker.gauge, p.breaker.opened = p.metrics.circuitState, p.metrics.circuitOpened
+	}
+	if p.budget != nil {
+		p.budget.gauge = p.metrics.shadowed
+	}
+	if p.negotiation != nil {
+		p.negotiation.requests = p.metrics.negotiated
+	}
+	if p.transforms != nil {
+		p.transforms.applied = p.metrics.transformed
+	}
+	if p.delays != nil {
+		p.delays.injected = p.metrics.injectedDelay
+	}
+	if p.staging != nil {
+		p.staging.sent, p.staging.skipped = p.metrics.stagingSent, p.metrics.stagingSkipped
+	}
+	if p.deliveries != nil {
+		p.deliveries.delivered, p.deliveries.depth, p.deliveries.dead = p.metrics.delivered, p.metrics.queued, p.metrics.dead
+	}
+	for _, a := range p.adaptive {
+		a.gauge = p.metrics.adaptiveTimeout
+	}
+	if p.diffs != nil {
+		p.diffs.compared = p.metrics.mirrorDiffs
+	}
+	if p.checks != nil {
+		p.checks.runs, p.checks.passing, p.checks.evicted = p.metrics.checkRuns, p.metrics.checkPassing, p.metrics.evicted
+	}
+	if p.experiment != nil {
+		p.experiment.races = p.metrics.experimentRaces
+		p.experiment.duration = p.metrics.experimentDuration
+	}
+	p.errors = newErrorLog(recentErrors)
+	return p
+}
+
+// WithMetrics records the proxy's metrics in reg.
+func WithMetrics(reg *Registry) Option {
+	return func(p *Proxy) { p.metrics = newProxyMetrics(reg) }
+}
+
+// WithHeadCache answers HEAD requests from the metadata of up to n cached GET
+// responses.
+func WithHeadCache(n int) Option {
+	return func(p *Proxy) {
+		if n > 0 {
+			p.heads = newHeadCache(n)
+		}
+	}
+}
+
+// WithFallbacks serves fb for routes whose targets all fail.
+func WithFallbacks(fb Fallbacks) Option {
+	return func(p *Proxy) { p.fallbacks = fb }
+}
+
+// WithErrorPages shows pages to browsers on routes no target answers for.
+func WithErrorPages(pages ErrorPages) Option {
+	return func(p *Proxy) { p.errorPages = pages }
+}
+
+// WithOutageBanner injects the HTML banner into HTML responses while any
+// target is unhealthy.
+func WithOutageBanner(banner string) Option {
+	return func(p *Proxy) { p.banner = banner }
+}
+
+// WithRedundancyHeader tells clients in a response header how many targets
+// their request was raced against and how many are healthy.
+func WithRedundancyHeader(on bool) Option {
+	return func(p *Proxy) { p.redundancy = on }
+}
+
+// WithBodyBuffer keeps up to memory bytes of each request body in memory and
+// the rest in a temporary file in spillDir, rejecting bodies over max. With
+// no spillDir, bodies over memory are rejected; with a max of zero there is
+// no other limit.
+func WithBodyBuffer(memory, max int64, spillDir string) Option {
+	return func(p *Proxy) { p.bodies = bodyBuffer{memory: memory, max: max, dir: spillDir} }
+}
+
+// WithAuditLog records a sample of the responses served in a.
+func WithAuditLog(a *AuditLog) Option {
+	return func(p *Proxy) { p.audit = a }
+}
+
+// WithDecisionLog records every race in d.
+func WithDecisionLog(d *DecisionLog) Option {
+	return func(p *Proxy) { p.decisions = d }
+}
+
+// WithExperiment splits clients between the variants of e.
+func WithExperiment(e *Experiment) Option {
+	return func(p *Proxy) { p.experiment = e }
+}
+
+// WithSelectors picks each request's targets with the first of sels that
+// picks any.
+func WithSelectors(sels []Selector) Option {
+	return func(p *Proxy) { p.selectors = sels }
+}
+
+// WithTrustedOverrides honors override headers from clients in nets.
+func WithTrustedOverrides(nets []*net.IPNet) Option {
+	return func(p *Proxy) { p.trusted = nets }
+}
+
+// WithDegrade races only the fanout fastest targets per request once
+// inFlight races are running, until they fall to half that. An inFlight of
+// zero never degrades.
+func WithDegrade(inFlight, fanout int) Option {
+	return func(p *Proxy) {
+		p.degrade = nil
+		if inFlight > 0 {
+			p.degrade = &degrader{high: int64(inFlight), fanout: fanout}
+		}
+	}
+}
+
+// WithErrorBudget shadows targets that fail more than ratio of at least
+// minAttempts attempts in window, racing them again once they fail under
+// half that, and posts each change to webhook if it is set. A ratio of zero
+// never shadows a target.
+func WithErrorBudget(ratio float64, window time.Duration, minAttempts int, webhook string) Option {
+	return func(p *Proxy) {
+		p.budget = nil
+		if ratio > 0 {
+			p.budget = &errorBudget{ratio: ratio, window: window, minAttempts: uint64(max(minAttempts, 1)),
+				webhook: webhook, client: &http.Client{}}
+		}
+	}
+}
+
+// WithHedgeDelay sends each request to the fastest target alone, and to
+// the next fastest each time d passes without an answer, or at once when
+// one fails. Zero races every target at once.
+func WithHedgeDelay(d time.Duration) Option {
+	return func(p *Proxy) { p.hedge = d }
+}
+
+// WithTimeout gives up on each request d after it arrives, whether or not
+// a target is still answering it. X-Multireq-Timeout overrides it for a
+// request. Zero waits forever.
+func WithTimeout(d time.Duration) Option {
+	return func(p *Proxy) { p.timeout = d }
+}
+
+// WithRequestContext sends each request to a target with the context f
+// returns, given the context the request would be sent with and the client
+// request r it is sent on behalf of, as to add a trace span or baggage for
+// the target. The context f is given carries r's values and deadline, and
+// f should return one derived from it, or the proxy can't cancel the
+// request once the race is decided.
+func WithRequestContext(f func(ctx context.Context, r *http.Request, t *Target) context.Context) Option {
+	return func(p *Proxy) { p.requestContext = f }
+}
+
+// WithAffinityHeader sends each request with header h to the one target
+// its value hashes to, racing the others only if that target fails.
+func WithAffinityHeader(h string) Option {
+	return func(p *Proxy) { p.affinity = http.CanonicalHeaderKey(h) }
+}
+
+// Validate reports every problem with the proxy's configuration.
+func (p *Proxy) Validate() error {
+	var errs []error
+	if len(p.Targets()) == 0 {
+		errs = append(errs, errors.New("no targets"))
+	}
+	if len(p.accepted) == 0 {
+		errs = append(errs, errors.New("no status is accepted"))
+	}
+	if p.stripPrefix != "" && !strings.HasPrefix(p.stripPrefix, "/") {
+		errs = append(errs, fmt.Errorf("strip prefix %q doesn't start with /", p.stripPrefix))
+	}
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, t := range p.Targets() {
+		if t.url.Scheme != "http" && t.url.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("target %s: scheme must be http or https", t))
+		}
+		if t.url.Host == "" {
+			errs = append(errs, fmt.Errorf("target %s: missing host", t))
+		}
+		if t.url.Scheme == "http" && t.setsTLS() {
+			errs = append(errs, fmt.Errorf("target %s: TLS settings on an http target", t))
+		}
+		if seen[t.url.String()] {
+			errs = append(errs, fmt.Errorf("target %s: listed more than once", t))
+		}
+		seen[t.url.String()] = true
+		if t.name != "" {
+			if names[t.name] {
+				errs = append(errs, fmt.Errorf("target %s: name %s is already taken", t, t.name))
+			}
+			names[t.name] = true
+		}
+		if t.maxAge < 0 {
+			errs = append(errs, fmt.Errorf("target %s: negative maximum response age", t))
+		}
+		if t.headerTimeout < 0 || t.attemptTimeout < 0 || t.bodyStall < 0 {
+			errs = append(errs, fmt.Errorf("target %s: negative timeout", t))
+		}
+		if t.transport.MaxIdleConnsPerHost <= 0 {
+			errs = append(errs, fmt.Errorf("target %s: keeps no idle connections", t))
+		}
+		if t.transport.IdleConnTimeout < 0 {
+			errs = append(errs, fmt.Errorf("target %s: negative idle connection timeout", t))
+		}
+		if t.sessionCache < 0 {
+			errs = append(errs, fmt.Errorf("target %s: negative TLS session cache size", t))
+		}
+		if t.prewarm < 0 {
+			errs = append(errs, fmt.Errorf("target %s: negative number of connections to prewarm", t))
+		}
+		if t.pace != nil && t.pace.rate < 0 {
+			errs = append(errs, fmt.Errorf("target %s: negative maximum rate", t))
+		}
+	}
+	if e := p.experiment; e != nil {
+		if len(e.variants) == 0 {
+			errs = append(errs, fmt.Errorf("experiment %s: no variants", e.name))
+		}
+		for _, v := range e.variants {
+			if len(v.targets) == 0 {
+				errs = append(errs, fmt.Errorf("experiment %s: variant %s has no targets", e.name, v.name))
+			}
+		}
+	}
+	if b := p.budget; b != nil {
+		if b.ratio >= 1 {
+			errs = append(errs, errors.New("error budget must be under 1"))
+		}
+		if b.window < time.Second || b.window > rollingWindow {
+			errs = append(errs, fmt.Errorf("error budget window must be from 1s to %s", rollingWindow))
+		}
+	}
+	if b := p.breaker; b != nil {
+		if b.ratio >= 1 {
+			errs = append(errs, errors.New("circuit breaker failure rate must be under 1"))
+		}
+		if b.window < time.Second || b.window > rollingWindow {
+			errs = append(errs, fmt.Errorf("circuit breaker window must be from 1s to %s", rollingWindow))
+		}
+		if b.open <= 0 {
+			errs = append(errs, errors.New("circuit breaker open duration must be positive"))
+		}
+	}
+	if p.timeout < 0 {
+		errs = append(errs, errors.New("negative timeout"))
+	}
+	if p.hedge < 0 {
+		errs = append(errs, errors.New("negative hedge delay"))
+	}
+	if p.hedgePercentile < 0 || p.hedgePercentile >= 100 {
+		errs = append(errs, errors.New("hedge percentile must be from 0 to under 100"))
+	}
+	if p.quorum > len(p.Targets()) {
+		errs = append(errs, fmt.Errorf("a quorum of %d needs at least as many targets", p.quorum))
+	}
+	if p.bodies.memory < 0 || p.bodies.max < 0 {
+		errs = append(errs, errors.New("negative request body limit"))
+	}
+	if p.degrade != nil && p.degrade.fanout < 1 {
+		errs = append(errs, errors.New("degraded fan-out must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
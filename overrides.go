@@ -0,0 +1,137 @@
+package multireq
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Trusted clients can change how their own request is raced with these
+// headers. They are never forwarded to targets.
+const (
+	// overrideTargets lists the targets to race, by their -target-name or
+	// URL. In mirror mode the first is the primary.
+	overrideTargets = "X-Multireq-Targets"
+
+	// overrideMode is race, the default, or mirror: the first target's
+	// response is always the one returned, and the rest are sent the
+	// request only for their own sake.
+	overrideMode = "X-Multireq-Mode"
+
+	// overrideTimeout bounds the whole request, as a Go duration.
+	overrideTimeout = "X-Multireq-Timeout"
+
+	// overridePin sends the request to the one target named, by its
+	// -target-name or URL, whether or not it is backing off or paced.
+	overridePin = "X-Multireq-Pin"
+)
+
+var overrideHeaders = []string{overrideTargets, overrideMode, overrideTimeout, overridePin}
+
+// overrides are the changes a request asked for.
+type overrides struct {
+	targets []*Target
+	pin     *Target
+	mirror  bool
+	timeout time.Duration
+}
+
+// overrides returns the overrides r asks for, or nil if it asks for none or
+// doesn't come from a trusted client.
+func (p *Proxy) overrides(r *http.Request) (*overrides, error) {
+	if len(p.trusted) == 0 || !p.trustsOverrides(r) {
+		return nil, nil
+	}
+	var o overrides
+	asked := false
+	if list := r.Header.Get(overrideTargets); list != "" {
+		asked = true
+		for _, name := range strings.Split(list, ",") {
+			t := p.lookup(strings.TrimSpace(name))
+			if t == nil {
+				return nil, fmt.Errorf("%s: %s is not a target", overrideTargets, name)
+			}
+			o.targets = append(o.targets, t)
+		}
+	}
+	if name := r.Header.Get(overridePin); name != "" {
+		asked = true
+		if o.targets != nil {
+			return nil, fmt.Errorf("%s and %s can't be used together", overridePin, overrideTargets)
+		}
+		if o.pin = p.lookup(name); o.pin == nil {
+			return nil, fmt.Errorf("%s: %s is not a target", overridePin, name)
+		}
+	}
+	switch mode := r.Header.Get(overrideMode); mode {
+	case "", "race":
+	case "mirror":
+		asked = true
+		o.mirror = true
+	default:
+		return nil, fmt.Errorf("%s: unknown mode %q", overrideMode, mode)
+	}
+	if s := r.Header.Get(overrideTimeout); s != "" {
+		asked = true
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a positive duration", overrideTimeout, s)
+		}
+		o.timeout = d
+	}
+	if !asked {
+		return nil, nil
+	}
+	return &o, nil
+}
+
+// lookup returns the target with the given name or URL.
+func (p *Proxy) lookup(name string) *Target {
+	for _, t := range p.Targets() {
+		if t.name == name || t.url.String() == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) trustsOverrides(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range p.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrusted reads IPs and CIDR ranges.
+func ParseTrusted(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is neither an IP nor a CIDR range", s)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,64 @@
+package multireq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxPaceWait is the longest a request waits for a target to come free
+// before it is turned away.
+const maxPaceWait = time.Second
+
+// tokenBucket allows rate events per second on average, in bursts of up to a
+// second's worth.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// take removes a token if there is one. If not it returns how long until
+// there will be.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// available returns the candidates to race a request against. When none can
+// be raced yet, it waits up to maxPaceWait for one to come free. If none
+// does, or ctx is done first, it returns no targets and when to try again.
+func (p *Proxy) available(ctx context.Context, candidates []*Target) ([]*Target, time.Time) {
+	for {
+		now := time.Now()
+		ts, until := p.eligible(candidates, now)
+		wait := until.Sub(now)
+		if len(ts) > 0 || until.IsZero() || wait > maxPaceWait {
+			return ts, until
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, until
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package multireq
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// upgrade reports whether r asks to switch the connection to another
+// protocol, as a WebSocket handshake does.
+func upgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.Header.Get("Upgrade") != "" && hasToken(r.Header, "Connection", "upgrade")
+}
+
+// hasToken reports whether the comma separated values of header name in h
+// include token.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type handshake struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// serveUpgrade races the handshake r starts, and joins the client's
+// connection to that of the first target to switch protocols, for as long
+// as both keep it open. Targets that switch later are hung up on. With a
+// primary, only the primary is sent the handshake: a mirror can't be let
+// in on a conversation the proxy has no part in, unless it is broadcast
+// what the client sends. It returns the target the client was joined to,
+// if any.
+func (p *Proxy) serveUpgrade(w http.ResponseWriter, r *http.Request) *Target {
+	candidates := p.selectTargets(r, p.Targets())
+	if p.primary != nil && !p.broadcast {
+		candidates = []*Target{p.primary}
+	}
+	targets, until := p.available(r.Context(), candidates)
+	designated := -1
+	if p.primary != nil && p.broadcast {
+		if designated = slices.Index(targets, p.primary); designated < 0 {
+			// Mirrors never answer in the primary's place.
+			targets = nil
+		}
+	}
+	if len(targets) == 0 {
+		if r.Context().Err() == nil {
+			p.writeUnavailable(w, r, until)
+		}
+		return nil
+	}
+	var b *broadcast
+	if p.broadcast && len(targets) > 1 {
+		b = newBroadcast(p, targets)
+		defer b.close()
+	}
+
+	r.RequestURI = ""
+	results := make(chan handshake, len(targets))
+	stops := make([]context.CancelCauseFunc, len(targets))
+	for i, t := range targets {
+		ctx, stop := context.WithCancelCause(r.Context())
+		stops[i] = stop
+		go func() {
+			var headers *time.Timer
+			if t.headerTimeout > 0 {
+				headers = time.AfterFunc(t.headerTimeout, func() { stop(errHeaderTimeout) })
+			}
+			req := p.outgoing(ctx, r, t)
+			if b != nil {
+				req.Header.Del("Sec-WebSocket-Extensions")
+			}
+			var resp *http.Response
+			err := t.prepare(ctx, req)
+			if err == nil {
+				resp, err = t.client.Do(req)
+			}
+			if headers != nil && !headers.Stop() && err == nil {
+				resp.Body.Close()
+				resp, err = nil, errHeaderTimeout
+			}
+			results <- handshake{index: i, resp: resp, err: err}
+		}()
+	}
+
+	win, pending := -1, len(targets)
+	var resp *http.Response
+	failures := make([]*failure, len(targets))
+	failed := targets
+	for win < 0 && pending > 0 {
+		res := <-results
+		pending--
+		t := targets[res.index]
+		var f *failure
+		switch {
+		case res.err != nil:
+			f = classify(r.Context(), res.err)
+		case res.resp.StatusCode != http.StatusSwitchingProtocols:
+			res.resp.Body.Close()
+			f = badStatus(res.resp.StatusCode)
+		case designated >= 0 && res.index != designated:
+			b.attach(res.index, res.resp)
+			p.metrics.outcomes.inc(t.String(), "lost")
+			continue
+		default:
+			win, resp = res.index, res.resp
+			p.metrics.outcomes.inc(t.String(), "won")
+			p.settle(t, true)
+			continue
+		}
+		failures[res.index] = f
+		p.fail(t, f)
+		p.metrics.outcomes.inc(t.String(), "failed")
+		b.forget(res.index)
+		if res.index == designated {
+			failed, failures = targets[designated:designated+1], failures[designated:designated+1]
+			break
+		}
+	}
+	if resp == nil {
+		b.close()
+	}
+	b.forget(win)
+	for i, stop := range stops {
+		if i != win && (b == nil || resp == nil) {
+			stop(errLost)
+		}
+	}
+	go func() {
+		for ; pending > 0; pending-- {
+			res := <-results
+			switch {
+			case res.err != nil:
+				b.forget(res.index)
+			case res.resp.StatusCode == http.StatusSwitchingProtocols:
+				b.attach(res.index, res.resp)
+			default:
+				res.resp.Body.Close()
+				b.forget(res.index)
+			}
+			p.metrics.outcomes.inc(targets[res.index].String(), "lost")
+		}
+	}()
+	if resp == nil {
+		if r.Context().Err() == nil {
+			p.writeFailure(w, r, failed, failures)
+		}
+		return nil
+	}
+	t := targets[win]
+	defer stops[win](nil)
+	defer resp.Body.Close()
+	up, ok := resp.Body.(io.ReadWriter)
+	if !ok {
+		slog.Error("a target switched protocols without handing over its connection", "target", t.String())
+		http.Error(w, "the target's connection can't be taken over", http.StatusBadGateway)
+		return t
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		slog.Error("taking over a client connection to switch protocols", "err", err)
+		http.Error(w, "the connection can't switch protocols", http.StatusInternalServerError)
+		return t
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		return t
+	}
+
+	p.metrics.upgraded.add(1, t.String())
+	defer p.metrics.upgraded.add(-1, t.String())
+	// Once either side is done with the connection, both are closed.
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(up, b.reader(brw.Reader))
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, up)
+		done <- struct{}{}
+	}()
+	<-done
+	return t
+}
@@ -0,0 +1,72 @@
+package multireq
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WithStripPrefix removes prefix from the start of the paths of requests
+// under it before they are raced, so that /api/users reaches targets as
+// /users with a prefix of /api. Other requests are raced as they are.
+func WithStripPrefix(prefix string) Option {
+	return func(p *Proxy) { p.stripPrefix = strings.TrimSuffix(prefix, "/") }
+}
+
+// strip returns r with p's strip prefix removed from its path, or r itself
+// if its path isn't under the prefix. Like http.StripPrefix, it doesn't
+// change r.
+func (p *Proxy) strip(r *http.Request) *http.Request {
+	if p.stripPrefix == "" {
+		return r
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, p.stripPrefix)
+	if !ok || rest != "" && rest[0] != '/' {
+		return r
+	}
+	u := *r.URL
+	u.Path = rest
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if raw, ok := strings.CutPrefix(u.RawPath, p.stripPrefix); ok && raw != "" {
+		u.RawPath = raw
+	} else {
+		u.RawPath = ""
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = &u
+	return r2
+}
+
+// join returns the URL of path on t: t's URL with path joined to its own,
+// so that a target of http://a.example.com/v1 is sent /users as /v1/users.
+func (t *Target) join(path *url.URL) *url.URL {
+	u := *t.url
+	u.Path, u.RawPath = joinPath(t.url, path)
+	u.RawQuery = path.RawQuery
+	return &u
+}
+
+// joinPath joins the paths of a and b with a single slash, as
+// httputil.ReverseProxy does.
+func joinPath(a, b *url.URL) (path, rawpath string) {
+	if a.Path == "" {
+		return b.Path, b.RawPath
+	}
+	apath, bpath := a.EscapedPath(), b.EscapedPath()
+	aslash, bslash := strings.HasSuffix(apath, "/"), strings.HasPrefix(bpath, "/")
+	switch {
+	case aslash && bslash:
+		path, rawpath = a.Path+b.Path[1:], apath+bpath[1:]
+	case !aslash && !bslash:
+		path, rawpath = a.Path+"/"+b.Path, apath+"/"+bpath
+	default:
+		path, rawpath = a.Path+b.Path, apath+bpath
+	}
+	if a.RawPath == "" && b.RawPath == "" {
+		rawpath = ""
+	}
+	return path, rawpath
+}
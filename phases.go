@@ -0,0 +1,97 @@
+package multireq
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// phases times the stages of a single upstream request: DNS lookup, TCP
+// connect, TLS handshake, time to the final response headers and, for the
+// winner, the body.
+type phases struct {
+	mu        sync.Mutex
+	dnsStart  time.Time
+	connStart time.Time
+	tlsStart  time.Time
+	wrote     time.Time
+	took      map[string]time.Duration
+}
+
+func newPhases() *phases {
+	return &phases{took: make(map[string]time.Duration)}
+}
+
+func (ph *phases) mark(t *time.Time) {
+	ph.mu.Lock()
+	if t.IsZero() {
+		*t = time.Now()
+	}
+	ph.mu.Unlock()
+}
+
+// done records phase name as having taken since from, unless the phase
+// never started.
+func (ph *phases) done(name string, from *time.Time) {
+	ph.mu.Lock()
+	if !from.IsZero() {
+		ph.took[name] = time.Since(*from)
+	}
+	ph.mu.Unlock()
+}
+
+func (ph *phases) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { ph.mark(&ph.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { ph.done("dns", &ph.dnsStart) },
+		// With several addresses connects may overlap, so time from the
+		// first attempt to the one that succeeded.
+		ConnectStart: func(_, _ string) { ph.mark(&ph.connStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				ph.done("connect", &ph.connStart)
+			}
+		},
+		TLSHandshakeStart: func() { ph.mark(&ph.tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				ph.done("tls", &ph.tlsStart)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { ph.mark(&ph.wrote) },
+	}
+}
+
+// headersDone records that the final response headers arrived. It stands in
+// for GotFirstResponseByte, which fires on the first informational response
+// when there is one.
+func (ph *phases) headersDone() {
+	ph.done("ttfb", &ph.wrote)
+}
+
+// bodyDone records that the response body took since start to copy.
+func (ph *phases) bodyDone(start time.Time) {
+	ph.done("body", &start)
+}
+
+// snapshot returns the phases measured so far.
+func (ph *phases) snapshot() map[string]time.Duration {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	m := make(map[string]time.Duration, len(ph.took))
+	for k, v := range ph.took {
+		m[k] = v
+	}
+	return m
+}
+
+// record adds the named phases to the latency histogram for target t.
+func (ph *phases) record(m *metricVec, t *Target, names ...string) {
+	took := ph.snapshot()
+	for _, name := range names {
+		if d, ok := took[name]; ok {
+			m.observe(d.Seconds(), t.String(), name)
+		}
+	}
+}
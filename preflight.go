@@ -0,0 +1,23 @@
+package multireq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Preflight is a step run before each request to a target is sent, such as
+// fetching a credential the target needs.
+type Preflight interface {
+	Prepare(ctx context.Context, req *http.Request) error
+}
+
+// prepare runs t's preflight steps on req.
+func (t *Target) prepare(ctx context.Context, req *http.Request) error {
+	for _, pf := range t.preflights {
+		if err := pf.Prepare(ctx, req); err != nil {
+			return &failure{code: codePreflight, err: fmt.Errorf("preflight: %w", err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package multireq
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// prewarmTimeout bounds how long startup waits for prewarmed connections.
+const prewarmTimeout = 5 * time.Second
+
+// Prewarm opens each target's prewarm connections, so the first races
+// don't pay for handshakes. Connections are opened by sending that many
+// concurrent HEAD requests for the target's URL, leaving them idle in its
+// pool.
+func (p *Proxy) Prewarm() {
+	ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, t := range p.Targets() {
+		if t.prewarm == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := t.warm(ctx)
+			slog.Info("prewarmed connections", "target", t.String(), "connections", n, "wanted", t.prewarm)
+		}()
+	}
+	wg.Wait()
+}
+
+// warm opens up to t.prewarm connections to t, returning how many it
+// opened.
+func (t *Target) warm(ctx context.Context) int {
+	n := min(t.prewarm, t.transport.MaxIdleConnsPerHost)
+	var opened atomic.Int64
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				opened.Add(1)
+			}
+		},
+	}
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, t.url.String(), nil)
+			if err != nil {
+				return
+			}
+			if t.userAgent != "" {
+				req.Header.Set("User-Agent", t.userAgent)
+			}
+			resp, err := t.client.Do(req)
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	return int(opened.Load())
+}
@@ -0,0 +1,34 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Probe sends a GET for path to t the way a proxied request would be sent.
+func (t *Target) Probe(path string, timeout time.Duration) (int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if r.URL.Host != "" {
+		return 0, 0, errors.New("-path must be a path, not a URL")
+	}
+	start := time.Now()
+	resp, err := t.client.Do(outgoing(ctx, r, t))
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
+
+// Acceptable reports whether a target's response with status can win a
+// race, with the statuses accepted by default.
+func Acceptable(status int) bool {
+	return allowedCodes[status]
+}
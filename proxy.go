@@ -0,0 +1,1084 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// allowedCodes are the statuses accepted unless a proxy is built
+// WithStatuses.
+var allowedCodes = StatusSet{
+	200: true,
+	304: true,
+	302: true,
+}
+
+// errLost cancels the upstream requests of the targets that lost a race.
+var errLost = errors.New("another target won the race")
+
+// Proxy sends every request it receives to all of its targets and replies
+// with the first acceptable response.
+type Proxy struct {
+	// targets are replaced whole, under targetsMu, when the admin API
+	// changes them.
+	targets   atomic.Pointer[[]*Target]
+	targetsMu sync.Mutex
+
+	// targetOptions configure targets added through the admin API, and
+	// adminToken, if set, must be presented to change them.
+	targetOptions []TargetOption
+	adminToken    *Secret
+
+	// heads, if set, answers HEAD requests from the metadata of earlier
+	// GET responses.
+	heads *headCache
+
+	// access, if set, is logged a record of every request.
+	access *slog.Logger
+
+	// fullRaces, if set, picks out requests exempt from caching and from
+	// narrowing their races.
+	fullRaces *FullRaces
+
+	// longPolls, if set, picks out requests sent to one target at a time.
+	longPolls *LongPolls
+
+	// negative, if set, leaves targets out of races for resources they
+	// recently didn't have.
+	negative *negativeCache
+
+	// families, if set, sends related requests to the same target.
+	families *families
+
+	// requestContext, if set, replaces the context of each request sent
+	// to a target.
+	requestContext func(context.Context, *http.Request, *Target) context.Context
+
+	// hooks are called as races are run.
+	hooks raceHooks
+
+	metrics *proxyMetrics
+
+	// errors keeps the most recent upstream failures for the admin API.
+	errors *errorLog
+
+	// fallbacks serve local files for routes none of whose targets could
+	// answer.
+	fallbacks Fallbacks
+
+	// errorPages are shown to browsers when no target answers.
+	errorPages ErrorPages
+
+	// banner, if set, is injected into HTML responses while some targets
+	// are unhealthy.
+	banner string
+
+	// redundancy adds redundancyHeader to responses.
+	redundancy bool
+
+	// flushInterval is the longest a winning body waits to be flushed to
+	// the client, or, if negative, none.
+	flushInterval time.Duration
+
+	// bodyCheck, if set, fails responses whose bodies say they are
+	// errors.
+	bodyCheck *BodyCheck
+
+	// stripPrefix is removed from the paths of requests under it.
+	stripPrefix string
+
+	// broadcast sends what clients send over upgraded connections to every
+	// target that switched protocols.
+	broadcast bool
+
+	// xForwarded, via and forwarded add X-Forwarded-*, Via and Forwarded
+	// headers to the messages passed on.
+	xForwarded, via, forwarded bool
+
+	// accepted are the statuses of responses that can win a race.
+	accepted StatusSet
+
+	// reportTrailer ends passed on responses with the trace of their race.
+	reportTrailer bool
+
+	// resume carries on winning bodies from another target when theirs
+	// fails partway.
+	resume bool
+
+	// decisions, if set, records every race for offline analysis.
+	decisions *DecisionLog
+
+	// audit, if set, records a sample of the responses served.
+	audit *AuditLog
+
+	// signatures, if set, are checked before requests are raced.
+	signatures Signatures
+
+	// checks, if set, are run against every target on a schedule.
+	checks *Checks
+
+	// deliveries, if set, takes some requests to deliver to every target
+	// in the background rather than race.
+	deliveries *Deliveries
+
+	// negotiation, if set, asks targets for variants of assets that
+	// clients accept.
+	negotiation *Negotiation
+
+	// transforms, if set, rewrite the bodies of winning responses.
+	transforms *Transforms
+
+	// delays, if set, hold back some winning responses, for testing.
+	delays *Delays
+
+	// staging, if set, is sent copies of a sample of requests.
+	staging *Staging
+
+	// diffs, if set, compares mirrors' answers with the primary's.
+	diffs *MirrorDiffs
+
+	// primary, if set, answers every request, which the other targets are
+	// sent as mirrors.
+	primary *Target
+
+	// strategy picks the targets each request is sent to.
+	strategy Strategy
+
+	// quorum, if over 1, is how many targets must return the same response
+	// before it is sent to the client.
+	quorum int
+
+	// hedge, if set, launches racing targets one at a time, fastest first,
+	// each only once the ones before have gone this long without
+	// answering.
+	hedge time.Duration
+
+	// hedgePercentile, if set, lengthens the hedge delay for each target
+	// to this percentile of its recent response times.
+	hedgePercentile float64
+
+	// learned, if set, orders hedged races by the weights targets have
+	// learned from them rather than by latency.
+	learned bool
+
+	// timeout, if set, bounds each request from when it arrives.
+	timeout time.Duration
+
+	// adaptive, if set, replaces timeout under its routes.
+	adaptive AdaptiveTimeouts
+
+	// bodies buffers request bodies to send every target.
+	bodies bodyBuffer
+
+	// experiment, if set, splits clients between groups of targets.
+	experiment *Experiment
+
+	// selectors pick the targets for each request by their labels.
+	selectors []Selector
+
+	// trusted clients may change how their requests are raced with
+	// override headers.
+	trusted []*net.IPNet
+
+	// degrade, if set, races fewer targets while the proxy is overloaded.
+	degrade *degrader
+
+	// fair, if set, caps the races run at once, queueing requests over the
+	// cap fairly by tenant.
+	fair *FairQueue
+
+	// budget, if set, stops using the responses of targets that fail too
+	// often.
+	budget *errorBudget
+
+	// breaker, if set, leaves targets that fail too often out of races
+	// for a while.
+	breaker *circuitBreaker
+
+	// affinity, if set, is a request header whose value picks the one
+	// target a request is sent to, unless that target fails.
+	affinity string
+
+	// conns holds the *clientConn of each open client connection, keyed
+	// by its net.Conn.
+	conns sync.Map
+
+	inFlight    atomic.Int64
+	won, failed rollingCounter
+}
+
+type proxyMetrics struct {
+	phase            *metricVec
+	inFlight         *metricVec
+	races            *metricVec
+	outcomes         *metricVec
+	errors           *metricVec
+	paced            *metricVec
+	degraded         *metricVec
+	pinned           *metricVec
+	handshakes       *metricVec
+	shadowed         *metricVec
+	unstuck          *metricVec
+	familyFallbacks  *metricVec
+	unsigned         *metricVec
+	hedges           *metricVec
+	delivered        *metricVec
+	queued           *metricVec
+	dead             *metricVec
+	checkRuns        *metricVec
+	mirrored         *metricVec
+	adaptiveTimeout  *metricVec
+	mirrorDiffs      *metricVec
+	mirrorMismatches *metricVec
+	checkPassing     *metricVec
+	fullRaces        *metricVec
+	longPolls        *metricVec
+	negativeSkips    *metricVec
+	circuitState     *metricVec
+	circuitOpened    *metricVec
+	fairQueued       *metricVec
+	fairTimeouts     *metricVec
+	evicted          *metricVec
+	stagingSent      *metricVec
+	injectedDelay    *metricVec
+	transformed      *metricVec
+	negotiated       *metricVec
+	resumed          *metricVec
+	upgraded         *metricVec
+	broadcastDrops   *metricVec
+	stagingSkipped   *metricVec
+
+	info     *metricVec
+	infoKeys []string
+
+	decisionsDropped   *metricVec
+	experimentRaces    *metricVec
+	experimentDuration *metricVec
+
+	reg *Registry
+}
+
+func newProxyMetrics(reg *Registry) *proxyMetrics {
+	return &proxyMetrics{
+		reg: reg,
+		phase: reg.histogram("multireq_upstream_phase_seconds",
+			"Time spent by upstream requests in each phase: dns, connect, tls, ttfb and body.",
+			latencyBuckets, "target", "phase"),
+		inFlight: reg.gauge("multireq_races_in_flight",
+			"Races currently waiting for a winner or copying its response."),
+		races: reg.counter("multireq_races_total",
+			"Races by result: won, or failed when no target gave an acceptable response.",
+			"result"),
+		outcomes: reg.counter("multireq_upstream_outcomes_total",
+			"Upstream requests by target and outcome: won, lost or failed.",
+			"target", "outcome"),
+		errors: reg.counter("multireq_upstream_errors_total",
+			"Upstream failures by target and failure code.",
+			"target", "code"),
+		degraded: reg.gauge("multireq_degraded",
+			"1 while racing fewer targets per request because of load, otherwise 0."),
+		decisionsDropped: reg.counter("multireq_decisions_dropped_total",
+			"Race decision records dropped because the decision log fell behind."),
+		experimentRaces: reg.counter("multireq_experiment_races_total",
+			"Races by experiment variant and result: won or failed.",
+			"variant", "result"),
+		experimentDuration: reg.histogram("multireq_experiment_race_seconds",
+			"Time from a request arriving to its race being decided, by experiment variant and result.",
+			latencyBuckets, "variant", "result"),
+		pinned: reg.counter("multireq_pinned_connections_total",
+			"Client connections pinned to a target, without racing, for multi-leg authentication.",
+			"target"),
+		unstuck: reg.counter("multireq_affinity_fallbacks_total",
+			"Requests raced against the other targets after failing on the target their affinity header picked.",
+			"target"),
+		familyFallbacks: reg.counter("multireq_family_fallbacks_total",
+			"Requests raced against the other targets after failing on the target that won their family's last race.",
+			"target"),
+		handshakes: reg.counter("multireq_upstream_tls_handshakes_total",
+			"TLS handshakes with each target, by whether they resumed an earlier session.",
+			"target", "resumed"),
+		shadowed: reg.gauge("multireq_target_shadowed",
+			"1 while a target is over its error budget and its responses are not used, otherwise 0.",
+			"target"),
+		unsigned: reg.counter("multireq_signature_rejections_total",
+			"Requests rejected for a missing or bad signature, by the route requiring it.",
+			"route"),
+		hedges: reg.counter("multireq_hedges_total",
+			"Targets launched into a hedged race because the ones before had not answered within the hedge delay.",
+			"target"),
+		delivered: reg.counter("multireq_delivery_attempts_total",
+			"Attempts to deliver queued events to each target, by result: delivered or failed.",
+			"target", "result"),
+		queued: reg.gauge("multireq_delivery_queue_depth",
+			"Events waiting to be delivered to each target.",
+			"target"),
+		adaptiveTimeout: reg.gauge("multireq_adaptive_timeout_seconds",
+			"The timeout last given a request under each route with an adaptive timeout.",
+			"route"),
+		mirrorDiffs: reg.counter("multireq_mirror_diffs_total",
+			"Answers of mirrors compared with the primary's, by result: same or different.",
+			"target", "result"),
+		mirrored: reg.counter("multireq_mirror_responses_total",
+			"Answers of mirrors, by status or, if they gave none, failure code.",
+			"target", "result"),
+		mirrorMismatches: reg.counter("multireq_mirror_mismatches_total",
+			"Answers of mirrors with a different status from the primary's.",
+			"target"),
+		checkRuns: reg.counter("multireq_check_runs_total",
+			"Runs of each synthetic check on each target, by result: passed or failed.",
+			"check", "target", "result"),
+		checkPassing: reg.gauge("multireq_check_passing",
+			"Whether each synthetic check passed on each target the last time it ran.",
+			"check", "target"),
+		fairQueued: reg.gauge("multireq_fair_queue_waiting",
+			"Requests waiting for their turn to race, over -max-races."),
+		fairTimeouts: reg.counter("multireq_fair_queue_timeouts_total",
+			"Requests turned away for waiting too long for their turn to race."),
+		circuitState: reg.gauge("multireq_circuit_state",
+			"State of each target's circuit breaker: 0 closed, 1 open, 2 half-open.",
+			"target"),
+		circuitOpened: reg.counter("multireq_circuit_opened_total",
+			"Times each target's circuit breaker opened for too many failures.",
+			"target"),
+		fullRaces: reg.counter("multireq_full_races_total",
+			"Requests exempt from caching and raced against every candidate by -full-race rules."),
+		longPolls: reg.counter("multireq_long_polls_total",
+			"Requests held on one target at a time by -long-poll rules."),
+		negativeSkips: reg.counter("multireq_negative_cache_skips_total",
+			"Times a target was left out of a race for a resource it recently answered 404 or 410 for.",
+			"target"),
+		evicted: reg.gauge("multireq_target_evicted",
+			"Whether a health check has taken each target out of races.",
+			"target"),
+		dead: reg.gauge("multireq_delivery_dead_letters",
+			"Events given up on delivering to each target, kept until requeued.",
+			"target"),
+		transformed: reg.counter("multireq_transformed_responses_total",
+			"Winning responses whose bodies were run through each transform, by route and transform.",
+			"route", "transform"),
+		broadcastDrops: reg.counter("multireq_broadcast_drops_total",
+			"Targets sent a copy of a client's upgraded connection that were hung up on for falling behind it.",
+			"target"),
+		upgraded: reg.gauge("multireq_upgraded_connections",
+			"Client connections switched to another protocol, such as WebSocket, joined to each target.",
+			"target"),
+		resumed: reg.counter("multireq_resumed_responses_total",
+			"Winning response bodies another target was asked for the rest of after theirs failed partway, by the target asked and result: resumed or failed.",
+			"target", "result"),
+		negotiated: reg.counter("multireq_variant_requests_total",
+			"Requests for a variant of an asset sent to each target, by result: served, or missing if it was asked for the original instead.",
+			"target", "result"),
+		injectedDelay: reg.histogram("multireq_injected_delay_seconds",
+			"Delays injected before sending winning responses, for testing.",
+			latencyBuckets),
+		stagingSent: reg.counter("multireq_staging_requests_total",
+			"Copies of live requests sent to each staging target, by status, or by failure code if it gave none.",
+			"target", "result"),
+		stagingSkipped: reg.counter("multireq_staging_skipped_total",
+			"Sampled requests not copied to staging, by reason: body, rate or in_flight.",
+			"reason"),
+		paced: reg.counter("multireq_upstream_paced_total",
+			"Times a target was left out of a race for being over its rate limit.",
+			"target"),
+	}
+}
+
+// describe publishes each target's URL and labels in an info metric, so the
+// target label of every other metric can be joined with them.
+func (m *proxyMetrics) describe(targets []*Target) {
+	keys := []string{"target", "url"}
+	for _, t := range targets {
+		for k := range t.labels {
+			if !slices.Contains(keys, "label_"+k) {
+				keys = append(keys, "label_"+k)
+			}
+		}
+	}
+	slices.Sort(keys[2:])
+	m.info, m.infoKeys = m.reg.gauge("multireq_target_info", "Each target's URL and labels; always 1.", keys...), keys
+	for _, t := range targets {
+		m.describeOne(t)
+	}
+}
+
+// describeOne publishes t's URL and labels. Labels no target had when the
+// proxy started are left out.
+func (m *proxyMetrics) describeOne(t *Target) {
+	values := []string{t.String(), t.url.String()}
+	for _, k := range m.infoKeys[2:] {
+		values = append(values, t.labels[strings.TrimPrefix(k, "label_")])
+	}
+	m.info.set(1, values...)
+}
+
+type result struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	received := r
+	r = p.forward(p.strip(r))
+	full := p.fullRaces.match(r) || r.Context().Value(testRaceKey{}) != nil
+	longPoll := !full && p.longPolls.match(r)
+	heads, negative := p.heads, p.negative
+	if full {
+		heads, negative = nil, nil
+	}
+	if r.Method == http.MethodHead && heads != nil && heads.serve(w, r) {
+		return
+	}
+
+	p.metrics.inFlight.add(1)
+	defer p.metrics.inFlight.add(-1)
+	inFlight := p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+
+	start := time.Now()
+	id := requestID(r)
+	var rt *raceTrace
+	var winner *Target
+	if p.access != nil {
+		cw := &countingWriter{ResponseWriter: w}
+		w = cw
+		defer func() { p.logAccess(received, id, cw, start, rt, winner) }()
+	}
+	o, err := p.overrides(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, ok := p.bufferBody(w, r)
+	if !ok {
+		return
+	}
+	if !p.verify(w, r, body) {
+		body.close()
+		return
+	}
+	if upgrade(r) {
+		body.close()
+		winner = p.serveUpgrade(w, r)
+		return
+	}
+	if p.deliveries.takes(r) {
+		p.accept(w, r, id, body)
+		return
+	}
+	p.staging.copy(r, body)
+	if !p.fair.acquire(r.Context(), r) {
+		body.close()
+		if r.Context().Err() == nil {
+			p.writeUnavailable(w, r, time.Now())
+		}
+		return
+	}
+	defer p.fair.release()
+	candidates := p.Targets()
+	var v *variant
+	if p.experiment != nil {
+		var unit string
+		v, unit = p.experiment.assign(r)
+		p.experiment.expose(r, id, v, unit)
+		candidates = v.targets
+	}
+	candidates = p.selectTargets(r, candidates)
+	primaryMode := p.isPrimaryMode(o)
+	mirror := primaryMode
+	if primaryMode {
+		candidates = withPrimary(candidates, p.primary)
+	} else {
+		candidates = negative.filter(r, candidates, time.Now())
+	}
+	timeout := p.timeout
+	adaptive := p.adaptive.match(r.URL.Path)
+	if longPoll {
+		timeout, adaptive = 0, nil
+	}
+	if adaptive != nil {
+		timeout = adaptive.timeout(time.Now())
+	}
+	if o != nil {
+		if o.targets != nil {
+			candidates = o.targets
+		}
+		if o.timeout > 0 {
+			timeout = o.timeout
+		}
+		mirror = mirror || o.mirror
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	var targets []*Target
+	var until time.Time
+	cc := connOf(r)
+	pinned, client := cc.pinned()
+	if pinned != nil {
+		targets = []*Target{pinned}
+	} else if o != nil && o.pin != nil {
+		targets = []*Target{o.pin}
+	} else {
+		targets, until = p.available(r.Context(), candidates)
+		if primaryMode && (len(targets) == 0 || targets[0] != p.primary) {
+			// Mirrors never answer in the primary's place.
+			targets = nil
+		}
+	}
+	if len(targets) == 0 {
+		body.close()
+		if r.Context().Err() == nil {
+			p.raceDone(v, "failed", start)
+			p.hooks.allFailed(r, nil, nil)
+			p.writeRedundancy(w.Header(), 0)
+			if !p.fallbacks.serve(w, r) {
+				p.writeUnavailable(w, r, until)
+			}
+		}
+		return
+	}
+	if scheme := multiLegAuth(r.Header.Values("Authorization")); cc != nil && pinned == nil && scheme != "" {
+		pinned, client = p.pin(cc, targets[0], scheme)
+		targets = []*Target{pinned}
+	}
+	chosen := pinned != nil || mirror || o != nil && o.pin != nil
+	first := len(targets)
+	var votes *vote
+	if !chosen && p.quorum > 1 && !longPoll {
+		votes = newVote(p.quorum)
+	} else if !chosen && !full {
+		targets, first = p.strategy.Plan(r, targets)
+		if longPoll {
+			first = 1
+		}
+	}
+	racing := first == len(targets) && votes == nil
+	if p.degrade != nil && racing && !full && len(targets) > 1 {
+		targets = p.degrade.trim(targets, inFlight)
+		first = len(targets)
+	}
+	sticky, family, hedged := false, false, false
+	if !chosen && racing && !full {
+		if targets, family = p.families.order(r, targets); !family {
+			targets, sticky = p.stick(r, targets)
+		}
+		sticky = sticky || family
+		if hedged = (p.hedge > 0 || p.hedgePercentile > 0) && !sticky && len(targets) > 1; hedged {
+			if p.learned {
+				targets = byLearned(targets)
+			} else {
+				targets = byLatency(targets)
+			}
+		}
+	}
+
+	r.RequestURI = ""
+	alt, negotiated := p.negotiation.pick(r)
+	hints := &earlyHints{w: w, leader: -1}
+	traced := r.Header.Get(traceHeader) != "" && p.trustsOverrides(r)
+	rt = newRaceTrace(r, targets, traced, p.decisions != nil || p.access != nil || p.reportTrailer)
+
+	// Each target's request is cancelled when the client goes away, and
+	// when it loses the race. Mirrors aren't racing, so they are left to
+	// finish after the client has its response, unless it left early.
+	results := make(chan result, len(targets))
+	timings := make([]*phases, len(targets))
+	stops := make([]context.CancelCauseFunc, len(targets))
+	ctxs := make([]context.Context, len(targets))
+	var detach []func() bool
+	defer func() {
+		for _, d := range detach {
+			d()
+		}
+	}()
+	launch := func(i int) {
+		t := targets[i]
+		timings[i] = newPhases()
+		if mirror && i != 0 {
+			ctxs[i], stops[i] = context.WithCancelCause(context.WithoutCancel(r.Context()))
+			detach = append(detach, context.AfterFunc(r.Context(), func() {
+				stops[i](context.Cause(r.Context()))
+			}))
+		} else {
+			ctxs[i], stops[i] = context.WithCancelCause(r.Context())
+		}
+		if t.attemptTimeout > 0 && !longPoll {
+			expire := time.AfterFunc(t.attemptTimeout, func() { stops[i](errAttemptTimeout) })
+			context.AfterFunc(ctxs[i], func() { expire.Stop() })
+		}
+		ctx := httptrace.WithClientTrace(ctxs[i], hints.trace(i))
+		ctx = httptrace.WithClientTrace(ctx, timings[i].trace())
+		ctx = httptrace.WithClientTrace(ctx, p.tlsTrace(t))
+		req := p.outgoing(ctx, r, t)
+		if alt != "" {
+			req.URL.Path, req.URL.RawPath = joinPath(t.url, &url.URL{Path: alt})
+		}
+		p.hooks.dispatched(r, t)
+
+		go func() {
+			sent := time.Now()
+			var headers *time.Timer
+			if t.headerTimeout > 0 && !longPoll {
+				headers = time.AfterFunc(t.headerTimeout, func() { stops[i](errHeaderTimeout) })
+			}
+			c := t.client
+			if client != nil {
+				c = client
+			}
+			var resp *http.Response
+			err := t.prepare(ctxs[i], req)
+			if err == nil {
+				resp, err = c.Do(req)
+			}
+			if err == nil && alt != "" {
+				p.negotiation.count(t, resp.StatusCode)
+				if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+					// t hasn't the variant, so it's asked for the original.
+					resp.Body.Close()
+					resp, req = nil, p.outgoing(ctx, r, t)
+					if err = t.prepare(ctxs[i], req); err == nil {
+						resp, err = c.Do(req)
+					}
+				}
+			}
+			if headers != nil && !headers.Stop() && err == nil {
+				// The timeout fired as the headers arrived.
+				resp.Body.Close()
+				resp, err = nil, errHeaderTimeout
+			}
+			if cause := context.Cause(ctxs[i]); err != nil && !errors.Is(err, cause) &&
+				(errors.Is(cause, errHeaderTimeout) || errors.Is(cause, errAttemptTimeout)) {
+				err = fmt.Errorf("%w: %w", cause, err)
+			}
+			if err == nil {
+				timings[i].headersDone()
+				t.observeLatency(time.Since(sent))
+				if t.bodyStall > 0 {
+					resp.Body = newStallReader(resp.Body, t.bodyStall, stops[i])
+				}
+				if p.accepted[resp.StatusCode] && p.bodyCheck.applies(r, resp) {
+					if err = p.bodyCheck.run(resp); err != nil {
+						resp.Body.Close()
+						resp = nil
+					}
+				}
+			}
+			timings[i].record(p.metrics.phase, t, "dns", "connect", "tls", "ttfb")
+			results <- result{index: i, resp: resp, err: err}
+		}()
+	}
+	launched := first
+	if sticky || hedged {
+		launched = 1
+	}
+	sent := time.Now()
+	for i := range launched {
+		launch(i)
+	}
+
+	win := -1
+	var resp *http.Response
+	var agreed []int
+	var early []result
+	failures := make([]*failure, len(targets))
+	pending := launched
+	var shadow []bool
+	if !mirror {
+		shadow = shadows(targets)
+	}
+	// hedge launches the next target of a hedged race, and restarts the
+	// delay before the one after.
+	var hedgeTimer *time.Timer
+	var hedgeDue <-chan time.Time
+	if hedged {
+		hedgeTimer = time.NewTimer(p.hedgeAfter(targets[0]))
+		defer hedgeTimer.Stop()
+		hedgeDue = hedgeTimer.C
+	}
+	hedge := func() {
+		if launched < len(targets) {
+			launch(launched)
+			launched++
+			pending++
+		}
+		if launched < len(targets) {
+			hedgeTimer.Reset(p.hedgeAfter(targets[launched-1]))
+		} else {
+			hedgeDue = nil
+		}
+	}
+	// escalate races the rest of the targets once the one a request stuck
+	// to, t, could not answer it. In a hedged race, the next target is sent
+	// the request without waiting for the delay, and a strategy that tries
+	// targets in turn gets the next one.
+	escalate := func(t *Target) {
+		if hedged {
+			hedge()
+			return
+		}
+		if launched == len(targets) {
+			return
+		}
+		if !sticky {
+			launch(launched)
+			launched++
+			pending++
+			return
+		}
+		if family {
+			p.metrics.familyFallbacks.inc(t.String())
+		} else {
+			p.metrics.unstuck.inc(t.String())
+		}
+		for i := launched; i < len(targets); i++ {
+			launch(i)
+		}
+		pending += len(targets) - launched
+		launched = len(targets)
+	}
+	for win < 0 && pending > 0 {
+		var res result
+		select {
+		case res = <-results:
+		case <-hedgeDue:
+			p.metrics.hedges.inc(targets[launched].String())
+			hedge()
+			continue
+		}
+		pending--
+		t := targets[res.index]
+		p.hooks.answered(r, t, res)
+		var f *failure
+		switch {
+		case res.err != nil:
+			f = classify(r.Context(), res.err)
+		case !p.accepted[res.resp.StatusCode] && !challenge(res.resp):
+			f = badStatus(res.resp.StatusCode)
+			negative.record(r, t, res.resp.StatusCode)
+			if d, ok := retryAfter(res.resp, time.Now()); ok {
+				slog.Info("target asked us to back off", "target", t.String(), "for", d.String())
+				t.backOff(d)
+			}
+		case t.tooOld(res.resp):
+			age := responseAge(res.resp.Header, time.Now())
+			f = &failure{code: codeStale, status: res.resp.StatusCode, err: fmt.Errorf("response is %s old", age)}
+		case mirror && res.index != 0:
+			// Mirrors answer only for their own sake. When diffing,
+			// discard reads the body and closes it.
+			if p.diffs == nil {
+				res.resp.Body.Close()
+			}
+			early = append(early, res)
+			rt.outcome(res.index, "mirrored", res.resp.StatusCode, nil)
+			p.metrics.outcomes.inc(t.String(), "lost")
+			p.settle(t, true)
+			continue
+		case shadow != nil && shadow[res.index]:
+			// Shadowed targets are over their error budget, and only
+			// raced to see when they recover.
+			res.resp.Body.Close()
+			rt.outcome(res.index, "shadowed", res.resp.StatusCode, nil)
+			p.metrics.outcomes.inc(t.String(), "lost")
+			p.settle(t, true)
+			escalate(t)
+			continue
+		case votes != nil:
+			var err error
+			if agreed, err = votes.cast(res.index, res.resp); err != nil {
+				f = &failure{code: codeBody, err: err}
+				break
+			}
+			p.settle(t, true)
+			if agreed == nil {
+				continue
+			}
+			// The first to answer of those agreeing wins.
+			win, resp = agreed[0], votes.resps[agreed[0]]
+			rt.outcome(win, "won", resp.StatusCode, nil)
+			p.metrics.outcomes.inc(targets[win].String(), "won")
+			for _, i := range agreed[1:] {
+				rt.outcome(i, "agreed", resp.StatusCode, nil)
+				p.metrics.outcomes.inc(targets[i].String(), "lost")
+			}
+			for i, other := range votes.resps {
+				if !slices.Contains(agreed, i) {
+					other.Body.Close()
+					rt.outcome(i, "outvoted", other.StatusCode, nil)
+					p.metrics.outcomes.inc(targets[i].String(), "lost")
+				}
+			}
+			continue
+		default:
+			if cc != nil && pinned == nil && challenge(res.resp) {
+				// The client's answer must go to the target that asked.
+				p.pin(cc, t, multiLegAuth(res.resp.Header.Values("WWW-Authenticate")))
+			}
+			win, resp = res.index, res.resp
+			negative.record(r, t, res.resp.StatusCode)
+			rt.outcome(res.index, "won", res.resp.StatusCode, nil)
+			p.metrics.outcomes.inc(t.String(), "won")
+			p.settle(t, true)
+			continue
+		}
+		if res.err == nil {
+			res.resp.Body.Close()
+		}
+		failures[res.index] = f
+		p.fail(t, f)
+		rt.outcome(res.index, f.code, f.status, f.err)
+		p.metrics.outcomes.inc(t.String(), "failed")
+		if mirror && res.index == 0 {
+			break
+		}
+		if mirror {
+			early = append(early, res)
+		}
+		escalate(t)
+	}
+	hints.stop()
+	if adaptive != nil && resp != nil {
+		adaptive.latencies.observe(time.Since(sent), time.Now())
+	}
+	targets, failures, timings = targets[:launched], failures[:launched], timings[:launched]
+	rt.trim(launched)
+	// A client that went away says nothing of how the targets did.
+	if hedged && p.learned && received.Context().Err() == nil {
+		learn(targets, win)
+	}
+
+	if !mirror {
+		for i, stop := range stops[:launched] {
+			if i != win {
+				stop(errLost)
+			}
+		}
+	}
+	var m *mirroring
+	if mirror {
+		m = &mirroring{r: r, early: early}
+		if resp != nil {
+			m.primary = resp.StatusCode
+		} else if failures[0] != nil {
+			m.primary = failures[0].status
+		}
+		if p.diffs != nil {
+			m.id, m.done = id, make(chan struct{})
+			defer close(m.done)
+			if resp != nil {
+				m.answer = p.diffs.capture(resp)
+			} else {
+				m.answer = &answer{status: m.primary}
+				switch {
+				case m.primary != 0:
+				case failures[0] != nil:
+					m.answer.err = failures[0].code
+				default:
+					m.answer.err = "pending"
+				}
+			}
+			m.answer.target = targets[0].String()
+		}
+	}
+	go p.discard(targets, results, pending, body, m)
+
+	if votes != nil && resp == nil {
+		for i, f := range votes.dissent() {
+			failures[i] = f
+			rt.outcome(i, f.code, f.status, f.err)
+			p.metrics.outcomes.inc(targets[i].String(), "failed")
+		}
+	}
+	rt.write(w.Header(), timings)
+	p.decisions.record(r, id, rt)
+	p.writeRedundancy(w.Header(), len(targets))
+	if agreed != nil {
+		writeAgreed(w.Header(), targets, agreed)
+	}
+	if resp == nil {
+		p.raceDone(v, "failed", start)
+		if mirror {
+			// Only the primary's failure counts.
+			targets, failures = targets[:1], failures[:1]
+		}
+		p.hooks.allFailed(r, targets, failures)
+		if !p.fallbacks.serve(w, r) {
+			p.writeFailure(w, r, targets, failures)
+		}
+		return
+	}
+	p.raceDone(v, "won", start)
+	winner = targets[win]
+	p.families.remember(r, winner)
+	p.hooks.won(r, winner, resp)
+	defer resp.Body.Close()
+	if !p.delays.wait(r.Context()) {
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			p.writeFailure(w, r, targets[win:win+1], []*failure{{code: codeTimeout, err: errDelayed}})
+		}
+		return
+	}
+	served, servedCtx := targets[win], ctxs[win]
+	var rs *resumption
+	if !mirror {
+		rs = p.resumable(r, resp, served, servedCtx)
+	}
+	if rs != nil {
+		resp.Body = rs
+		defer rs.Close()
+	}
+	p.forwardResponse(resp)
+	if negotiated {
+		varyByAccept(resp.Header)
+	}
+	p.transforms.apply(r, resp)
+	banner := p.banner != "" && wantsBanner(resp) && p.healthyTargets(time.Now()) < len(p.Targets())
+	// A bannered body is longer than the response's headers say, so they
+	// aren't kept for HEAD requests.
+	if r.Method == http.MethodGet && heads != nil && !banner {
+		heads.store(r, resp)
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if banner || p.reportTrailer {
+		w.Header().Del("Content-Length")
+	}
+	if p.reportTrailer {
+		w.Header().Add("Trailer", reportTrailer)
+	}
+	w.WriteHeader(resp.StatusCode)
+	captured := p.audit.capture(resp)
+	copyStart := time.Now()
+	var out io.Writer = w
+	var fw *flushWriter
+	if d := p.flushDelay(resp); d != 0 {
+		fw = newFlushWriter(w, d)
+		out = fw
+	}
+	if banner {
+		_, err = injectBanner(out, resp.Body, p.banner)
+	} else {
+		_, err = io.Copy(out, resp.Body)
+	}
+	fw.stop()
+	if err != nil {
+		if rs != nil {
+			served, servedCtx = rs.t, rs.ctx
+		}
+		f := &failure{code: codeBody, err: err}
+		switch ctxErr := r.Context().Err(); {
+		case errors.Is(context.Cause(servedCtx), errBodyStall):
+			f.code = codeBodyStall
+		case errors.Is(context.Cause(servedCtx), errAttemptTimeout):
+			f.code = codeTimeout
+		case errors.Is(ctxErr, context.DeadlineExceeded):
+			f.code = codeTimeout
+		case ctxErr != nil:
+			f.code = codeClientAbort
+		}
+		p.fail(served, f)
+	}
+	p.audit.write(r, id, targets[win], resp, captured)
+	timings[win].bodyDone(copyStart)
+	timings[win].record(p.metrics.phase, targets[win], "body")
+	if p.reportTrailer {
+		rt.writeTrailer(w.Header(), timings)
+	}
+}
+
+// outgoing builds the request sent to target t on behalf of r, with the
+// context the WithRequestContext hook makes of ctx.
+func (p *Proxy) outgoing(ctx context.Context, r *http.Request, t *Target) *http.Request {
+	if p.requestContext != nil {
+		ctx = p.requestContext(ctx, r, t)
+	}
+	return outgoing(ctx, r, t)
+}
+
+// outgoing builds the request sent to t on behalf of r with context ctx,
+// as it is for probes and staging copies, which the hook doesn't see.
+func outgoing(ctx context.Context, r *http.Request, t *Target) *http.Request {
+	req := r.Clone(ctx)
+	req.URL = t.join(r.URL)
+	if r.GetBody != nil {
+		req.Body, _ = r.GetBody()
+	}
+	removeProxyHeaders(req.Header)
+	if hasToken(r.Header, "Te", "trailers") {
+		req.Header.Set("Te", "trailers")
+	}
+	if upgrade(r) {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return req
+}
+
+// removeProxyHeaders deletes from h the headers meant for multireq or for
+// the client's connection to it, rather than for a target.
+func removeProxyHeaders(h http.Header) {
+	removeHopHeaders(h)
+	h.Del(traceHeader)
+	h.Del(familyHeader)
+	for _, name := range overrideHeaders {
+		h.Del(name)
+	}
+}
+
+// discard closes the bodies of the n responses still to arrive on results
+// once a race has been decided, counting their targets as having lost, and
+// then the request body they were sent. In mirror mode, m accounts for the
+// mirrors' answers.
+func (p *Proxy) discard(targets []*Target, results <-chan result, n int, body *buffered, m *mirroring) {
+	defer body.close()
+	if m != nil {
+		for _, res := range m.early {
+			p.mirrored(m, targets[res.index], res)
+			if res.err == nil {
+				res.resp.Body.Close()
+			}
+		}
+		if m.done != nil {
+			defer func() {
+				<-m.done
+				p.diffs.record(m.r, m.id, m.answer, m.answers)
+			}()
+		}
+	}
+	for ; n > 0; n-- {
+		res := <-results
+		t := targets[res.index]
+		if m != nil && res.index != 0 {
+			p.mirrored(m, t, res)
+		}
+		if res.err == nil {
+			if p.accepted[res.resp.StatusCode] {
+				p.settle(t, true)
+			} else if res.resp.StatusCode >= 500 {
+				p.settle(t, false)
+			}
+			res.resp.Body.Close()
+		}
+		p.metrics.outcomes.inc(t.String(), "lost")
+	}
+}
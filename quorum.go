@@ -0,0 +1,91 @@
+package multireq
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// agreedHeader lists, in a response decided by a quorum, the targets that
+// returned it.
+const agreedHeader = "X-Multireq-Agreed"
+
+// maxQuorumBody is the largest response body a quorum compares. Every
+// acceptable response is read into memory to be compared.
+const maxQuorumBody = 32 << 20
+
+// WithQuorum answers a request only once k targets have returned the same
+// acceptable response, with the same status and body, sending every
+// request to every target. The client gets the first of those responses,
+// or a 502 if no k targets agree. A k of 1 or less races as usual.
+func WithQuorum(k int) Option {
+	return func(p *Proxy) { p.quorum = k }
+}
+
+// vote tallies the acceptable responses of a race run to a quorum.
+type vote struct {
+	need    int
+	ballots map[[sha256.Size]byte][]int
+	resps   map[int]*http.Response
+}
+
+func newVote(need int) *vote {
+	return &vote{
+		need:    need,
+		ballots: make(map[[sha256.Size]byte][]int),
+		resps:   make(map[int]*http.Response),
+	}
+}
+
+// cast reads the body of resp, the acceptable response of target i, and
+// returns the targets that have now returned the same response if they
+// are a quorum. resp is left with a body of its own to be read again.
+func (v *vote) cast(i int, resp *http.Response) ([]int, error) {
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxQuorumBody+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxQuorumBody {
+		return nil, fmt.Errorf("response body is over %d bytes, too large to compare", maxQuorumBody)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", resp.StatusCode)
+	h.Write(b)
+	key := [sha256.Size]byte(h.Sum(nil))
+	v.ballots[key] = append(v.ballots[key], i)
+	v.resps[i] = resp
+	if group := v.ballots[key]; len(group) >= v.need {
+		return group, nil
+	}
+	return nil, nil
+}
+
+// dissent returns a failure for each target whose acceptable response too
+// few others agreed with.
+func (v *vote) dissent() map[int]*failure {
+	fs := make(map[int]*failure)
+	for _, group := range v.ballots {
+		for _, i := range group {
+			fs[i] = &failure{
+				code:   codeNoQuorum,
+				status: v.resps[i].StatusCode,
+				err:    fmt.Errorf("%d of the %d targets needed returned this response", len(group), v.need),
+			}
+		}
+	}
+	return fs
+}
+
+// writeAgreed names the targets of a quorum in h.
+func writeAgreed(h http.Header, targets []*Target, agreed []int) {
+	names := make([]string, len(agreed))
+	for j, i := range agreed {
+		names[j] = targets[i].String()
+	}
+	h.Set(agreedHeader, strings.Join(names, ", "))
+}
@@ -0,0 +1,21 @@
+package multireq
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// redundancyHeader tells clients how much redundancy served their request,
+// so they can adapt their own retries.
+const redundancyHeader = "X-Multireq-Redundancy"
+
+// writeRedundancy sets redundancyHeader on h for a request raced against
+// raced targets.
+func (p *Proxy) writeRedundancy(h http.Header, raced int) {
+	if !p.redundancy {
+		return
+	}
+	h.Set(redundancyHeader, fmt.Sprintf("raced=%d, healthy=%d, targets=%d",
+		raced, p.healthyTargets(time.Now()), len(p.Targets())))
+}
@@ -0,0 +1,141 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithResume, if on, carries on a winning response to a GET whose target
+// fails partway through its body by asking another target for the rest
+// with a range request, so long as the response has a strong ETag for the
+// other target to match. Off, the client's response is cut short. It is on
+// by default.
+func WithResume(on bool) Option {
+	return func(p *Proxy) { p.resume = on }
+}
+
+// resumption is the body of a winning response, read from whichever target
+// is serving it now.
+type resumption struct {
+	p    *Proxy
+	r    *http.Request
+	etag string
+
+	t    *Target
+	ctx  context.Context
+	stop context.CancelCauseFunc
+	body io.ReadCloser
+
+	// n is how many bytes of the body have been read, and tried the
+	// targets that have served or been asked for it.
+	n     int64
+	tried []*Target
+}
+
+// resumable returns resp's body as a resumption, if resp is a winning
+// answer to r from t that can be carried on from another target.
+func (p *Proxy) resumable(r *http.Request, resp *http.Response, t *Target, ctx context.Context) *resumption {
+	etag := resp.Header.Get("ETag")
+	if !p.resume || r.Method != http.MethodGet || resp.StatusCode != http.StatusOK ||
+		etag == "" || strings.HasPrefix(etag, "W/") || len(p.Targets()) < 2 {
+		return nil
+	}
+	return &resumption{p: p, r: r, etag: etag, t: t, ctx: ctx, body: resp.Body, tried: []*Target{t}}
+}
+
+func (rs *resumption) Read(b []byte) (int, error) {
+	n, err := rs.body.Read(b)
+	rs.n += int64(n)
+	if err == nil || err == io.EOF || rs.r.Context().Err() != nil || !rs.resume(err) {
+		return n, err
+	}
+	return n, nil
+}
+
+func (rs *resumption) Close() error {
+	if rs.stop != nil {
+		defer rs.stop(nil)
+	}
+	return rs.body.Close()
+}
+
+// resume swaps the body for the rest of it from another target, after the
+// one serving it failed with err, and reports whether one had it.
+func (rs *resumption) resume(err error) bool {
+	var candidates []*Target
+	for _, t := range rs.p.Targets() {
+		if !slices.Contains(rs.tried, t) {
+			candidates = append(candidates, t)
+		}
+	}
+	ts, _ := rs.p.eligible(candidates, time.Now())
+	for _, t := range ts {
+		rs.tried = append(rs.tried, t)
+		ctx, stop := context.WithCancelCause(rs.r.Context())
+		body, ferr := rs.fetch(ctx, stop, t)
+		if ferr != nil {
+			stop(nil)
+			rs.p.metrics.resumed.inc(t.String(), "failed")
+			slog.Info("a target couldn't resume a response body", "target", t.String(), "offset", rs.n, "err", ferr)
+			continue
+		}
+		f := &failure{code: codeBody, err: err}
+		if errors.Is(context.Cause(rs.ctx), errBodyStall) {
+			f.code = codeBodyStall
+		}
+		rs.p.fail(rs.t, f)
+		rs.Close()
+		slog.Info("resumed a response body from another target", "from", rs.t.String(), "target", t.String(), "offset", rs.n)
+		rs.p.metrics.resumed.inc(t.String(), "resumed")
+		rs.t, rs.ctx, rs.stop, rs.body = t, ctx, stop, body
+		return true
+	}
+	return false
+}
+
+// fetch asks t for the body from the offset reached, as the same
+// representation, under ctx, which stop cancels.
+func (rs *resumption) fetch(ctx context.Context, stop context.CancelCauseFunc, t *Target) (io.ReadCloser, error) {
+	req := rs.p.outgoing(ctx, rs.r, t)
+	for _, h := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(rs.n, 10)+"-")
+	req.Header.Set("If-Range", rs.etag)
+	if t.attemptTimeout > 0 {
+		expire := time.AfterFunc(t.attemptTimeout, func() { stop(errAttemptTimeout) })
+		context.AfterFunc(ctx, func() { expire.Stop() })
+	}
+	var headers *time.Timer
+	if t.headerTimeout > 0 {
+		headers = time.AfterFunc(t.headerTimeout, func() { stop(errHeaderTimeout) })
+	}
+	err := t.prepare(ctx, req)
+	var resp *http.Response
+	if err == nil {
+		resp, err = t.client.Do(req)
+	}
+	if headers != nil {
+		headers.Stop()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("ETag") != rs.etag ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", rs.n)) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("answered with status %d, ETag %s and Content-Range %q", resp.StatusCode, resp.Header.Get("ETag"), resp.Header.Get("Content-Range"))
+	}
+	if t.bodyStall > 0 {
+		return newStallReader(resp.Body, t.bodyStall, stop), nil
+	}
+	return resp.Body, nil
+}
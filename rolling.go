@@ -0,0 +1,42 @@
+package multireq
+
+import (
+	"sync"
+	"time"
+)
+
+// rollingWindow is the longest span a rollingCounter can sum over.
+const rollingWindow = 5 * time.Minute
+
+// rollingCounter counts events in one second buckets over the last
+// rollingWindow.
+type rollingCounter struct {
+	mu      sync.Mutex
+	counts  [int(rollingWindow / time.Second)]uint64
+	seconds [int(rollingWindow / time.Second)]int64
+}
+
+func (c *rollingCounter) inc(now time.Time) {
+	sec := now.Unix()
+	i := sec % int64(len(c.counts))
+	c.mu.Lock()
+	if c.seconds[i] != sec {
+		c.seconds[i], c.counts[i] = sec, 0
+	}
+	c.counts[i]++
+	c.mu.Unlock()
+}
+
+// sum returns the events counted in the window up to now.
+func (c *rollingCounter) sum(now time.Time, window time.Duration) uint64 {
+	since := now.Unix() - int64(window/time.Second)
+	var n uint64
+	c.mu.Lock()
+	for i, sec := range c.seconds {
+		if sec > since {
+			n += c.counts[i]
+		}
+	}
+	c.mu.Unlock()
+	return n
+}
@@ -0,0 +1,218 @@
+package multireq
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultTTL is how long a secret read from Vault is used before it is read
+// again, unless Vault leases it for some other time.
+const vaultTTL = 5 * time.Minute
+
+// Secret is a credential referred to rather than given inline, so it stays
+// out of flags and the process list. It is read again whenever it is used,
+// or from Vault once its lease is up, so rotating it needs no restart.
+type Secret struct {
+	ref  string
+	read func(ctx context.Context) (string, time.Duration, error)
+
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+// ParseSecret returns the secret ref refers to, which is one of
+//
+//	env:<name>           the environment variable name
+//	file:<path>          the file at path, which only its owner may read
+//	vault:<path>#<field> field of the Vault secret at path, such as
+//	                     secret/data/multireq#client_secret
+//
+// Vault is found at VAULT_ADDR, trusting VAULT_CACERT if it is set, and
+// authenticated to with VAULT_TOKEN or else the token in ~/.vault-token.
+func ParseSecret(ref string) (*Secret, error) {
+	kind, arg, _ := strings.Cut(ref, ":")
+	s := &Secret{ref: ref}
+	switch kind {
+	case "env":
+		if _, ok := os.LookupEnv(arg); !ok {
+			return nil, fmt.Errorf("%s: not set", ref)
+		}
+		s.read = func(context.Context) (string, time.Duration, error) {
+			return os.Getenv(arg), 0, nil
+		}
+	case "file":
+		if _, err := readSecretFile(arg); err != nil {
+			return nil, err
+		}
+		s.read = func(context.Context) (string, time.Duration, error) {
+			v, err := readSecretFile(arg)
+			return v, 0, err
+		}
+	case "vault":
+		path, field, _ := strings.Cut(arg, "#")
+		if path == "" || field == "" {
+			return nil, fmt.Errorf("%s: not of the form vault:<path>#<field>", ref)
+		}
+		v, err := newVault()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ref, err)
+		}
+		s.read = func(ctx context.Context) (string, time.Duration, error) {
+			return v.read(ctx, path, field)
+		}
+	default:
+		return nil, fmt.Errorf("%q is not an env:, file: or vault: secret reference", ref)
+	}
+	return s, nil
+}
+
+// String returns the reference, never the secret.
+func (s *Secret) String() string { return s.ref }
+
+// Value returns the secret's current value. If it can't be read again from
+// Vault, the value read last is used until it can.
+func (s *Secret) Value(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value != "" && time.Now().Before(s.expires) {
+		return s.value, nil
+	}
+	v, ttl, err := s.read(ctx)
+	switch {
+	case err != nil && s.value != "":
+		slog.Warn("reading secret failed; using the value read before", "secret", s.ref, "err", err)
+		return s.value, nil
+	case err != nil:
+		return "", err
+	case v == "":
+		return "", fmt.Errorf("%s is empty", s.ref)
+	}
+	s.value, s.expires = v, time.Now().Add(ttl)
+	return v, nil
+}
+
+// readSecretFile reads a secret from file, refusing it if anyone but its
+// owner can read or write it.
+func readSecretFile(file string) (string, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if perm := fi.Mode().Perm(); perm&0o077 != 0 && runtime.GOOS != "windows" {
+		return "", fmt.Errorf("%s is accessible to other users (mode %04o); it must be 0600 or 0400", file, perm)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// vault reads secrets over Vault's HTTP API.
+type vault struct {
+	addr   string
+	client *http.Client
+}
+
+func newVault() (*vault, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if ca := os.Getenv("VAULT_CACERT"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", ca)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &vault{
+		addr:   strings.TrimSuffix(addr, "/"),
+		client: &http.Client{Transport: tr, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// token returns the Vault token, read afresh each time so that an agent
+// renewing ~/.vault-token is followed.
+func (v *vault) token() (string, error) {
+	if t := os.Getenv("VAULT_TOKEN"); t != "" {
+		return t, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.New("VAULT_TOKEN is not set")
+	}
+	t, err := readSecretFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", fmt.Errorf("VAULT_TOKEN is not set: %s", err)
+	}
+	return t, nil
+}
+
+// read returns field of the secret at path, of either version of the KV
+// secrets engine, and how long it may be used.
+func (v *vault) read(ctx context.Context, path, field string) (string, time.Duration, error) {
+	token, err := v.token()
+	if err != nil {
+		return "", 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("vault: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var secret struct {
+		LeaseDuration int64          `json:"lease_duration"`
+		Data          map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", 0, fmt.Errorf("vault: %s", err)
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", 0, fmt.Errorf("vault: %s has no string field %q", path, field)
+	}
+	ttl := vaultTTL
+	if secret.LeaseDuration > 0 {
+		ttl = time.Duration(secret.LeaseDuration) * time.Second
+	}
+	return value, ttl, nil
+}
@@ -0,0 +1,42 @@
+package multireq
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Selector picks targets by an expression over their labels.
+type Selector struct {
+	src string
+	e   expr
+}
+
+// ParseSelectors parses selector expressions, which are tried in order.
+func ParseSelectors(srcs []string) ([]Selector, error) {
+	var sels []Selector
+	for _, src := range srcs {
+		e, err := parseExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", src, err)
+		}
+		sels = append(sels, Selector{src, e})
+	}
+	return sels, nil
+}
+
+// selectTargets returns the candidates picked for r by the first selector
+// that picks any. If none does, all the candidates are returned.
+func (p *Proxy) selectTargets(r *http.Request, candidates []*Target) []*Target {
+	for _, s := range p.selectors {
+		var ts []*Target
+		for _, t := range candidates {
+			if truthy(s.e.eval(t, r)) {
+				ts = append(ts, t)
+			}
+		}
+		if len(ts) > 0 {
+			return ts
+		}
+	}
+	return candidates
+}
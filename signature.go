@@ -0,0 +1,207 @@
+package multireq
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSignatureTolerance is how far a Stripe style signature's timestamp
+// may be from now, so that a captured request can't be replayed later.
+const defaultSignatureTolerance = 5 * time.Minute
+
+// Signatures check the HMAC signatures of requests under path prefixes,
+// longest prefix first, before they are sent to any target.
+type Signatures []signature
+
+type signature struct {
+	route  string
+	style  string
+	header string
+	secret *Secret
+
+	// For the hmac style, the header's value is prefix followed by the
+	// HMAC of the body, encoded with encode.
+	hash   func() hash.Hash
+	prefix string
+	encode func([]byte) string
+
+	// tolerance is for the stripe style.
+	tolerance time.Duration
+}
+
+// NewSignatures builds signature checks from path prefixes to comma
+// separated settings, which are
+//
+//	style     github, stripe or hmac (the default)
+//	secret    a reference to the shared secret, as for ParseSecret
+//	header    the header carrying the signature; github's and stripe's
+//	          default to X-Hub-Signature-256 and Stripe-Signature
+//
+// and, for the hmac style, which signs the body alone,
+//
+//	hash      sha256 (the default), sha512 or sha1
+//	encoding  hex (the default) or base64
+//	prefix    text before the signature, such as sha256=
+//
+// and, for the stripe style, which signs the timestamp and the body,
+//
+//	tolerance how far the timestamp may be from now, 5m by default
+func NewSignatures(routes map[string]string) (Signatures, error) {
+	var ss Signatures
+	for route, s := range routes {
+		settings, err := ParseLabelList(s)
+		if err != nil {
+			return nil, err
+		}
+		sig := signature{
+			route:     route,
+			style:     settings["style"],
+			header:    settings["header"],
+			hash:      sha256.New,
+			encode:    hex.EncodeToString,
+			tolerance: defaultSignatureTolerance,
+		}
+		if sig.secret, err = secretSetting(settings, "secret"); err != nil {
+			return nil, fmt.Errorf("%s: %s", route, err)
+		}
+		if sig.secret == nil {
+			return nil, fmt.Errorf("%s: secret is required", route)
+		}
+		switch sig.style {
+		case "github":
+			sig.prefix = "sha256="
+			if sig.header == "" {
+				sig.header = "X-Hub-Signature-256"
+			}
+		case "stripe":
+			if sig.header == "" {
+				sig.header = "Stripe-Signature"
+			}
+			if t := settings["tolerance"]; t != "" {
+				if sig.tolerance, err = time.ParseDuration(t); err != nil {
+					return nil, fmt.Errorf("%s: tolerance: %s", route, err)
+				}
+			}
+		case "", "hmac":
+			sig.style = "hmac"
+			if sig.header == "" {
+				return nil, fmt.Errorf("%s: header is required", route)
+			}
+			switch settings["hash"] {
+			case "", "sha256":
+			case "sha512":
+				sig.hash = sha512.New
+			case "sha1":
+				sig.hash = sha1.New
+			default:
+				return nil, fmt.Errorf("%s: unknown hash %q", route, settings["hash"])
+			}
+			switch settings["encoding"] {
+			case "", "hex":
+			case "base64":
+				sig.encode = base64.StdEncoding.EncodeToString
+			default:
+				return nil, fmt.Errorf("%s: unknown encoding %q", route, settings["encoding"])
+			}
+			sig.prefix = settings["prefix"]
+		default:
+			return nil, fmt.Errorf("%s: unknown style %q", route, sig.style)
+		}
+		ss = append(ss, sig)
+	}
+	slices.SortFunc(ss, func(a, b signature) int { return len(b.route) - len(a.route) })
+	return ss, nil
+}
+
+// WithSignatures rejects requests under the prefixes of ss that aren't
+// signed as they require.
+func WithSignatures(ss Signatures) Option {
+	return func(p *Proxy) { p.signatures = ss }
+}
+
+// verify answers r itself with a 401, and returns false, if r's route needs
+// a signature and body doesn't have a good one.
+func (p *Proxy) verify(w http.ResponseWriter, r *http.Request, body *buffered) bool {
+	for _, s := range p.signatures {
+		if !strings.HasPrefix(r.URL.Path, s.route) {
+			continue
+		}
+		err := s.check(r, body, time.Now())
+		if err == nil {
+			return true
+		}
+		p.metrics.unsigned.inc(s.route)
+		p.errorPages.write(w, r, http.StatusUnauthorized, errorBody{Error: err.Error()})
+		return false
+	}
+	return true
+}
+
+func (s *signature) check(r *http.Request, body *buffered, now time.Time) error {
+	got := r.Header.Get(s.header)
+	if got == "" {
+		return fmt.Errorf("no %s header", s.header)
+	}
+	secret, err := s.secret.Value(r.Context())
+	if err != nil {
+		return errors.New("signature can't be checked")
+	}
+	if s.style != "stripe" {
+		if !hmac.Equal([]byte(got), []byte(s.prefix+s.encode(s.sum(secret, body)))) {
+			return fmt.Errorf("bad signature in %s", s.header)
+		}
+		return nil
+	}
+
+	var ts string
+	var sigs []string
+	for _, kv := range strings.Split(got, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("no timestamp in %s", s.header)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > s.tolerance || d < -s.tolerance {
+		return fmt.Errorf("signature timestamp in %s is more than %s from now", s.header, s.tolerance)
+	}
+	want := hex.EncodeToString(s.sum(secret, body, ts, "."))
+	for _, v := range sigs {
+		if hmac.Equal([]byte(v), []byte(want)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad signature in %s", s.header)
+}
+
+// sum returns the HMAC of before followed by the body.
+func (s *signature) sum(secret string, body *buffered, before ...string) []byte {
+	mac := hmac.New(s.hash, []byte(secret))
+	for _, b := range before {
+		io.WriteString(mac, b)
+	}
+	if body != nil {
+		rd, _ := body.open()
+		io.Copy(mac, rd)
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,64 @@
+package multireq
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SourcePool binds outgoing connections to a set of local addresses, handing
+// them out in round robin order.
+type SourcePool struct {
+	addrs []net.IP
+	next  atomic.Uint32
+}
+
+// ParseSourcePool reads a comma separated list of local IPs or interface
+// names. An interface contributes all of its unicast addresses.
+func ParseSourcePool(s string) (*SourcePool, error) {
+	var p SourcePool
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if ip := net.ParseIP(f); ip != nil {
+			p.addrs = append(p.addrs, ip)
+			continue
+		}
+		ifi, err := net.InterfaceByName(f)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP nor an interface: %s", f, err)
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.IsGlobalUnicast() {
+				p.addrs = append(p.addrs, ipn.IP)
+			}
+		}
+	}
+	if len(p.addrs) == 0 {
+		return nil, fmt.Errorf("no usable source addresses in %q", s)
+	}
+	return &p, nil
+}
+
+func (p *SourcePool) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ip := p.addrs[int(p.next.Add(1)-1)%len(p.addrs)]
+	d := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip},
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	// Only resolve the target to addresses of the same family as the
+	// source, or the bind would fail.
+	if ip.To4() != nil {
+		network = "tcp4"
+	} else {
+		network = "tcp6"
+	}
+	return d.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package multireq
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const spoolLock = ".lock"
+
+// lockSpool opens the spool's lock file without locking it: elsewhere than
+// on unix, nothing stops two processes delivering from one spool.
+func lockSpool(dir string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, spoolLock), os.O_RDWR|os.O_CREATE, 0o600)
+}
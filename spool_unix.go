@@ -0,0 +1,31 @@
+//go:build unix
+
+package multireq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// spoolLock is the file in a delivery spool that the process delivering
+// from it holds an exclusive lock on.
+const spoolLock = ".lock"
+
+// lockSpool takes the lock on the spool in dir, which is released when the
+// file returned is closed or the process exits.
+func lockSpool(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, spoolLock), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrSpoolInUse
+		}
+		return nil, err
+	}
+	return f, nil
+}
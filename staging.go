@@ -0,0 +1,136 @@
+package multireq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxStagingBody is the largest request body copied to staging. Requests
+// with larger bodies aren't copied.
+const maxStagingBody = 1 << 20
+
+// Staging sends a sample of live traffic to a group of targets of its own,
+// a staging deployment typically, apart from those raced. Copies are sent
+// in the background once a request is sampled, and nothing waits for their
+// answers, which are only counted: the client's response never depends on
+// staging.
+type Staging struct {
+	targets []*Target
+	percent float64
+
+	// rate caps the requests copied per second, if set, and inFlight
+	// those unanswered at once.
+	rate     *tokenBucket
+	inFlight chan struct{}
+
+	ctx  context.Context
+	stop context.CancelFunc
+
+	sent, skipped *metricVec
+}
+
+// NewStaging copies percent of requests to every one of targets, at most
+// rate a second, or any number if rate is zero, and with at most inFlight
+// copies unanswered at once. A request sampled while over either cap isn't
+// copied.
+func NewStaging(targets []*Target, percent, rate float64, inFlight int) (*Staging, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("no staging targets")
+	}
+	if percent <= 0 || percent > 100 {
+		return nil, errors.New("percentage must be over 0 and at most 100")
+	}
+	if rate < 0 || inFlight <= 0 {
+		return nil, errors.New("caps must be positive")
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	s := &Staging{targets: targets, percent: percent, inFlight: make(chan struct{}, inFlight), ctx: ctx, stop: stop}
+	if rate > 0 {
+		s.rate = newTokenBucket(rate)
+	}
+	return s, nil
+}
+
+// WithStaging copies a sample of requests to s's targets.
+func WithStaging(s *Staging) Option {
+	return func(p *Proxy) { p.staging = s }
+}
+
+func (s *Staging) close() {
+	if s != nil {
+		s.stop()
+	}
+}
+
+// copy sends r, with its buffered body, to every staging target in the
+// background, if r is sampled and the caps allow it.
+func (s *Staging) copy(r *http.Request, body *buffered) {
+	if s == nil || rand.Float64()*100 >= s.percent {
+		return
+	}
+	var b []byte
+	if body != nil {
+		if body.size > maxStagingBody {
+			s.skipped.inc("body")
+			return
+		}
+		rd, err := body.open()
+		if err == nil {
+			b, err = io.ReadAll(rd)
+			rd.Close()
+		}
+		if err != nil {
+			s.skipped.inc("body")
+			return
+		}
+	}
+	if s.rate != nil {
+		if ok, _ := s.rate.take(time.Now()); !ok {
+			s.skipped.inc("rate")
+			return
+		}
+	}
+	for _, t := range s.targets {
+		select {
+		case s.inFlight <- struct{}{}:
+		default:
+			s.skipped.inc("in_flight")
+			continue
+		}
+		req := outgoing(s.ctx, r, t)
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.GetBody = nil
+		req.RequestURI = ""
+		go func() {
+			defer func() { <-s.inFlight }()
+			s.send(t, req)
+		}()
+	}
+}
+
+// send sends req to staging target t, counting its answer.
+func (s *Staging) send(t *Target, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), max(t.headerTimeout, t.attemptTimeout, time.Minute))
+	defer cancel()
+	req = req.WithContext(ctx)
+	err := t.prepare(ctx, req)
+	var resp *http.Response
+	if err == nil {
+		resp, err = t.client.Do(req)
+	}
+	if err != nil {
+		if s.ctx.Err() == nil {
+			s.sent.inc(t.String(), classify(context.Background(), err).code)
+		}
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	s.sent.inc(t.String(), strconv.Itoa(resp.StatusCode))
+}
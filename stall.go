@@ -0,0 +1,41 @@
+package multireq
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Causes for cancelling an upstream request that is taking too long, told
+// apart so they can be reported separately: a target that never starts
+// answering is broken differently from one that stops part way.
+var (
+	errHeaderTimeout  = errors.New("no response headers in time")
+	errAttemptTimeout = errors.New("response not complete in time")
+	errBodyStall      = errors.New("response body stalled")
+)
+
+// stallReader cancels an upstream request, with errBodyStall, if its body
+// goes d without a read returning.
+type stallReader struct {
+	io.ReadCloser
+	d     time.Duration
+	timer *time.Timer
+}
+
+func newStallReader(body io.ReadCloser, d time.Duration, cancel context.CancelCauseFunc) *stallReader {
+	return &stallReader{body, d, time.AfterFunc(d, func() { cancel(errBodyStall) })}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	s.timer.Reset(s.d)
+	n, err := s.ReadCloser.Read(p)
+	s.timer.Reset(s.d)
+	return n, err
+}
+
+func (s *stallReader) Close() error {
+	s.timer.Stop()
+	return s.ReadCloser.Close()
+}
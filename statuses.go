@@ -0,0 +1,62 @@
+package multireq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A StatusSet is a set of HTTP response statuses.
+type StatusSet map[int]bool
+
+// ParseStatusSet parses a comma separated list of statuses, such as 404,
+// and classes of them, such as 5xx.
+func ParseStatusSet(s string) (StatusSet, error) {
+	set := StatusSet{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if class, ok := strings.CutSuffix(strings.ToLower(f), "xx"); ok {
+			n, err := strconv.Atoi(class)
+			if err != nil || n < 1 || n > 5 {
+				return nil, fmt.Errorf("%q is not a class of statuses, such as 5xx", f)
+			}
+			for status := n * 100; status < n*100+100; status++ {
+				set[status] = true
+			}
+			continue
+		}
+		status, err := strconv.Atoi(f)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("%q is not a status", f)
+		}
+		set[status] = true
+	}
+	return set, nil
+}
+
+// WithStatuses lets a target's response win a race if its status is in
+// accept but not in failOn; responses with any other status fail. Either
+// may be nil: by default 200, 302 and 304 are accepted, and none are
+// failed on.
+func WithStatuses(accept, failOn StatusSet) Option {
+	return func(p *Proxy) {
+		if accept == nil {
+			accept = allowedCodes
+		}
+		p.accepted = StatusSet{}
+		for status := range accept {
+			if !failOn[status] {
+				p.accepted[status] = true
+			}
+		}
+	}
+}
+
+// Acceptable reports whether a target's response with status can win one
+// of p's races.
+func (p *Proxy) Acceptable(status int) bool {
+	return p.accepted[status]
+}
@@ -0,0 +1,81 @@
+package multireq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// statusSchema is the version of the /status.json document. It changes only
+// when a field is removed or changes meaning; fields may be added without a
+// new version.
+const statusSchema = 1
+
+// started is when the process started, for uptime.
+var started = time.Now()
+
+// configHash identifies the arguments multireq was started with, so tooling
+// can tell whether two processes are configured alike.
+func configHash() string {
+	sum := sha256.Sum256([]byte(strings.Join(os.Args[1:], "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// windowCounts is a count of events over the last minute and five minutes.
+type windowCounts struct {
+	OneMinute   uint64 `json:"1m"`
+	FiveMinutes uint64 `json:"5m"`
+}
+
+func windowed(c *rollingCounter, now time.Time) windowCounts {
+	return windowCounts{c.sum(now, time.Minute), c.sum(now, 5*time.Minute)}
+}
+
+// serveStatus serves a summary of the proxy for tooling as JSON.
+func (p *Proxy) serveStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	status := struct {
+		Schema        int           `json:"schema"`
+		Version       string        `json:"version"`
+		Started       time.Time     `json:"started"`
+		UptimeSeconds int64         `json:"uptime_seconds"`
+		ConfigHash    string        `json:"config_hash"`
+		Targets       []targetState `json:"targets"`
+		Races         struct {
+			InFlight int64        `json:"in_flight"`
+			Won      windowCounts `json:"won"`
+			Failed   windowCounts `json:"failed"`
+		} `json:"races"`
+	}{
+		Schema:        statusSchema,
+		Version:       Version,
+		Started:       started,
+		UptimeSeconds: int64(now.Sub(started) / time.Second),
+		ConfigHash:    configHash(),
+		Targets:       p.states(now),
+	}
+	status.Races.InFlight = p.inFlight.Load()
+	status.Races.Won = windowed(&p.won, now)
+	status.Races.Failed = windowed(&p.failed, now)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
+
+// raceDone counts a race that started at start and ended with result, won
+// or failed, for the experiment variant v if there is one.
+func (p *Proxy) raceDone(v *variant, result string, start time.Time) {
+	p.experiment.done(v, result, start)
+	p.metrics.races.inc(result)
+	if result == "won" {
+		p.won.inc(time.Now())
+	} else {
+		p.failed.inc(time.Now())
+	}
+}
@@ -0,0 +1,59 @@
+package multireq
+
+import (
+	"cmp"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// stick orders targets for a request carrying the proxy's affinity header,
+// first the target its value hashes to and then the ones it would move to
+// should that fail. It reports whether r has the header: if so, only the
+// first target is raced to begin with.
+//
+// Targets are ranked by rendezvous hashing, so a target joining or leaving
+// moves only the keys it gains or loses. Healthy targets rank above
+// unhealthy ones, so a failing primary's keys move until it recovers.
+func (p *Proxy) stick(r *http.Request, targets []*Target) ([]*Target, bool) {
+	if p.affinity == "" || len(targets) < 2 {
+		return targets, false
+	}
+	key := r.Header.Get(p.affinity)
+	if key == "" {
+		return targets, false
+	}
+	now := time.Now()
+	scores := make(map[*Target]uint64, len(targets))
+	for _, t := range targets {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(t.url.String()))
+		scores[t] = mix(h.Sum64())
+	}
+	ts := slices.Clone(targets)
+	slices.SortFunc(ts, func(a, b *Target) int {
+		ha, hb := a.healthy(now), b.healthy(now)
+		if ha != hb {
+			if ha {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(scores[b], scores[a])
+	})
+	return ts, true
+}
+
+// mix spreads every bit of h over all the others, as FNV on its own does
+// not for inputs differing only at the end, as target URLs usually do.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
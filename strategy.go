@@ -0,0 +1,60 @@
+package multireq
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+)
+
+// Strategy decides which of the targets available for a request it is
+// sent to, and when.
+type Strategy interface {
+	// Plan returns the targets to try for r, in the order to try them, and
+	// how many of the first of them to send r to at once. The rest are
+	// sent r one at a time, each only once one before it has failed.
+	Plan(r *http.Request, targets []*Target) ([]*Target, int)
+}
+
+// NewStrategy returns the strategy called name:
+//
+//	race      send every request to every target, the first acceptable
+//	          answer winning (the default)
+//	fallback  send each request to the targets in the order they are
+//	          given, moving on to the next only when one fails
+//	random    send each request to one target, picked at random
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", "race":
+		return raceStrategy{}, nil
+	case "fallback":
+		return fallbackStrategy{}, nil
+	case "random":
+		return randomStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q, want race, fallback or random", name)
+}
+
+// WithStrategy sends requests to targets as s plans. Requests to targets
+// chosen by an override, a pinned connection or an affinity header, and
+// mirrored requests, are sent as those require instead.
+func WithStrategy(s Strategy) Option {
+	return func(p *Proxy) { p.strategy = s }
+}
+
+type raceStrategy struct{}
+
+func (raceStrategy) Plan(_ *http.Request, targets []*Target) ([]*Target, int) {
+	return targets, len(targets)
+}
+
+type fallbackStrategy struct{}
+
+func (fallbackStrategy) Plan(_ *http.Request, targets []*Target) ([]*Target, int) {
+	return targets, 1
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Plan(_ *http.Request, targets []*Target) ([]*Target, int) {
+	return []*Target{targets[rand.IntN(len(targets))]}, 1
+}
@@ -0,0 +1,115 @@
+package multireq
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Target is one of the backends every request is raced against.
+type Target struct {
+	url *url.URL
+
+	// name, if set, identifies the target in place of its URL: in logs,
+	// metrics, the admin API and override headers.
+	name string
+
+	// labels describe the target, as region, version or tier might.
+	labels map[string]string
+
+	// userAgent replaces the client's User-Agent on requests to this
+	// target, unless it is empty.
+	userAgent string
+
+	transport *http.Transport
+	client    *http.Client
+
+	// roundTripper, if set, sends the target's requests in place of
+	// transport, whose connection settings then don't apply.
+	roundTripper http.RoundTripper
+
+	// headerTimeout, if set, fails requests to the target that have no
+	// response headers this long after being sent.
+	headerTimeout time.Duration
+
+	// attemptTimeout, if set, fails requests to the target that haven't
+	// been answered in full this long after being sent.
+	attemptTimeout time.Duration
+
+	// bodyStall, if set, fails a winning response whose body goes this
+	// long without delivering anything.
+	bodyStall time.Duration
+
+	// preflights run before each request to the target is sent.
+	preflights []Preflight
+
+	// dns, if set, resolves the target's host in place of the transport's
+	// dialer.
+	dns *DNSCache
+
+	// maxAge, if set, is the oldest a response may be, judging by its
+	// Date and Age headers, before it is rejected as coming from a stale
+	// cache.
+	maxAge time.Duration
+
+	// pace, if set, limits the rate of requests sent to the target.
+	pace *tokenBucket
+
+	// sessionCache is how many TLS sessions are kept for resuming
+	// connections to the target.
+	sessionCache int
+
+	// prewarm is how many connections to open to the target on startup.
+	prewarm int
+
+	// backoffUntil is when, in unix nanoseconds, the target may be raced
+	// again after asking us to back off with Retry-After.
+	backoffUntil atomic.Int64
+
+	// latency is a moving average of how long the target takes to start
+	// responding, in nanoseconds.
+	latency atomic.Int64
+
+	// latencies holds the same times over the last minute, for
+	// percentiles.
+	latencies latencyHistogram
+
+	// heatmap holds them by the hour over the last week.
+	heatmap latencyHeatmap
+
+	// arm is what the target has learned from hedged races.
+	arm arm
+
+	// attempts and attemptErrors count the target's recent attempts, and
+	// those that failed, against its error budget and circuit breaker.
+	attempts, attemptErrors rollingCounter
+
+	// shadowed is set while the target is over its error budget.
+	shadowed atomic.Bool
+
+	// circuit is the state of the target's circuit breaker.
+	circuit circuit
+
+	// failing is set while the target's most recent attempt failed for a
+	// reason of its own.
+	failing atomic.Bool
+
+	// checksFailing counts the synthetic checks failing on the target, and
+	// evicted those that have failed it enough times in a row to take it
+	// out of races.
+	checksFailing, evicted atomic.Int64
+
+	// draining is set while the target is kept out of new races through
+	// the admin API, and removed is closed once it is no longer a target.
+	draining atomic.Bool
+	removed  chan struct{}
+}
+
+// String returns the target's name, or its URL if it has none.
+func (t *Target) String() string {
+	if t.name != "" {
+		return t.name
+	}
+	return t.url.String()
+}
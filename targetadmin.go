@@ -0,0 +1,205 @@
+package multireq
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// WithTargetOptions configures the targets added through the admin API, as
+// NewTarget would with opts.
+func WithTargetOptions(opts ...TargetOption) Option {
+	return func(p *Proxy) { p.targetOptions = opts }
+}
+
+// WithAdminToken lets clients of the admin API that present token as a
+// bearer token add, drain and remove targets. Without a token, targets
+// can't be changed at runtime.
+func WithAdminToken(token *Secret) Option {
+	return func(p *Proxy) { p.adminToken = token }
+}
+
+// AddTarget adds t to the targets requests are raced across. It joins
+// races at once, and is run the proxy's checks if they have started. Events
+// for delivery aren't delivered to it until the proxy is restarted.
+func (p *Proxy) AddTarget(t *Target) error {
+	if t.url.Scheme != "http" && t.url.Scheme != "https" {
+		return fmt.Errorf("target %s: scheme must be http or https", t)
+	}
+	if t.url.Host == "" {
+		return fmt.Errorf("target %s: missing host", t)
+	}
+	p.targetsMu.Lock()
+	defer p.targetsMu.Unlock()
+	old := p.Targets()
+	for _, o := range old {
+		if o.url.String() == t.url.String() {
+			return fmt.Errorf("target %s: already a target", t)
+		}
+		if t.name != "" && (o.name == t.name || o.url.String() == t.name) {
+			return fmt.Errorf("target %s: name %s is already taken", t, t.name)
+		}
+		if o.name != "" && o.name == t.url.String() {
+			return fmt.Errorf("target %s: already the name of %s", t, o.url.String())
+		}
+	}
+	ts := append(slices.Clone(old), t)
+	p.targets.Store(&ts)
+	p.metrics.describeOne(t)
+	if cs := p.checks; cs != nil && cs.ctx != nil {
+		for _, c := range cs.checks {
+			go p.runCheck(cs.ctx, c, t)
+		}
+	}
+	if t.prewarm > 0 {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+			defer cancel()
+			slog.Info("prewarmed connections", "target", t.String(), "connections", t.warm(ctx), "wanted", t.prewarm)
+		}()
+	}
+	slog.Info("added a target", "target", t.String())
+	return nil
+}
+
+// DrainTarget stops or, if drain is false, resumes sending new requests to
+// the target with the given name or URL. Requests it is already serving
+// are left to finish.
+func (p *Proxy) DrainTarget(name string, drain bool) error {
+	t := p.lookup(name)
+	if t == nil {
+		return fmt.Errorf("%s is not a target", name)
+	}
+	if t.draining.Swap(drain) != drain {
+		slog.Info("draining target", "target", t.String(), "draining", drain)
+	}
+	return nil
+}
+
+// RemoveTarget drains the target with the given name or URL and takes it
+// out of the proxy's targets. The primary and the last target can't be
+// removed. Events queued for delivery to it become dead letters.
+func (p *Proxy) RemoveTarget(name string) error {
+	p.targetsMu.Lock()
+	defer p.targetsMu.Unlock()
+	old := p.Targets()
+	i := slices.IndexFunc(old, func(t *Target) bool { return t.name == name || t.url.String() == name })
+	switch {
+	case i < 0:
+		return fmt.Errorf("%s is not a target", name)
+	case old[i] == p.primary:
+		return fmt.Errorf("%s is the primary", name)
+	case len(old) == 1:
+		return errors.New("the last target can't be removed")
+	}
+	t := old[i]
+	t.draining.Store(true)
+	ts := slices.Delete(slices.Clone(old), i, i+1)
+	p.targets.Store(&ts)
+	close(t.removed)
+	p.deliveries.remove(t)
+	// Connections still in use time out once idle.
+	t.client.CloseIdleConnections()
+	slog.Info("removed a target", "target", t.String())
+	return nil
+}
+
+// authorized reports whether r may change the proxy's targets, answering
+// it if not.
+func (p *Proxy) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if p.adminToken == nil {
+		http.Error(w, "targets can't be changed without an admin token", http.StatusForbidden)
+		return false
+	}
+	token, err := p.adminToken.Value(r.Context())
+	if err != nil {
+		slog.Error("reading the admin token", "err", err)
+		http.Error(w, "the admin token can't be read", http.StatusInternalServerError)
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="multireq"`)
+		http.Error(w, "a valid admin token is needed", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// serveTargets serves the state of every target as JSON. POST adds a
+// target, given by the url form value with optional name and labels, and
+// DELETE removes the one named by the target form value.
+func (p *Proxy) serveTargets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		p.targetStates(w, r)
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.authorized(w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := p.RemoveTarget(r.FormValue("target")); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	u, err := url.Parse(r.FormValue("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := slices.Clone(p.targetOptions)
+	if name := r.FormValue("name"); name != "" {
+		opts = append(opts, WithName(name))
+	}
+	if s := r.FormValue("labels"); s != "" {
+		labels, err := ParseLabelList(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, WithLabels(labels))
+	}
+	t := NewTarget(u, opts...)
+	if err := p.AddTarget(t); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p.state(t, time.Now()))
+}
+
+// serveDrain drains, on POST /targets/drain, or resumes, on POST
+// /targets/undrain, the target named by the target form value.
+func (p *Proxy) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.authorized(w, r) {
+		return
+	}
+	if err := p.DrainTarget(r.FormValue("target"), r.URL.Path == "/targets/drain"); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package multireq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// testRace is what POST /test-race is asked to race, the request a client
+// would send.
+type testRace struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// testRaceKey marks the context of a test race, which is always a full
+// race.
+type testRaceKey struct{}
+
+// testReport is what became of a test race.
+type testReport struct {
+	Status     int           `json:"status"`
+	Header     http.Header   `json:"header"`
+	BodyBytes  int64         `json:"body_bytes"`
+	DurationMS float64       `json:"duration_ms"`
+	Targets    []targetTrace `json:"targets"`
+}
+
+// serveTestRace races the request POSTed to it as JSON against the current
+// targets, as though a client had sent it to the proxy, and answers with
+// the response's status, headers and size and each target's outcome and
+// timings. It is a full race, skipping the caches and the strategy. It
+// takes the admin token: the race is real, and reaches the targets, the
+// logs and the metrics like any other.
+func (p *Proxy) serveTestRace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.authorized(w, r) {
+		return
+	}
+	spec := testRace{Method: http.MethodGet, Path: "/"}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&spec); err != nil {
+		http.Error(w, fmt.Sprintf("the request to race must be JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(spec.Path, "/") {
+		http.Error(w, "path must start with /", http.StatusBadRequest)
+		return
+	}
+	ctx := context.WithValue(r.Context(), testRaceKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, spec.Method, spec.Path, strings.NewReader(spec.Body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if spec.Header != nil {
+		req.Header = spec.Header
+	}
+	req.Header.Set(traceHeader, "1")
+	req.Host, req.RemoteAddr, req.RequestURI = spec.Host, r.RemoteAddr, spec.Path
+
+	rec := &recorder{header: make(http.Header)}
+	start := time.Now()
+	p.ServeHTTP(rec, req)
+	report := testReport{
+		Status:     rec.status,
+		Header:     rec.header,
+		BodyBytes:  rec.bytes,
+		DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if trace := rec.header.Get(traceHeader); trace != "" {
+		json.Unmarshal([]byte(trace), &report.Targets)
+		rec.header.Del(traceHeader)
+	}
+	slog.Info("ran a test race", "method", spec.Method, "path", spec.Path, "status", report.Status)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// recorder is the response writer of a test race. It keeps the headers and
+// counts the body.
+type recorder struct {
+	header http.Header
+	status int
+	bytes  int64
+}
+
+func (w *recorder) Header() http.Header {
+	return w.header
+}
+
+func (w *recorder) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.bytes += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,41 @@
+package multireq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// tlsConfig returns the TLS configuration of t's connections, creating it
+// if need be.
+func (t *Target) tlsConfig() *tls.Config {
+	if t.transport.TLSClientConfig == nil {
+		t.transport.TLSClientConfig = &tls.Config{}
+	}
+	return t.transport.TLSClientConfig
+}
+
+// WithRootCAs verifies the target's certificate against pool rather than
+// the system's roots.
+func WithRootCAs(pool *x509.CertPool) TargetOption {
+	return func(t *Target) { t.tlsConfig().RootCAs = pool }
+}
+
+// WithInsecureSkipVerify accepts any certificate from the target, which
+// leaves its connections open to interception.
+func WithInsecureSkipVerify(skip bool) TargetOption {
+	return func(t *Target) { t.tlsConfig().InsecureSkipVerify = skip }
+}
+
+// WithServerName sends name as the target's SNI and verifies its
+// certificate against it, in place of the URL's host.
+func WithServerName(name string) TargetOption {
+	return func(t *Target) { t.tlsConfig().ServerName = name }
+}
+
+// setsTLS reports whether t has TLS settings of its own, which an http
+// target would ignore.
+func (t *Target) setsTLS() bool {
+	c := t.transport.TLSClientConfig
+	return c != nil && (c.RootCAs != nil || c.InsecureSkipVerify || c.ServerName != "" ||
+		c.MinVersion != 0 || c.CipherSuites != nil || c.CurvePreferences != nil)
+}
@@ -0,0 +1,133 @@
+package multireq
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TLSPolicy limits the protocol versions, cipher suites and key exchanges a
+// TLS connection may use. Zero fields leave Go's defaults in place.
+type TLSPolicy struct {
+	MinVersion uint16
+
+	// CipherSuites apply to TLS 1.2 and earlier; TLS 1.3 suites are not
+	// configurable.
+	CipherSuites []uint16
+
+	Curves []tls.CurveID
+}
+
+// tlsProfiles follow Mozilla's server side TLS recommendations, less what
+// crypto/tls doesn't implement, such as DHE.
+var tlsProfiles = map[string]TLSPolicy{
+	"modern": {MinVersion: tls.VersionTLS13},
+	"intermediate": {
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: intermediateSuites,
+	},
+	"old": {
+		MinVersion: tls.VersionTLS10,
+		CipherSuites: append(slices.Clone(intermediateSuites),
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		),
+	},
+	// fips allows only FIPS 140-3 approved algorithms, and needs a binary
+	// running in FIPS 140-3 mode besides.
+	"fips": {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		Curves: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	},
+}
+
+var intermediateSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// NewTLSPolicy returns the policy of profile, which is modern,
+// intermediate, old, fips or "" for Go's defaults, with its minimum version
+// replaced by minVersion, such as 1.2, and its cipher suites by ciphers,
+// named as in crypto/tls, if they are given.
+func NewTLSPolicy(profile, minVersion string, ciphers []string) (*TLSPolicy, error) {
+	var p TLSPolicy
+	if profile != "" {
+		base, ok := tlsProfiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS profile %q, want modern, intermediate, old or fips", profile)
+		}
+		if profile == "fips" && !fips140.Enabled() {
+			return nil, errors.New("the fips TLS profile needs FIPS 140-3 mode; build with -tags fips or run with GODEBUG=fips140=on")
+		}
+		p = base
+	}
+	if minVersion != "" {
+		v, ok := map[string]uint16{
+			"1.0": tls.VersionTLS10,
+			"1.1": tls.VersionTLS11,
+			"1.2": tls.VersionTLS12,
+			"1.3": tls.VersionTLS13,
+		}[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, want 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		p.MinVersion = v
+	}
+	if len(ciphers) > 0 {
+		byName := make(map[string]uint16)
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			byName[s.Name] = s.ID
+		}
+		p.CipherSuites = nil
+		for _, name := range ciphers {
+			id, ok := byName[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			p.CipherSuites = append(p.CipherSuites, id)
+		}
+	}
+	return &p, nil
+}
+
+// Apply restricts c to the policy.
+func (p *TLSPolicy) Apply(c *tls.Config) {
+	if p.MinVersion != 0 {
+		c.MinVersion = p.MinVersion
+	}
+	if p.CipherSuites != nil {
+		c.CipherSuites = p.CipherSuites
+	}
+	if p.Curves != nil {
+		c.CurvePreferences = p.Curves
+	}
+}
+
+// WithTLSPolicy restricts the target's connections to p.
+func WithTLSPolicy(p *TLSPolicy) TargetOption {
+	return func(t *Target) { p.Apply(t.tlsConfig()) }
+}
@@ -0,0 +1,32 @@
+package multireq
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"strconv"
+)
+
+// WithTLSSessionCache keeps up to size TLS sessions to resume with the
+// target, saving a round trip and the key exchange on new connections. A
+// size of zero turns resumption off.
+func WithTLSSessionCache(size int) TargetOption {
+	return func(t *Target) {
+		t.tlsConfig().ClientSessionCache = nil
+		if size > 0 {
+			t.tlsConfig().ClientSessionCache = tls.NewLRUClientSessionCache(size)
+		}
+		t.sessionCache = size
+	}
+}
+
+// tlsTrace counts the target's TLS handshakes by whether they resumed a
+// session.
+func (p *Proxy) tlsTrace(t *Target) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				p.metrics.handshakes.inc(t.String(), strconv.FormatBool(state.DidResume))
+			}
+		},
+	}
+}
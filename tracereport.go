@@ -0,0 +1,116 @@
+package multireq
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// traceHeader is sent by a client to ask for the phase timings of every
+// target, which come back in the same response header.
+const traceHeader = "X-Multireq-Trace"
+
+// reportTrailer carries the trace of a race once the response body has
+// been sent, for proxies built WithReportTrailer.
+const reportTrailer = "Multireq-Report"
+
+// WithReportTrailer, if on, ends every response the proxy passes on with a
+// Multireq-Report trailer: the trace of its race, timed to the end of the
+// body. Responses with a trailer are sent without a Content-Length.
+func WithReportTrailer(on bool) Option {
+	return func(p *Proxy) { p.reportTrailer = on }
+}
+
+// raceTrace collects what happened to each target during one race. Its
+// methods do nothing on a nil receiver, so callers need not check whether
+// tracing was asked for.
+type raceTrace struct {
+	targets []targetTrace
+
+	// header is set if the client asked for the trace in a response
+	// header, rather than it being kept only for the decision log.
+	header bool
+}
+
+type targetTrace struct {
+	Target  string             `json:"target"`
+	Outcome string             `json:"outcome"`
+	Status  int                `json:"status,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	Phases  map[string]float64 `json:"phases_ms"`
+}
+
+// newRaceTrace returns a trace for r, or nil if r didn't ask for one and
+// there is no decision or access log to keep it for. Only a trusted client
+// may ask for one, the trace naming every target and how it failed.
+func newRaceTrace(r *http.Request, targets []*Target, trusted, logged bool) *raceTrace {
+	header := trusted && r.Header.Get(traceHeader) == "1"
+	if !header && !logged {
+		return nil
+	}
+	rt := &raceTrace{targets: make([]targetTrace, len(targets)), header: header}
+	for i, t := range targets {
+		rt.targets[i] = targetTrace{Target: t.String(), Outcome: "pending"}
+	}
+	return rt
+}
+
+func (rt *raceTrace) outcome(i int, outcome string, status int, err error) {
+	if rt == nil {
+		return
+	}
+	rt.targets[i].Outcome = outcome
+	rt.targets[i].Status = status
+	if err != nil {
+		rt.targets[i].Error = err.Error()
+	}
+}
+
+// trim drops all but the first n targets, the others having never been
+// sent the request.
+func (rt *raceTrace) trim(n int) {
+	if rt == nil {
+		return
+	}
+	rt.targets = rt.targets[:n]
+}
+
+// write fills in the phases measured so far, and sets the trace header on h
+// if the client asked for it.
+func (rt *raceTrace) write(h http.Header, timings []*phases) {
+	if rt == nil {
+		return
+	}
+	rt.fill(timings)
+	if !rt.header {
+		return
+	}
+	b, err := json.Marshal(rt.targets)
+	if err != nil {
+		return
+	}
+	h.Set(traceHeader, string(b))
+}
+
+// writeTrailer fills in the phases measured by now, the body's among them,
+// and sets the report trailer on h.
+func (rt *raceTrace) writeTrailer(h http.Header, timings []*phases) {
+	if rt == nil {
+		return
+	}
+	rt.fill(timings)
+	b, err := json.Marshal(rt.targets)
+	if err != nil {
+		return
+	}
+	h.Set(reportTrailer, string(b))
+}
+
+func (rt *raceTrace) fill(timings []*phases) {
+	for i, ph := range timings {
+		rt.targets[i].Phases = make(map[string]float64)
+		for name, d := range ph.snapshot() {
+			rt.targets[i].Phases[name] = float64(d) / float64(time.Millisecond)
+		}
+	}
+}
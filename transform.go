@@ -0,0 +1,345 @@
+package multireq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// transformLine is the longest line a regular expression transform sees
+// whole. Longer lines are rewritten a piece at a time.
+const transformLine = 64 << 10
+
+// A Transform rewrites winning response bodies as they stream to the
+// client, without reading them whole first.
+type Transform interface {
+	// Accepts reports whether the transform applies to resp, whose body is
+	// uncompressed.
+	Accepts(resp *http.Response) bool
+
+	// Wrap returns body as the transform rewrites it.
+	Wrap(body io.Reader) io.Reader
+}
+
+// Transforms rewrite the bodies of winning responses, under the route of
+// the longest path prefix a request matches, with the pipeline of
+// transforms given for it, in order.
+type Transforms struct {
+	routes []transformRoute
+
+	applied *metricVec
+}
+
+type transformRoute struct {
+	prefix    string
+	pipeline  []Transform
+	transform []string
+}
+
+// NewTransforms returns transforms from routes, path prefixes mapped to
+// the specifications of their transforms, as for ParseTransform.
+func NewTransforms(routes map[string][]string) (*Transforms, error) {
+	ts := &Transforms{}
+	for prefix, specs := range routes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%q is not a path prefix", prefix)
+		}
+		route := transformRoute{prefix: prefix, transform: specs}
+		for _, spec := range specs {
+			t, err := ParseTransform(spec)
+			if err != nil {
+				return nil, err
+			}
+			route.pipeline = append(route.pipeline, t)
+		}
+		ts.routes = append(ts.routes, route)
+	}
+	slices.SortFunc(ts.routes, func(a, b transformRoute) int { return len(b.prefix) - len(a.prefix) })
+	return ts, nil
+}
+
+// WithTransforms rewrites winning responses as ts says.
+func WithTransforms(ts *Transforms) Option {
+	return func(p *Proxy) { p.transforms = ts }
+}
+
+// ParseTransform returns the transform spec describes, one of
+//
+//	s/<regexp>/<replacement>/      replace every match, line by line, in text
+//	json-set:<field>=<json value>  set a top-level field of a JSON object
+//	html-base:<url>                give an HTML page a <base href>
+//
+// The s form may use any delimiter in place of /, and the replacement may
+// refer to groups as $1 or ${name}.
+func ParseTransform(spec string) (Transform, error) {
+	switch {
+	case strings.HasPrefix(spec, "json-set:"):
+		field, value, ok := strings.Cut(strings.TrimPrefix(spec, "json-set:"), "=")
+		if !ok || field == "" || !json.Valid([]byte(value)) {
+			return nil, fmt.Errorf("%q is not of the form json-set:<field>=<json value>", spec)
+		}
+		name, _ := json.Marshal(field)
+		return &jsonSet{member: append(append(name, ':'), value...)}, nil
+	case strings.HasPrefix(spec, "html-base:"):
+		href := strings.TrimPrefix(spec, "html-base:")
+		if href == "" {
+			return nil, fmt.Errorf("%q names no URL", spec)
+		}
+		return &htmlBase{tag: []byte(`<base href="` + html.EscapeString(href) + `">`)}, nil
+	case len(spec) > 1 && spec[0] == 's':
+		parts := strings.Split(spec[2:], spec[1:2])
+		if len(parts) != 3 || parts[2] != "" {
+			return nil, fmt.Errorf("%q is not of the form s/<regexp>/<replacement>/", spec)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", spec, err)
+		}
+		return &replace{re: re, repl: []byte(parts[1])}, nil
+	}
+	return nil, fmt.Errorf("%q is not an s/…/…/, json-set: or html-base: transform", spec)
+}
+
+// apply rewrites the body of resp, the winning answer to r, if the route
+// of r has transforms for it. Its length changes, so Content-Length is
+// dropped and a strong ETag made weak.
+func (ts *Transforms) apply(r *http.Request, resp *http.Response) {
+	if ts == nil || r.Method == http.MethodHead || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	i := slices.IndexFunc(ts.routes, func(route transformRoute) bool { return strings.HasPrefix(r.URL.Path, route.prefix) })
+	if i < 0 {
+		return
+	}
+	route := ts.routes[i]
+	var body io.Reader = resp.Body
+	for j, t := range route.pipeline {
+		if t.Accepts(resp) {
+			body = t.Wrap(body)
+			ts.applied.inc(route.prefix, route.transform[j])
+		}
+	}
+	if body == resp.Body {
+		return
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// mediaType returns the media type of resp.
+func mediaType(resp *http.Response) string {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt
+}
+
+// replace rewrites every match of a regular expression in a text body. A
+// match can't span lines.
+type replace struct {
+	re   *regexp.Regexp
+	repl []byte
+}
+
+func (t *replace) Accepts(resp *http.Response) bool {
+	mt := mediaType(resp)
+	return strings.HasPrefix(mt, "text/") || mt == "application/json" || strings.HasSuffix(mt, "+json") ||
+		mt == "application/javascript" || mt == "application/xml" || strings.HasSuffix(mt, "+xml")
+}
+
+func (t *replace) Wrap(body io.Reader) io.Reader {
+	return &lineReplacer{t: t, br: bufio.NewReaderSize(body, transformLine)}
+}
+
+type lineReplacer struct {
+	t   *replace
+	br  *bufio.Reader
+	out []byte
+	err error
+}
+
+func (l *lineReplacer) Read(b []byte) (int, error) {
+	for len(l.out) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		line, err := l.br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = nil
+		}
+		l.out = l.t.re.ReplaceAll(line, l.t.repl)
+		l.err = err
+	}
+	n := copy(b, l.out)
+	l.out = l.out[n:]
+	return n, nil
+}
+
+// jsonSet adds a member to a JSON object body, last, so that it wins over
+// one of the same name for most parsers. A body that isn't an object is
+// left as it is.
+type jsonSet struct {
+	member []byte
+}
+
+func (t *jsonSet) Accepts(resp *http.Response) bool {
+	mt := mediaType(resp)
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+func (t *jsonSet) Wrap(body io.Reader) io.Reader {
+	return &jsonSetter{t: t, r: body}
+}
+
+type jsonSetter struct {
+	t *jsonSet
+	r io.Reader
+
+	started, object bool
+
+	// members is set once the object is known to have members, and held
+	// is what follows the last } read, which may close it.
+	members bool
+	held    []byte
+
+	buf, out []byte
+	err      error
+}
+
+func (s *jsonSetter) Read(b []byte) (int, error) {
+	if s.buf == nil {
+		s.buf = make([]byte, 32<<10)
+	}
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		n, err := s.r.Read(s.buf)
+		s.feed(s.buf[:n])
+		if err != nil {
+			if err == io.EOF && s.object && len(s.held) > 0 {
+				if s.members {
+					s.out = append(s.out, ',')
+				}
+				s.out = append(s.out, s.t.member...)
+			}
+			s.out = append(s.out, s.held...)
+			s.held = nil
+			s.err = err
+		}
+	}
+	n := copy(b, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// feed takes the next chunk of the body.
+func (s *jsonSetter) feed(chunk []byte) {
+	if !s.started {
+		i := bytes.IndexFunc(chunk, func(r rune) bool { return !isJSONSpace(r) })
+		if i < 0 {
+			s.out = append(s.out, chunk...)
+			return
+		}
+		s.started, s.object = true, chunk[i] == '{'
+		if !s.object {
+			s.out = append(s.out, chunk...)
+			return
+		}
+		s.out = append(s.out, chunk[:i+1]...)
+		chunk = chunk[i+1:]
+	}
+	if !s.object {
+		s.out = append(s.out, chunk...)
+		return
+	}
+	data := append(s.held, chunk...)
+	k := bytes.LastIndexByte(data, '}')
+	if k < 0 {
+		k = len(data)
+	}
+	s.members = s.members || bytes.IndexFunc(data[:k], func(r rune) bool { return !isJSONSpace(r) }) >= 0
+	s.out = append(s.out, data[:k]...)
+	s.held = slices.Clone(data[k:])
+}
+
+func isJSONSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// htmlBase inserts a <base> tag just after an HTML page's <head> tag, so
+// that it comes before, and wins over, any the page has. If there is no
+// <head> tag near the start, the page is left as it is.
+type htmlBase struct {
+	tag []byte
+}
+
+func (t *htmlBase) Accepts(resp *http.Response) bool {
+	return mediaType(resp) == "text/html"
+}
+
+func (t *htmlBase) Wrap(body io.Reader) io.Reader {
+	return &headInserter{tag: t.tag, body: body}
+}
+
+type headInserter struct {
+	tag  []byte
+	body io.Reader
+	r    io.Reader
+}
+
+func (h *headInserter) Read(b []byte) (int, error) {
+	if h.r == nil {
+		head := make([]byte, bannerSearch)
+		n, err := io.ReadFull(h.body, head)
+		head = insertAfterTag(head[:n], "<head", h.tag)
+		h.r = io.MultiReader(bytes.NewReader(head), h.body)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			h.r = io.MultiReader(bytes.NewReader(head), errReader{err})
+		}
+	}
+	return h.r.Read(b)
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// insertAfterTag returns b with ins inserted just after the first opening
+// tag of the element named by tag, such as "<body", or b as it is if it
+// has none.
+func insertAfterTag(b []byte, tag string, ins []byte) []byte {
+	lower := bytes.ToLower(b)
+	for from := 0; ; {
+		i := bytes.Index(lower[from:], []byte(tag))
+		if i < 0 {
+			return b
+		}
+		i += from + len(tag)
+		from = i
+		if i < len(b) && !strings.ContainsRune(" \t\r\n/>", rune(b[i])) {
+			// <header, say, for <head.
+			continue
+		}
+		j := bytes.IndexByte(b[i:], '>')
+		if j < 0 {
+			return b
+		}
+		at := i + j + 1
+		return append(b[:at:at], append(slices.Clone(ins), b[at:]...)...)
+	}
+}
@@ -0,0 +1,6 @@
+package multireq
+
+// Version is reported by multireq and sent in its default User-Agent.
+// Release builds set it with
+// -ldflags "-X github.com/whyrusleeping/multireq.Version=<version>".
+var Version = "0.1.0-dev"